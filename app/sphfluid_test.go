@@ -20,11 +20,16 @@ func TestSPH(t *testing.T) {
 	//4. Bind GL Programs to Geometry & Rende
 
 	//Fluid Setup
-	var mfp = F.MassFluidParticle{0.001, 0.3, 0.1, 0.5, 0.1 / 1500, 1500, 1, 1.4} //Particle Mass Description
-	var boxfluid = F.BoxFluidSystem{V.Vec32{0, 0, -5}, 2, 2, 2, 9, 9, 9}          //Box System Description
-	var sphfluid = F.SPHFluid{}                                                   //Main Fluid Component
+	var boxfluid = F.BoxFluidSystem{V.Vec32{0, 0, -5}, 2, 2, 2, 9, 9, 9} //Box System Description
+	var sphfluid = F.SPHFluid{}                                          //Main Fluid Component
 
-	sphfluid.Initialize(&boxfluid, &mfp)
+	mfp, err := F.NewBoxMassFluidParticle(&boxfluid, 1000, 30, 1e-3, 2) //Particle Mass Description
+	if err != nil {
+		t.Fatalf("Particle description failed: %s\n", err.Error())
+	}
+	if err := sphfluid.Initialize(&boxfluid, mfp); err != nil {
+		t.Fatalf("Fluid initialization failed: %s\n", err.Error())
+	}
 	//Set OpenGL Windowing Context with GLFW and GO-GL Bindings
 	glWindowProperties := AppWindow{1440, 800, "Diesel Particle SPH"}
 	runtime.LockOSThread() //OpenGL can only handle one thread context
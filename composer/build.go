@@ -0,0 +1,416 @@
+package composer
+
+import (
+	"bufio"
+	"diesel.com/diesel/fluid"
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Simulation - Fluid built from a scene together with its emitters, force fields and outputs
+type Simulation struct {
+	Scene    *Scene
+	Fluid    *fluid.SPHFluid
+	Emitters []*Emitter
+	Fields   []ForceField
+	Outputs  []OutputSpec
+	Steps    int //Completed steps
+}
+
+//ForceField - Body acceleration at a particle position and velocity at time t
+type ForceField interface {
+	Acceleration(p V.Vec32, v V.Vec32, t float32) V.Vec32
+}
+
+//Emitter - Runtime state of an emitter
+type Emitter struct {
+	Spec      EmitterSpec
+	Layer     []V.Vec32 //Lattice of one emitted layer
+	travelled float32   //Inflow distance since the last layer
+}
+
+//Build - Creates the simulation described by the scene. Build errors are SceneErrors pointing at the
+//scene value that caused them
+func (s *Scene) Build() (*Simulation, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	material, err := s.material()
+	if err != nil {
+		return nil, s.wrap("material", err)
+	}
+	neighbors := s.Particles.Neighbors
+	if neighbors == 0 {
+		neighbors = DEFAULT_NEIGHBORS
+	}
+	maxVelocity := s.Particles.MaxVelocity
+	if maxVelocity == 0 {
+		maxVelocity = DEFAULT_MAX_VELOCITY
+	}
+	spacing := s.Particles.Spacing
+	mfp, err := material.Particle(spacing, neighbors, maxVelocity)
+	if err != nil {
+		return nil, s.wrap("particles", err)
+	}
+	if s.Solver.TimeStep > 0 {
+		mfp.TimeStep = s.Solver.TimeStep
+	}
+
+	colliders, err := s.colliders()
+	if err != nil {
+		return nil, err
+	}
+
+	var positions, velocities []V.Vec32
+	var volumes fluid.UnionVolume
+	for i, f := range s.Fluids {
+		path := fmt.Sprintf("fluids[%d]", i)
+		volume, err := s.volume(path, &f)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+		var points []V.Vec32
+		if f.Sampling == "poisson" {
+			points, err = fluid.PoissonDisk(volume, fluid.PoissonSpacing(spacing), int64(i))
+		} else {
+			points, err = fluid.FillVolume(volume, spacing, f.Jitter, int64(i))
+		}
+		if err != nil {
+			return nil, s.wrap(path, err)
+		}
+		if len(points) == 0 {
+			return nil, s.wrap(path, fmt.Errorf("volume is smaller than the particle spacing"))
+		}
+		for _, p := range points {
+			positions = append(positions, p)
+			velocities = append(velocities, f.Velocity)
+		}
+	}
+	emitters := make([]*Emitter, len(s.Emitters))
+	for i, e := range s.Emitters {
+		layer, err := fluid.FillVolume(&fluid.BoxVolume{Center: e.Center, Size: e.Size}, spacing, 0, 0)
+		if err != nil {
+			return nil, s.wrap(fmt.Sprintf("emitters[%d]", i), err)
+		}
+		emitters[i] = &Emitter{Spec: e, Layer: layer, travelled: spacing}
+	}
+	sim := &Simulation{Scene: s, Fluid: &fluid.SPHFluid{Workers: s.Solver.Workers}, Emitters: emitters, Outputs: s.Outputs}
+	if err := sim.Fluid.InitializeParticles(positions, colliders, mfp); err != nil {
+		return nil, s.wrap("fluids", err)
+	}
+	copy(sim.Fluid.Velocities, velocities)
+	if s.Solver.Search != "" {
+		if err := sim.Fluid.SetNeighborSearch(s.Solver.Search); err != nil {
+			return nil, s.wrap("solver.neighbor_search", err)
+		}
+	}
+	if s.Solver.Relax > 0 && len(volumes) > 0 {
+		if _, err := sim.Fluid.Relax(s.Solver.Relax, s.Solver.RelaxTol, volumes); err != nil {
+			return nil, s.wrap("solver.relax", err)
+		}
+	}
+
+	for _, f := range s.Forces {
+		if f.Type == "gravity" { //Body acceleration of the solver, fields add the same m a as forces
+			gravity := f.Vector
+			sim.Fluid.Gravity = &gravity
+			continue
+		}
+		sim.Fields = append(sim.Fields, NewForceField(f))
+	}
+	sim.Fluid.ReorderEvery = s.Solver.Reorder
+	if s.Solver.Watchdog {
+		sim.Fluid.Watchdog = sim.Fluid.NewWatchdog()
+	}
+	for _, o := range s.Outputs {
+		if o.Type == "diagnostics" {
+			sim.Fluid.Recorder = &fluid.DiagnosticsSeries{}
+		}
+	}
+	return sim, nil
+}
+
+//colliders - Domain box and collider meshes merged into one collider mesh
+func (s *Scene) colliders() (*G.Mesh, error) {
+	mesh := &G.Mesh{}
+	if s.Domain != nil {
+		mesh.Merge(G.Box(s.Domain.Size[0], s.Domain.Size[1], s.Domain.Size[2], s.Domain.Center))
+	}
+	for i, c := range s.Colliders {
+		switch c.Type {
+		case "box":
+			mesh.Merge(G.Box(c.Size[0], c.Size[1], c.Size[2], c.Center))
+		case "mesh":
+			m, err := s.loadMesh(fmt.Sprintf("colliders[%d].file", i), c.File, c.Scale, c.Offset)
+			if err != nil {
+				return nil, err
+			}
+			mesh.Merge(m)
+		}
+	}
+	return mesh, nil
+}
+
+//loadMesh - OBJ mesh relative to the scene, scaled (0 keeps the size) and translated
+func (s *Scene) loadMesh(path string, file string, scale float32, offset V.Vec32) (*G.Mesh, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(s.Dir, file)
+	}
+	m, err := G.LoadOBJ(file)
+	if err != nil {
+		return nil, s.wrap(path, err)
+	}
+	if scale == 0 {
+		scale = 1
+	}
+	m.Transform(scale, offset)
+	return m, nil
+}
+
+//volume - Fluid volume of a (validated) volume spec
+func (s *Scene) volume(path string, v *VolumeSpec) (fluid.Volume, error) {
+	var volume fluid.Volume
+	switch v.Shape {
+	case "", "box":
+		volume = &fluid.BoxVolume{Center: v.Center, Size: v.Size}
+	case "sphere":
+		volume = &fluid.SphereVolume{Center: v.Center, Radius: v.Radius}
+	case "cylinder":
+		axis := v.Axis
+		if V.Length(axis) == 0 {
+			axis = V.Vec32{0, 1, 0}
+		}
+		volume = &fluid.CylinderVolume{Base: v.Center, Axis: axis, Radius: v.Radius, Height: v.Height}
+	case "mesh":
+		m, err := s.loadMesh(path+".file", v.File, v.Scale, v.Offset)
+		if err != nil {
+			return nil, err
+		}
+		volume = &fluid.MeshVolume{Mesh: m}
+	}
+	if len(v.Subtract) == 0 {
+		return volume, nil
+	}
+	diff := &fluid.DifferenceVolume{Volume: volume}
+	for i := range v.Subtract {
+		sub, err := s.volume(fmt.Sprintf("%s.subtract[%d]", path, i), &v.Subtract[i])
+		if err != nil {
+			return nil, err
+		}
+		diff.Subtract = append(diff.Subtract, sub)
+	}
+	return diff, nil
+}
+
+//Emit - Emits a layer for every particle spacing the inflow advanced during dt. Layers after the first
+//are shifted along the inflow so they do not overlap the particles emitted before
+func (e *Emitter) Emit(f *fluid.SPHFluid, t float32, dt float32, spacing float32) error {
+	if t < e.Spec.Start || (e.Spec.Stop > 0 && t >= e.Spec.Stop) {
+		return nil
+	}
+	speed := V.Length(e.Spec.Velocity)
+	dir := V.Scale(e.Spec.Velocity, 1/speed)
+	for e.travelled >= spacing {
+		e.travelled -= spacing
+		shift := V.Scale(dir, e.travelled)
+		layer := make([]V.Vec32, len(e.Layer))
+		velocities := make([]V.Vec32, len(e.Layer))
+		for i, p := range e.Layer {
+			layer[i] = V.Add(p, shift)
+			velocities[i] = e.Spec.Velocity
+		}
+		if _, err := f.AddParticles(layer, velocities); err != nil {
+			return err
+		}
+	}
+	e.travelled += speed * dt
+	return nil
+}
+
+//Advance - Emits, applies the force fields, advances the fluid one step and writes the outputs due
+func (sim *Simulation) Advance() error {
+	f := sim.Fluid
+	t := f.Timer.T
+	for i, e := range sim.Emitters {
+		if err := e.Emit(f, t, f.Timer.TS, sim.Scene.Particles.Spacing); err != nil {
+			return fmt.Errorf("Emitter %d: %s", i, err.Error())
+		}
+	}
+	for _, field := range sim.Fields {
+		for i := 0; i < f.Count; i++ {
+			a := field.Acceleration(f.Positions[i], f.Velocities[i], t)
+			f.Forces[i].Add(V.Scale(a, f.Mfp.Mass))
+		}
+	}
+	if err := f.SafeCompute(); err != nil {
+		return err
+	}
+	sim.Steps++
+
+	for _, o := range sim.Outputs {
+		every := o.Every
+		if every == 0 {
+			every = 1
+		}
+		if sim.Steps%every != 0 {
+			continue
+		}
+		var err error
+		switch o.Type {
+		case "checkpoint":
+			err = f.SaveCheckpoint(sim.outputPath(o))
+		case "positions":
+			err = sim.writePositions(sim.outputPath(o))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Done - True once the end time or the step limit is reached
+func (sim *Simulation) Done() bool {
+	solver := sim.Scene.Solver
+	if solver.MaxSteps > 0 && sim.Steps >= solver.MaxSteps {
+		return true
+	}
+	return solver.EndTime > 0 && sim.Fluid.Timer.T >= solver.EndTime
+}
+
+//Run - Advances until done and writes the final outputs
+func (sim *Simulation) Run() error {
+	for !sim.Done() {
+		if err := sim.Advance(); err != nil {
+			return err
+		}
+	}
+	return sim.Finish()
+}
+
+//Finish - Writes the outputs collected over the run (diagnostics)
+func (sim *Simulation) Finish() error {
+	for _, o := range sim.Outputs {
+		if o.Type != "diagnostics" || sim.Fluid.Recorder == nil {
+			continue
+		}
+		file, err := os.Create(sim.outputPath(o))
+		if err != nil {
+			return err
+		}
+		if err := sim.Fluid.Recorder.WriteCSV(file); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//outputPath - Output path relative to the scene with the step number expanded
+func (sim *Simulation) outputPath(o OutputSpec) string {
+	path := o.Path
+	if strings.Contains(path, "%") {
+		path = fmt.Sprintf(path, sim.Steps)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(sim.Scene.Dir, path)
+	}
+	return path
+}
+
+//writePositions - Particle positions and velocities as CSV, one row per particle ID so rows stay stable
+//when the particles are reordered
+func (sim *Simulation) writePositions(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "x,y,z,vx,vy,vz\n")
+	for id := 0; id < sim.Fluid.Count; id++ {
+		i := sim.Fluid.Index(id)
+		p := sim.Fluid.Positions[i]
+		v := sim.Fluid.Velocities[i]
+		fmt.Fprintf(w, "%g,%g,%g,%g,%g,%g\n", p[0], p[1], p[2], v[0], v[1], v[2])
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//-----------------------------------------------------------------------------
+//Force fields
+
+//UniformField - Constant acceleration, optionally limited to a sphere
+type UniformField struct {
+	Vector V.Vec32
+	Center V.Vec32
+	Radius float32
+}
+
+//VortexField - Swirl about an axis through Center. Tangential acceleration Strength, ramping up
+//linearly from the axis over Radius (solid body core) and constant outside
+type VortexField struct {
+	Center   V.Vec32
+	Axis     V.Vec32
+	Strength float32
+	Radius   float32
+}
+
+//AttractorField - Acceleration of Strength towards Center (negative repels), limited to Radius if set
+type AttractorField struct {
+	Center   V.Vec32
+	Strength float32
+	Radius   float32
+}
+
+//NewForceField - Field of a (validated) non gravity force spec
+func NewForceField(f ForceSpec) ForceField {
+	switch f.Type {
+	case "vortex":
+		return &VortexField{f.Center, V.Scale(f.Axis, 1/V.Length(f.Axis)), f.Strength, f.Radius}
+	case "attractor":
+		return &AttractorField{f.Center, f.Strength, f.Radius}
+	}
+	return &UniformField{f.Vector, f.Center, f.Radius}
+}
+
+func (u *UniformField) Acceleration(p V.Vec32, v V.Vec32, t float32) V.Vec32 {
+	if u.Radius > 0 && p.Distance(u.Center) > u.Radius {
+		return V.Vec32{}
+	}
+	return u.Vector
+}
+
+func (vf *VortexField) Acceleration(p V.Vec32, v V.Vec32, t float32) V.Vec32 {
+	r := V.Sub(p, vf.Center)
+	r = V.Sub(r, V.Scale(vf.Axis, V.Dot(r, vf.Axis))) //Radial part
+	d := V.Length(r)
+	if d == 0 {
+		return V.Vec32{}
+	}
+	s := vf.Strength
+	if vf.Radius > 0 && d < vf.Radius {
+		s *= d / vf.Radius
+	}
+	return V.Scale(V.Cross(vf.Axis, r), s/d)
+}
+
+func (af *AttractorField) Acceleration(p V.Vec32, v V.Vec32, t float32) V.Vec32 {
+	r := V.Sub(af.Center, p)
+	d := V.Length(r)
+	if d == 0 || (af.Radius > 0 && d > af.Radius) {
+		return V.Vec32{}
+	}
+	return V.Scale(r, af.Strength/d)
+}
@@ -0,0 +1,152 @@
+package composer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const tankScene = `{
+  "name": "tank",
+  "material": "syrup",
+  "materials": [
+    {"name": "syrup", "rest_density": 1300, "viscosity": 0.5, "surface_tension": 0.05, "stiffness": 3e5, "eos_exp": 7}
+  ],
+  "particles": {"spacing": 0.05, "neighbors": 20, "max_velocity": 2},
+  "domain": {"center": [0.5, 0.5, 0.5], "size": [0.5, 0.5, 0.5]},
+  "fluids": [
+    {"center": [0.5, 0.35, 0.5], "size": [0.2, 0.2, 0.2], "velocity": [0.1, 0, 0]}
+  ],
+  "emitters": [
+    {"center": [0.5, 0.65, 0.5], "size": [0.1, 0.01, 0.1], "velocity": [0, -1, 0]}
+  ],
+  "forces": [
+    {"type": "gravity", "vector": [0, -9.81, 0]},
+    {"type": "vortex", "center": [0.5, 0, 0.5], "axis": [0, 1, 0], "strength": 0.5, "radius": 0.1}
+  ],
+  "solver": {"max_steps": 3},
+  "outputs": [
+    {"type": "positions", "path": "frame%03d.csv", "every": 3},
+    {"type": "diagnostics", "path": "diagnostics.csv"}
+  ]
+}`
+
+//Scene files build a fluid with materials, volumes, emitters, forces and outputs
+func TestBuildScene(t *testing.T) {
+	scene, err := ParseScene([]byte(tankScene), "tank.json")
+	if err != nil {
+		t.Fatalf("Failed to parse scene: %s\n", err.Error())
+	}
+	scene.Dir, err = ioutil.TempDir("", "composer")
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	defer os.RemoveAll(scene.Dir)
+
+	sim, err := scene.Build()
+	if err != nil {
+		t.Fatalf("Failed to build scene: %s\n", err.Error())
+	}
+	f := sim.Fluid
+	if f.Count != 64 || f.Mfp.TargetDensity != 1300 || f.Velocities[0][0] != 0.1 {
+		t.Errorf("Unexpected fluid: %d particles, density %f\n", f.Count, f.Mfp.TargetDensity)
+	}
+	if f.Gravity == nil || (*f.Gravity)[1] != -9.81 || len(sim.Fields) != 1 {
+		t.Errorf("Forces were not applied\n")
+	}
+
+	sim.Advance()
+	if f.Count != 64+4 {
+		t.Errorf("Expected the emitter to add one layer of 4 particles, have %d\n", f.Count)
+	}
+	for !sim.Done() {
+		sim.Advance()
+	}
+	sim.Finish()
+	for _, name := range []string{"frame003.csv", "diagnostics.csv"} {
+		if _, err := os.Stat(filepath.Join(scene.Dir, name)); err != nil {
+			t.Errorf("Missing output %s\n", name)
+		}
+	}
+}
+
+//Validation reports every problem with the line of the offending value
+func TestSceneErrors(t *testing.T) {
+	src := strings.Replace(tankScene, `"spacing": 0.05`, `"spacing": -1`, 1)
+	src = strings.Replace(src, `"type": "vortex"`, `"type": "tornado"`, 1)
+	_, err := ParseScene([]byte(src), "tank.json")
+	errs, ok := err.(SceneErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Expected two scene errors, got %v\n", err)
+	}
+	if errs[0].Path != "particles.spacing" || errs[0].Line != 7 {
+		t.Errorf("Expected spacing error on line 7, got %s\n", errs[0].Error())
+	}
+	if errs[1].Path != "forces[1].type" || errs[1].Line != 17 {
+		t.Errorf("Expected force type error on line 17, got %s\n", errs[1].Error())
+	}
+
+	src = strings.Replace(tankScene, `"every": 3`, `"evry": 3`, 1)
+	_, err = ParseScene([]byte(src), "tank.json")
+	if errs, ok := err.(SceneErrors); !ok || errs[0].Line != 21 || errs[0].Path != "outputs[0].evry" {
+		t.Errorf("Expected unknown field error on line 21, got %v\n", err)
+	}
+
+	src = strings.Replace(tankScene, `"max_steps": 3`, `"max_steps": 3, "neighbor_search": "bvh"`, 1)
+	_, err = ParseScene([]byte(src), "tank.json")
+	if errs, ok := err.(SceneErrors); !ok || errs[0].Line != 19 || errs[0].Path != "solver.neighbor_search" {
+		t.Errorf("Expected neighbor search error on line 19, got %v\n", err)
+	}
+
+	src = strings.Replace(tankScene, `"max_steps": 3`, `"max_steps": 3, "workers": -2`, 1)
+	_, err = ParseScene([]byte(src), "tank.json")
+	if errs, ok := err.(SceneErrors); !ok || errs[0].Line != 19 || errs[0].Path != "solver.workers" {
+		t.Errorf("Expected workers error on line 19, got %v\n", err)
+	}
+
+	src = strings.Replace(tankScene, `"max_steps": 3`, `"max_steps": "3"`, 1)
+	_, err = ParseScene([]byte(src), "tank.json")
+	if errs, ok := err.(SceneErrors); !ok || errs[0].Line != 19 {
+		t.Errorf("Expected type error on line 19, got %v\n", err)
+	}
+}
+
+const fallScene = `{
+  "name": "fall",
+  "material": "water",
+  "particles": {"spacing": 0.05, "neighbors": 20, "max_velocity": 2},
+  "domain": {"center": [0, 0, 0], "size": [10, 10, 10]},
+  "fluids": [{"center": [0, 0, 0], "size": [0.2, 0.2, 0.2]}],
+  "forces": [FORCES],
+  "solver": {"max_steps": 10}
+}`
+
+//Gravity and force fields are accelerations, a freely falling block accelerates at |g| whatever drives it
+func TestForceUnits(t *testing.T) {
+	for _, forces := range []string{`{"type": "gravity", "vector": [0, -9.81, 0]}`,
+		`{"type": "gravity", "vector": [0, 0, 0]}, {"type": "uniform", "vector": [0, -9.81, 0]}`} {
+		scene, err := ParseScene([]byte(strings.Replace(fallScene, "FORCES", forces, 1)), "fall.json")
+		if err != nil {
+			t.Fatalf("Failed to parse scene: %s\n", err.Error())
+		}
+		sim, err := scene.Build()
+		if err != nil {
+			t.Fatalf("Failed to build scene: %s\n", err.Error())
+		}
+		for !sim.Done() {
+			if err := sim.Advance(); err != nil {
+				t.Fatalf("Step failed: %s\n", err.Error())
+			}
+		}
+		f := sim.Fluid
+		v := float32(0)
+		for i := 0; i < f.Count; i++ {
+			v += f.Velocities[i][1]
+		}
+		if a := v / float32(f.Count) / f.Timer.T; a > -9.81*0.999 || a < -9.81*1.001 {
+			t.Errorf("Block driven by %s accelerates at %f, expected -9.81\n", forces, a)
+		}
+	}
+}
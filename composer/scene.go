@@ -0,0 +1,378 @@
+package composer
+
+import (
+	"diesel.com/diesel/fluid"
+	V "diesel.com/diesel/vector"
+	"fmt"
+	Math "math"
+)
+
+//Package composer - High level fluid parameterization and scene building. A scene file (JSON) describes
+//the fluid material, particle resolution, fluid volumes, colliders, emitters, force fields, solver settings
+//and outputs. Scenes are validated as a whole and every problem is reported with its line in the file
+
+//Scene - Declarative description of a simulation. Lengths are in m, times in s, SI units throughout
+type Scene struct {
+	Name      string           `json:"name"`
+	Material  string           `json:"material"`  //Preset or scene material name, default water
+	Materials []fluid.Material `json:"materials"` //Scene local materials, shadow presets of the same name
+	Particles ParticleSpec     `json:"particles"`
+	Domain    *BoxSpec         `json:"domain"` //Closed container box, optional if colliders enclose the fluid
+	Fluids    []VolumeSpec     `json:"fluids"`
+	Colliders []ColliderSpec   `json:"colliders"`
+	Emitters  []EmitterSpec    `json:"emitters"`
+	Forces    []ForceSpec      `json:"forces"`
+	Solver    SolverSpec       `json:"solver"`
+	Outputs   []OutputSpec     `json:"outputs"`
+
+	Dir    string       `json:"-"` //Directory relative file paths are resolved against
+	File   string       `json:"-"` //Scene file name for error messages
+	source *sourceIndex //Line lookup of the parsed file, nil for scenes built in code
+}
+
+//ParticleSpec - Particle resolution, see fluid.NewMassFluidParticle
+type ParticleSpec struct {
+	Spacing     float32 `json:"spacing"`      //Particle spacing
+	Neighbors   int     `json:"neighbors"`    //Target neighbor count, default 30
+	MaxVelocity float32 `json:"max_velocity"` //Max expected velocity, the speed of sound is at least 10 times it
+}
+
+//BoxSpec - Axis aligned box
+type BoxSpec struct {
+	Center V.Vec32 `json:"center"`
+	Size   V.Vec32 `json:"size"`
+}
+
+//VolumeSpec - Region initially filled with fluid particles on a lattice of the particle spacing
+//(see fluid.FillVolume). Subtracted volumes cut cavities, i.e. the inside of a bottle is a cylinder
+//minus the neck above the fill level
+type VolumeSpec struct {
+	Shape    string       `json:"shape"`    //box (default), sphere, cylinder or mesh
+	Center   V.Vec32      `json:"center"`   //Box and sphere center, cylinder base center
+	Size     V.Vec32      `json:"size"`     //Box size
+	Radius   float32      `json:"radius"`   //Sphere and cylinder radius
+	Height   float32      `json:"height"`   //Cylinder length along Axis
+	Axis     V.Vec32      `json:"axis"`     //Cylinder axis, default +y
+	File     string       `json:"file"`     //Closed OBJ mesh
+	Scale    float32      `json:"scale"`    //Mesh scale, default 1
+	Offset   V.Vec32      `json:"offset"`   //Mesh translation applied after scaling
+	Subtract []VolumeSpec `json:"subtract"` //Regions removed from the volume
+	Sampling string       `json:"sampling"` //lattice (default) or poisson (blue noise)
+	Jitter   float32      `json:"jitter"`   //Random lattice displacement in spacings [0, 0.5]
+	Velocity V.Vec32      `json:"velocity"` //Initial velocity
+}
+
+//ColliderSpec - Static collider, a box or a triangle mesh loaded from an OBJ file
+type ColliderSpec struct {
+	Type   string  `json:"type"` //box or mesh
+	Center V.Vec32 `json:"center"`
+	Size   V.Vec32 `json:"size"`
+	File   string  `json:"file"`
+	Scale  float32 `json:"scale"`  //Mesh scale, default 1
+	Offset V.Vec32 `json:"offset"` //Mesh translation applied after scaling
+}
+
+//EmitterSpec - Inflow box. Whenever the inflow has advanced one particle spacing a lattice layer
+//filling the box is emitted, so the volume rate is the box cross section times the speed
+type EmitterSpec struct {
+	Center   V.Vec32 `json:"center"`
+	Size     V.Vec32 `json:"size"`
+	Velocity V.Vec32 `json:"velocity"`
+	Start    float32 `json:"start"`
+	Stop     float32 `json:"stop"` //0 emits until the end
+}
+
+//ForceSpec - Body force field. Strength and vectors are accelerations (m/s^2). Radius limits the
+//field to a sphere about Center, 0 is unbounded
+type ForceSpec struct {
+	Type     string  `json:"type"` //gravity, uniform, vortex or attractor
+	Vector   V.Vec32 `json:"vector"`
+	Center   V.Vec32 `json:"center"`
+	Axis     V.Vec32 `json:"axis"`
+	Strength float32 `json:"strength"`
+	Radius   float32 `json:"radius"`
+}
+
+//SolverSpec - Time stepping and stability settings
+type SolverSpec struct {
+	TimeStep float32 `json:"time_step"` //0 uses the derived stable time step
+	EndTime  float32 `json:"end_time"`
+	MaxSteps int     `json:"max_steps"`       //0 for no limit
+	Watchdog bool    `json:"watchdog"`        //Roll back and retry unstable steps
+	Relax    int     `json:"relax"`           //Density relaxation iterations before the first step
+	RelaxTol float32 `json:"relax_tolerance"` //RMS density error that ends relaxation early
+	Search   string  `json:"neighbor_search"` //grid (default), kdtree or octree
+	Reorder  int     `json:"reorder_every"`   //Steps between Morton reorderings of the particles, 0 disables
+	Workers  int     `json:"workers"`         //Goroutines of the neighbor search builds, 0 uses every CPU
+}
+
+//OutputSpec - Files written while running. Paths containing a format verb (%d) are expanded with the
+//step number, otherwise the file is overwritten
+type OutputSpec struct {
+	Type  string `json:"type"` //checkpoint, positions (CSV) or diagnostics (CSV written at the end)
+	Path  string `json:"path"`
+	Every int    `json:"every"` //Steps between writes, default every step
+}
+
+const DEFAULT_MATERIAL = "water"
+const DEFAULT_NEIGHBORS = 30
+const DEFAULT_MAX_VELOCITY = 2.0
+
+//problems - Collects validation errors by scene path
+type problems []*SceneError
+
+func (p *problems) add(path string, format string, args ...interface{}) {
+	*p = append(*p, &SceneError{Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+func finite(v float32) bool {
+	return !Math.IsNaN(float64(v)) && !Math.IsInf(float64(v), 0)
+}
+
+func (p *problems) vec(path string, v V.Vec32) {
+	for k := 0; k < 3; k++ {
+		if !finite(v[k]) {
+			p.add(path, "components must be finite")
+			return
+		}
+	}
+}
+
+func (p *problems) size(path string, v V.Vec32) {
+	for k := 0; k < 3; k++ {
+		if !finite(v[k]) || v[k] <= 0 {
+			p.add(path, "size components must be positive, got %v", v)
+			return
+		}
+	}
+}
+
+//Validate - Checks the whole scene and returns every problem found as SceneErrors (nil when valid)
+func (s *Scene) Validate() error {
+	p := problems{}
+
+	names := map[string]bool{}
+	for i := range s.Materials {
+		m := s.Materials[i]
+		path := fmt.Sprintf("materials[%d]", i)
+		if err := m.Validate(); err != nil {
+			p.add(path, "%s", err.Error())
+		}
+		if names[m.Name] {
+			p.add(path+".name", "duplicate material %q", m.Name)
+		}
+		names[m.Name] = true
+	}
+	if _, err := s.material(); err != nil {
+		p.add("material", "%s", err.Error())
+	}
+
+	if !finite(s.Particles.Spacing) || s.Particles.Spacing <= 0 {
+		p.add("particles.spacing", "must be positive, got %g", s.Particles.Spacing)
+	}
+	if n := s.Particles.Neighbors; n != 0 && (n < fluid.MIN_NEIGHBORS || n > fluid.MAX_NEIGHBORS) {
+		p.add("particles.neighbors", "must be within [%d, %d], got %d", fluid.MIN_NEIGHBORS, fluid.MAX_NEIGHBORS, n)
+	}
+	if !finite(s.Particles.MaxVelocity) || s.Particles.MaxVelocity < 0 {
+		p.add("particles.max_velocity", "must not be negative, got %g", s.Particles.MaxVelocity)
+	}
+
+	if s.Domain != nil {
+		p.vec("domain.center", s.Domain.Center)
+		p.size("domain.size", s.Domain.Size)
+	}
+	if len(s.Fluids) == 0 && len(s.Emitters) == 0 {
+		p.add("fluids", "scene needs at least one fluid volume or emitter")
+	}
+	for i, f := range s.Fluids {
+		path := fmt.Sprintf("fluids[%d]", i)
+		s.checkVolume(&p, path, &f)
+		p.vec(path+".velocity", f.Velocity)
+		if !finite(f.Jitter) || f.Jitter < 0 || f.Jitter > 0.5 {
+			p.add(path+".jitter", "must be within [0, 0.5], got %g", f.Jitter)
+		}
+		if f.Sampling != "" && f.Sampling != "lattice" && f.Sampling != "poisson" {
+			p.add(path+".sampling", "unknown sampling %q, expected lattice or poisson", f.Sampling)
+		}
+	}
+
+	if s.Domain == nil && len(s.Colliders) == 0 {
+		p.add("colliders", "scene needs a domain or at least one collider")
+	}
+	for i, c := range s.Colliders {
+		path := fmt.Sprintf("colliders[%d]", i)
+		switch c.Type {
+		case "box":
+			p.vec(path+".center", c.Center)
+			p.size(path+".size", c.Size)
+		case "mesh":
+			if c.File == "" {
+				p.add(path+".file", "mesh collider needs an OBJ file")
+			}
+			if !finite(c.Scale) || c.Scale < 0 {
+				p.add(path+".scale", "must not be negative, got %g", c.Scale)
+			}
+			p.vec(path+".offset", c.Offset)
+		default:
+			p.add(path+".type", "unknown collider type %q, expected box or mesh", c.Type)
+		}
+	}
+
+	for i, e := range s.Emitters {
+		path := fmt.Sprintf("emitters[%d]", i)
+		p.vec(path+".center", e.Center)
+		p.size(path+".size", e.Size)
+		p.vec(path+".velocity", e.Velocity)
+		if V.Length(e.Velocity) == 0 {
+			p.add(path+".velocity", "emitter velocity must not be zero")
+		}
+		if !finite(e.Start) || e.Start < 0 {
+			p.add(path+".start", "must not be negative, got %g", e.Start)
+		}
+		if !finite(e.Stop) || (e.Stop != 0 && e.Stop < e.Start) {
+			p.add(path+".stop", "must be 0 or after start, got %g", e.Stop)
+		}
+		s.checkInside(&p, path, e.Center, e.Size)
+	}
+
+	gravity := 0
+	for i, f := range s.Forces {
+		path := fmt.Sprintf("forces[%d]", i)
+		p.vec(path+".vector", f.Vector)
+		p.vec(path+".center", f.Center)
+		if !finite(f.Strength) || !finite(f.Radius) || f.Radius < 0 {
+			p.add(path, "strength must be finite and radius not negative")
+		}
+		switch f.Type {
+		case "gravity":
+			gravity++
+			if gravity > 1 {
+				p.add(path+".type", "only one gravity force is allowed")
+			}
+		case "uniform":
+		case "vortex":
+			p.vec(path+".axis", f.Axis)
+			if V.Length(f.Axis) == 0 {
+				p.add(path+".axis", "vortex axis must not be zero")
+			}
+		case "attractor":
+		default:
+			p.add(path+".type", "unknown force type %q, expected gravity, uniform, vortex or attractor", f.Type)
+		}
+	}
+
+	if !finite(s.Solver.TimeStep) || s.Solver.TimeStep < 0 {
+		p.add("solver.time_step", "must not be negative, got %g", s.Solver.TimeStep)
+	}
+	if !finite(s.Solver.EndTime) || s.Solver.EndTime < 0 {
+		p.add("solver.end_time", "must not be negative, got %g", s.Solver.EndTime)
+	}
+	if s.Solver.Relax < 0 {
+		p.add("solver.relax", "must not be negative, got %d", s.Solver.Relax)
+	}
+	if !finite(s.Solver.RelaxTol) || s.Solver.RelaxTol < 0 {
+		p.add("solver.relax_tolerance", "must not be negative, got %g", s.Solver.RelaxTol)
+	}
+	if s.Solver.Reorder < 0 {
+		p.add("solver.reorder_every", "must not be negative, got %d", s.Solver.Reorder)
+	}
+	if s.Solver.Workers < 0 {
+		p.add("solver.workers", "must not be negative, got %d", s.Solver.Workers)
+	}
+	if s.Solver.MaxSteps < 0 {
+		p.add("solver.max_steps", "must not be negative, got %d", s.Solver.MaxSteps)
+	}
+	switch s.Solver.Search {
+	case "", fluid.SEARCH_GRID, fluid.SEARCH_KDTREE, fluid.SEARCH_OCTREE:
+	default:
+		p.add("solver.neighbor_search", "unknown neighbor search %q, expected grid, kdtree or octree", s.Solver.Search)
+	}
+	if s.Solver.EndTime == 0 && s.Solver.MaxSteps == 0 {
+		p.add("solver", "end_time or max_steps is required")
+	}
+
+	for i, o := range s.Outputs {
+		path := fmt.Sprintf("outputs[%d]", i)
+		switch o.Type {
+		case "checkpoint", "positions", "diagnostics":
+		default:
+			p.add(path+".type", "unknown output type %q, expected checkpoint, positions or diagnostics", o.Type)
+		}
+		if o.Path == "" {
+			p.add(path+".path", "output path is required")
+		}
+		if o.Every < 0 {
+			p.add(path+".every", "must not be negative, got %d", o.Every)
+		}
+	}
+
+	if len(p) == 0 {
+		return nil
+	}
+	return s.locate(p)
+}
+
+//checkVolume - Shape parameters of a volume and its subtracted volumes
+func (s *Scene) checkVolume(p *problems, path string, v *VolumeSpec) {
+	switch v.Shape {
+	case "", "box":
+		p.vec(path+".center", v.Center)
+		p.size(path+".size", v.Size)
+		s.checkInside(p, path, v.Center, v.Size)
+	case "sphere", "cylinder":
+		p.vec(path+".center", v.Center)
+		if !finite(v.Radius) || v.Radius <= 0 {
+			p.add(path+".radius", "must be positive, got %g", v.Radius)
+		}
+		if v.Shape == "cylinder" {
+			p.vec(path+".axis", v.Axis)
+			if !finite(v.Height) || v.Height <= 0 {
+				p.add(path+".height", "must be positive, got %g", v.Height)
+			}
+		}
+	case "mesh":
+		if v.File == "" {
+			p.add(path+".file", "mesh volume needs an OBJ file")
+		}
+		if !finite(v.Scale) || v.Scale < 0 {
+			p.add(path+".scale", "must not be negative, got %g", v.Scale)
+		}
+		p.vec(path+".offset", v.Offset)
+	default:
+		p.add(path+".shape", "unknown shape %q, expected box, sphere, cylinder or mesh", v.Shape)
+	}
+	for i := range v.Subtract {
+		s.checkVolume(p, fmt.Sprintf("%s.subtract[%d]", path, i), &v.Subtract[i])
+	}
+}
+
+//checkInside - Boxes must lie inside the domain when one is given
+func (s *Scene) checkInside(p *problems, path string, center V.Vec32, size V.Vec32) {
+	if s.Domain == nil {
+		return
+	}
+	for k := 0; k < 3; k++ {
+		lo := center[k] - size[k]/2
+		hi := center[k] + size[k]/2
+		dlo := s.Domain.Center[k] - s.Domain.Size[k]/2
+		dhi := s.Domain.Center[k] + s.Domain.Size[k]/2
+		if lo < dlo || hi > dhi {
+			p.add(path, "box extends outside the domain")
+			return
+		}
+	}
+}
+
+//material - Scene local material or preset, water when none is named
+func (s *Scene) material() (fluid.Material, error) {
+	name := s.Material
+	if name == "" {
+		name = DEFAULT_MATERIAL
+	}
+	for _, m := range s.Materials {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return fluid.GetMaterial(name)
+}
@@ -0,0 +1,216 @@
+package composer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//SceneError - Problem in a scene description. Line and Column are 1 based and 0 when the scene was
+//not parsed from a file. Path names the offending value (i.e. fluids[0].size)
+type SceneError struct {
+	File   string
+	Line   int
+	Column int
+	Path   string
+	Reason string
+}
+
+func (e *SceneError) Error() string {
+	loc := e.File
+	if e.Line > 0 {
+		loc = fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s: %s", loc, e.Path, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", loc, e.Reason)
+}
+
+//SceneErrors - Every problem found in a scene, in file order
+type SceneErrors []*SceneError
+
+func (e SceneErrors) Error() string {
+	lines := make([]string, len(e))
+	for i := range e {
+		lines[i] = e[i].Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+//sourceIndex - Byte offsets of every key and array element of a JSON document by scene path
+type sourceIndex struct {
+	data    []byte
+	offsets map[string]int
+}
+
+//LoadScene - Reads and validates a scene file. Relative paths in the scene resolve against its directory
+func LoadScene(path string) (*Scene, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseScene(data, filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	s.Dir = filepath.Dir(path)
+	return s, nil
+}
+
+//ParseScene - Decodes and validates scene JSON. Syntax, type, unknown field and validation errors are
+//returned as SceneErrors carrying the line of the offending value. file is only used in messages
+func ParseScene(data []byte, file string) (*Scene, error) {
+	s := &Scene{File: file}
+	s.source = indexSource(data)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		e := &SceneError{File: file, Reason: err.Error()}
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			e.Line, e.Column = s.source.position(int(err.Offset))
+		case *json.UnmarshalTypeError:
+			e.Line, e.Column = s.source.position(int(err.Offset))
+			e.Path = err.Field
+			e.Reason = fmt.Sprintf("expected %s, got %s", err.Type.String(), err.Value)
+		default:
+			if strings.HasPrefix(err.Error(), "json: unknown field ") {
+				key, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+				e.Path = s.source.find(key)
+				e.Line, e.Column = s.source.lookup(e.Path)
+				e.Reason = fmt.Sprintf("unknown field %q", key)
+			}
+		}
+		return nil, SceneErrors{e}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//locate - Attaches file and line information to scene errors
+func (s *Scene) locate(p problems) SceneErrors {
+	for _, e := range p {
+		e.File = s.File
+		e.Line, e.Column = s.source.lookup(e.Path)
+	}
+	errs := SceneErrors(p)
+	for i := 1; i < len(errs); i++ { //Insertion sort keeps the validation order for equal lines
+		for j := i; j > 0 && errs[j].Line < errs[j-1].Line; j-- {
+			errs[j], errs[j-1] = errs[j-1], errs[j]
+		}
+	}
+	return errs
+}
+
+//wrap - Scene error for a build failure of the value at path
+func (s *Scene) wrap(path string, err error) error {
+	e := &SceneError{File: s.File, Path: path, Reason: err.Error()}
+	e.Line, e.Column = s.source.lookup(path)
+	return SceneErrors{e}
+}
+
+//indexSource - Records where every value starts. Malformed documents are indexed up to the error
+func indexSource(data []byte) *sourceIndex {
+	s := &sourceIndex{data, map[string]int{}}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	s.walk(dec, "")
+	return s
+}
+
+func (s *sourceIndex) walk(dec *json.Decoder, path string) error {
+	if _, ok := s.offsets[path]; !ok {
+		s.offsets[path] = s.start(int(dec.InputOffset()))
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			off := s.start(int(dec.InputOffset()))
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			child := fmt.Sprintf("%v", key)
+			if path != "" {
+				child = path + "." + child
+			}
+			s.offsets[child] = off
+			if err := s.walk(dec, child); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := s.walk(dec, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+//start - Skips separators and white space to the first byte of the next token
+func (s *sourceIndex) start(off int) int {
+	for off < len(s.data) && strings.IndexByte(" \t\r\n,:", s.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+//position - Line and column of a byte offset
+func (s *sourceIndex) position(off int) (int, int) {
+	if s == nil {
+		return 0, 0
+	}
+	if off > len(s.data) {
+		off = len(s.data)
+	}
+	line := 1 + bytes.Count(s.data[:off], []byte{'\n'})
+	col := off - bytes.LastIndexByte(s.data[:off], '\n')
+	return line, col
+}
+
+//lookup - Position of a path, falling back to the closest enclosing value that is present in the file
+func (s *sourceIndex) lookup(path string) (int, int) {
+	if s == nil {
+		return 0, 0
+	}
+	for {
+		if off, ok := s.offsets[path]; ok {
+			return s.position(off)
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			if path == "" {
+				return 0, 0
+			}
+			path = ""
+			continue
+		}
+		path = path[:cut]
+	}
+}
+
+//find - First path in the file whose last element is key
+func (s *sourceIndex) find(key string) string {
+	best, found := -1, ""
+	for path, off := range s.offsets {
+		if (path == key || strings.HasSuffix(path, "."+key)) && (best < 0 || off < best) {
+			best, found = off, path
+		}
+	}
+	return found
+}
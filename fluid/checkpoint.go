@@ -0,0 +1,533 @@
+package fluid
+
+import (
+	"bytes"
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+)
+
+//Checkpoint file layout (little endian):
+//  header  - magic "DSPH", uint32 version, uint64 payload length, uint32 CRC32 (IEEE) of the payload
+//  payload - timer, particle count, steps since the last reorder, particle description, gravity, grid,
+//            colliders, particle buffers and IDs followed by the optional thermal, granular, scalar, elastic
+//            solid and diffuse sections
+//Watchdog, diagnostics recorder, periodic domain, search backend, reorder interval, worker count and the
+//grid sample cap are run configuration, not state, and are not stored - they are kept from the loading fluid.
+//Diffuse particle random numbers are reseeded from the simulation time on load
+
+const CHECKPOINT_VERSION = 5
+
+var checkpointMagic = [4]byte{'D', 'S', 'P', 'H'}
+
+type checkpointHeader struct {
+	Magic   [4]byte
+	Version uint32
+	Length  uint64
+	CRC     uint32
+}
+
+//ckWriter - Binary writer keeping the first error
+type ckWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *ckWriter) put(v interface{}) {
+	if c.err == nil {
+		c.err = binary.Write(c.w, binary.LittleEndian, v)
+	}
+}
+
+func (c *ckWriter) flag(b bool) {
+	if b {
+		c.put(uint8(1))
+	} else {
+		c.put(uint8(0))
+	}
+}
+
+func (c *ckWriter) length(n int) {
+	c.put(uint64(n))
+}
+
+func (c *ckWriter) vecs(v []V.Vec32) {
+	c.length(len(v))
+	c.put(v)
+}
+
+func (c *ckWriter) floats(v []float32) {
+	c.length(len(v))
+	c.put(v)
+}
+
+func (c *ckWriter) mats(v []V.Mat3) {
+	c.length(len(v))
+	c.put(v)
+}
+
+func (c *ckWriter) ints(v []int) {
+	c.length(len(v))
+	for _, i := range v {
+		c.put(int64(i))
+	}
+}
+
+func (c *ckWriter) str(s string) {
+	c.length(len(s))
+	c.put([]byte(s))
+}
+
+//ckReader - Binary reader keeping the first error, lengths are bounded by the payload size
+type ckReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (c *ckReader) get(v interface{}) {
+	if c.err == nil {
+		c.err = binary.Read(c.r, binary.LittleEndian, v)
+	}
+}
+
+func (c *ckReader) flag() bool {
+	var b uint8
+	c.get(&b)
+	return b == 1
+}
+
+func (c *ckReader) length(size int) int {
+	var n uint64
+	c.get(&n)
+	if c.err == nil && n*uint64(size) > uint64(c.r.Len()) {
+		c.err = fmt.Errorf("Checkpoint section length %d exceeds remaining payload", n)
+	}
+	if c.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (c *ckReader) vecs() []V.Vec32 {
+	v := make([]V.Vec32, c.length(12))
+	c.get(v)
+	return v
+}
+
+func (c *ckReader) floats() []float32 {
+	v := make([]float32, c.length(4))
+	c.get(v)
+	return v
+}
+
+func (c *ckReader) mats() []V.Mat3 {
+	v := make([]V.Mat3, c.length(36))
+	c.get(v)
+	return v
+}
+
+func (c *ckReader) ints() []int {
+	n := c.length(8)
+	v := make([]int, n)
+	for i := range v {
+		var x int64
+		c.get(&x)
+		v[i] = int(x)
+	}
+	return v
+}
+
+func (c *ckReader) str() string {
+	b := make([]byte, c.length(1))
+	c.get(b)
+	return string(b)
+}
+
+//SaveCheckpoint - Writes the complete simulation state to a file
+func (fluid *SPHFluid) SaveCheckpoint(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := fluid.WriteCheckpoint(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//LoadCheckpoint - Replaces the simulation state with a checkpoint file
+func (fluid *SPHFluid) LoadCheckpoint(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fluid.ReadCheckpoint(f)
+}
+
+//WriteCheckpoint - Writes header and checksummed payload of the simulation state
+func (fluid *SPHFluid) WriteCheckpoint(w io.Writer) error {
+	if fluid.Mfp == nil || fluid.SPHGrid == nil {
+		return &StateError{-1, "fluid is not initialized"}
+	}
+	fluid.assignIDs() //Fluids assembled by hand may not number their particles yet
+	payload := bytes.Buffer{}
+	c := &ckWriter{w: &payload}
+	fluid.writeState(c)
+	if c.err != nil {
+		return c.err
+	}
+
+	header := checkpointHeader{checkpointMagic, CHECKPOINT_VERSION, uint64(payload.Len()), crc32.ChecksumIEEE(payload.Bytes())}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+//ReadCheckpoint - Verifies header and checksum and replaces the simulation state. The fluid is left
+//untouched if the checkpoint is invalid. The run configuration of the fluid is kept
+func (fluid *SPHFluid) ReadCheckpoint(r io.Reader) error {
+	header := checkpointHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("Checkpoint header: %s", err.Error())
+	}
+	if header.Magic != checkpointMagic {
+		return fmt.Errorf("Not a fluid checkpoint")
+	}
+	if header.Version != CHECKPOINT_VERSION {
+		return fmt.Errorf("Unsupported checkpoint version %d, expected %d", header.Version, CHECKPOINT_VERSION)
+	}
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return fmt.Errorf("Checkpoint payload truncated: %s", err.Error())
+	}
+	if crc32.ChecksumIEEE(payload) != header.CRC {
+		return fmt.Errorf("Checkpoint checksum mismatch")
+	}
+
+	next := &SPHFluid{}
+	c := &ckReader{r: bytes.NewReader(payload)}
+	next.readState(c)
+	if c.err != nil {
+		return fmt.Errorf("Checkpoint payload: %s", c.err.Error())
+	}
+	if err := next.checkState(); err != nil {
+		return err
+	}
+
+	next.Watchdog = fluid.Watchdog
+	next.Recorder = fluid.Recorder
+	next.Search = fluid.Search
+	next.Periodic = fluid.Periodic
+	next.ReorderEvery = fluid.ReorderEvery
+	next.Workers = fluid.Workers
+	if fluid.SPHGrid != nil {
+		next.SPHGrid.MaxSamples = fluid.SPHGrid.MaxSamples
+	}
+	next.applyWorkers()
+	*fluid = *next
+	return nil
+}
+
+func (fluid *SPHFluid) writeState(c *ckWriter) {
+	c.put(fluid.Timer)
+	c.put(int64(fluid.Count))
+	c.put(int64(fluid.sinceReorder))
+	c.put(*fluid.Mfp)
+	c.flag(fluid.Gravity != nil)
+	if fluid.Gravity != nil {
+		c.put(*fluid.Gravity)
+	}
+	c.put(fluid.SPHGrid.Origin)
+	c.put(fluid.SPHGrid.CellSize)
+	c.put(int64(len(fluid.SPHGrid.Table))) //Compact hash buckets, 0 for the dense grid
+	for _, d := range fluid.SPHGrid.Dims {
+		c.put(int64(d))
+	}
+
+	c.flag(fluid.Colliders != nil)
+	if fluid.Colliders != nil {
+		c.vecs(fluid.Colliders.Vertexes)
+		c.vecs(fluid.Colliders.Normals)
+	}
+
+	c.vecs(fluid.Positions)
+	c.vecs(fluid.Velocities)
+	c.vecs(fluid.Forces)
+	c.floats(fluid.Densities)
+	c.floats(fluid.Pressures)
+	c.ints(fluid.IDs)
+
+	c.flag(fluid.Thermal != nil)
+	if pc := fluid.Thermal; pc != nil {
+		c.put([]float32{pc.MeltingPoint, pc.LatentHeat, pc.SpecificHeat, pc.Diffusivity, pc.Ambient, pc.CoolingRate, pc.ViscosityBand, pc.ViscosityScale})
+		c.put(int32(pc.Motion))
+		c.floats(fluid.Temperatures)
+		c.floats(fluid.Latent)
+	}
+
+	phases := make([]int, len(fluid.Phases))
+	for i, p := range fluid.Phases {
+		phases[i] = int(p)
+	}
+	c.ints(phases)
+
+	c.flag(fluid.Granular != nil)
+	if gm := fluid.Granular; gm != nil {
+		c.put([]float32{gm.FrictionAngle, gm.Cohesion, gm.ShearModulus})
+		c.mats(fluid.Stresses)
+	}
+
+	c.length(len(fluid.Scalars))
+	for _, field := range fluid.Scalars {
+		c.str(field.Name)
+		c.put(field.Diffusion)
+		c.floats(field.Values)
+	}
+
+	c.length(len(fluid.Solids))
+	for _, solid := range fluid.Solids {
+		c.put([]float32{solid.YoungModulus, solid.PoissonRatio, solid.Yield, solid.Creep, solid.MaxPlastic})
+		c.ints(solid.Indices)
+		c.vecs(solid.Rest)
+		c.floats(solid.Volumes)
+		c.length(len(solid.Neighbors))
+		for k := range solid.Neighbors {
+			c.ints(solid.Neighbors[k])
+			c.vecs(solid.Gradients[k])
+		}
+		c.mats(solid.DeformGrad)
+		c.mats(solid.Plastic)
+	}
+
+	c.flag(fluid.Diffuse != nil)
+	if ds := fluid.Diffuse; ds != nil {
+		c.put([]float32{ds.TrappedAir[0], ds.TrappedAir[1], ds.WaveCrest[0], ds.WaveCrest[1], ds.Energy[0], ds.Energy[1],
+			ds.TrappedAirRate, ds.WaveCrestRate, ds.Lifetime, ds.Buoyancy, ds.Drag})
+		c.put([]int64{int64(ds.SprayNeighbors), int64(ds.FoamNeighbors), int64(ds.MaxParticles)})
+		c.length(len(ds.Particles))
+		for _, p := range ds.Particles {
+			c.put(p.Position)
+			c.put(p.Velocity)
+			c.put(p.Lifetime)
+			c.put(int32(p.Kind))
+		}
+	}
+}
+
+func (fluid *SPHFluid) readState(c *ckReader) {
+	var count, since, buckets int64
+	var origin V.Vec32
+	var cellSize float32
+	var dims [3]int64
+	mfp := MassFluidParticle{}
+	c.get(&fluid.Timer)
+	c.get(&count)
+	c.get(&since)
+	c.get(&mfp)
+	fluid.Count = int(count)
+	if since > 0 {
+		fluid.sinceReorder = int(since)
+	}
+	fluid.Mfp = &mfp
+	if c.flag() {
+		gravity := V.Vec32{}
+		c.get(&gravity)
+		fluid.Gravity = &gravity
+	}
+	c.get(&origin)
+	c.get(&cellSize)
+	c.get(&buckets)
+	c.get(&dims)
+	if c.err != nil {
+		return
+	}
+	if !isFinite(cellSize) || cellSize <= 0 {
+		c.err = &GridError{fmt.Sprintf("checkpoint grid cell size %f out of range", cellSize)}
+		return
+	}
+	if buckets > 0 {
+		if buckets > int64(c.r.Len())+MIN_HASH_TABLE { //Sized from the particle count, bounded by the payload
+			c.err = &GridError{fmt.Sprintf("checkpoint hash table size %d out of range", buckets)}
+			return
+		}
+		fluid.SPHGrid = AllocateCompactTable(origin, cellSize, int(buckets))
+	} else {
+		for _, d := range dims {
+			if d <= 0 || d > MAX_GRID_SUBDIV {
+				c.err = &GridError{fmt.Sprintf("checkpoint grid dimensions %v out of range", dims)}
+				return
+			}
+		}
+		fluid.SPHGrid = AllocateUniformGrid(origin, cellSize, [3]int{int(dims[0]), int(dims[1]), int(dims[2])})
+	}
+
+	if c.flag() {
+		fluid.Colliders = &G.Mesh{Vertexes: c.vecs(), Normals: c.vecs()}
+	}
+
+	fluid.Positions = c.vecs()
+	fluid.Velocities = c.vecs()
+	fluid.Forces = c.vecs()
+	fluid.Densities = c.floats()
+	fluid.Pressures = c.floats()
+	fluid.IDs = c.ints()
+
+	if c.flag() {
+		p := make([]float32, 8)
+		var motion int32
+		c.get(p)
+		c.get(&motion)
+		fluid.Thermal = &PhaseChange{p[0], p[1], p[2], p[3], p[4], p[5], p[6], p[7], SolidMotion(motion)}
+		fluid.Temperatures = c.floats()
+		fluid.Latent = c.floats()
+	}
+
+	if phases := c.ints(); len(phases) > 0 {
+		fluid.Phases = make([]Phase, len(phases))
+		for i, p := range phases {
+			fluid.Phases[i] = Phase(p)
+		}
+	}
+
+	if c.flag() {
+		p := make([]float32, 3)
+		c.get(p)
+		fluid.Granular = &GranularMaterial{p[0], p[1], p[2]}
+		fluid.Stresses = c.mats()
+	}
+
+	scalars := c.length(1)
+	for i := 0; i < scalars && c.err == nil; i++ {
+		field := &ScalarField{}
+		field.Name = c.str()
+		c.get(&field.Diffusion)
+		field.Values = c.floats()
+		fluid.Scalars = append(fluid.Scalars, field)
+	}
+
+	solids := c.length(1)
+	for i := 0; i < solids && c.err == nil; i++ {
+		p := make([]float32, 5)
+		c.get(p)
+		solid := &ElasticSolid{YoungModulus: p[0], PoissonRatio: p[1], Yield: p[2], Creep: p[3], MaxPlastic: p[4]}
+		solid.Indices = c.ints()
+		solid.Rest = c.vecs()
+		solid.Volumes = c.floats()
+		n := c.length(1)
+		solid.Neighbors = make([][]int, n)
+		solid.Gradients = make([][]V.Vec32, n)
+		for k := 0; k < n && c.err == nil; k++ {
+			solid.Neighbors[k] = c.ints()
+			solid.Gradients[k] = c.vecs()
+		}
+		solid.DeformGrad = c.mats()
+		solid.Plastic = c.mats()
+		fluid.Solids = append(fluid.Solids, solid)
+	}
+
+	if c.flag() {
+		p := make([]float32, 11)
+		n := make([]int64, 3)
+		c.get(p)
+		c.get(n)
+		ds := &DiffuseSystem{
+			TrappedAir:     [2]float32{p[0], p[1]},
+			WaveCrest:      [2]float32{p[2], p[3]},
+			Energy:         [2]float32{p[4], p[5]},
+			TrappedAirRate: p[6],
+			WaveCrestRate:  p[7],
+			Lifetime:       p[8],
+			Buoyancy:       p[9],
+			Drag:           p[10],
+			SprayNeighbors: int(n[0]),
+			FoamNeighbors:  int(n[1]),
+			MaxParticles:   int(n[2]),
+			Rand:           rand.New(rand.NewSource(int64(fluid.Timer.T * 1e6)))}
+		particles := c.length(28)
+		ds.Particles = make([]DiffuseParticle, particles)
+		for k := 0; k < particles && c.err == nil; k++ {
+			var kind int32
+			c.get(&ds.Particles[k].Position)
+			c.get(&ds.Particles[k].Velocity)
+			c.get(&ds.Particles[k].Lifetime)
+			c.get(&kind)
+			ds.Particles[k].Kind = DiffuseKind(kind)
+		}
+		fluid.Diffuse = ds
+	}
+
+	if c.err == nil && c.r.Len() != 0 {
+		c.err = fmt.Errorf("%d trailing bytes", c.r.Len())
+	}
+	if c.err != nil {
+		return
+	}
+
+	fluid.ItrpKernel = InitGaussian(mfp.InnerRadius)
+	fluid.GradKernel = InitCubic(mfp.InnerRadius)
+	if err := fluid.SPHGrid.Load(fluid.Positions); err != nil {
+		c.err = &GridError{err.Error()}
+	}
+}
+
+//checkState - Buffer lengths of a loaded state must agree with the particle count
+func (fluid *SPHFluid) checkState() error {
+	n := fluid.Count
+	if err := fluid.Mfp.Validate(); err != nil {
+		return err
+	}
+	if len(fluid.Positions) != n || len(fluid.Velocities) != n || len(fluid.Forces) != n ||
+		len(fluid.Densities) != n || len(fluid.Pressures) != n {
+		return &StateError{-1, "checkpoint particle buffers do not match the particle count"}
+	}
+	if fluid.Thermal != nil && (len(fluid.Temperatures) != n || len(fluid.Latent) != n || len(fluid.Phases) != n) {
+		return &StateError{-1, "checkpoint thermal buffers do not match the particle count"}
+	}
+	if fluid.Granular != nil && (len(fluid.Stresses) != n || len(fluid.Phases) != n) {
+		return &StateError{-1, "checkpoint granular buffers do not match the particle count"}
+	}
+	if len(fluid.IDs) != n {
+		return &StateError{-1, "checkpoint particle IDs do not match the particle count"}
+	}
+	seen := make([]bool, n)
+	for i, id := range fluid.IDs {
+		if id < 0 || id >= n || seen[id] {
+			return &StateError{i, fmt.Sprintf("checkpoint particle ID %d out of range or repeated", id)}
+		}
+		seen[id] = true
+	}
+	for _, field := range fluid.Scalars {
+		if len(field.Values) != n {
+			return &StateError{-1, fmt.Sprintf("checkpoint scalar %s does not match the particle count", field.Name)}
+		}
+	}
+	for _, solid := range fluid.Solids {
+		if err := fluid.checkIndices("ElasticSolid", solid.Indices); err != nil {
+			return err
+		}
+		k := len(solid.Indices)
+		if len(solid.Rest) != k || len(solid.Volumes) != k || len(solid.Neighbors) != k || len(solid.DeformGrad) != k || len(solid.Plastic) != k {
+			return &StateError{-1, "checkpoint elastic solid buffers are inconsistent"}
+		}
+		for l := range solid.Neighbors {
+			if len(solid.Gradients[l]) != len(solid.Neighbors[l]) {
+				return &StateError{-1, "checkpoint elastic solid neighbors are inconsistent"}
+			}
+			for _, j := range solid.Neighbors[l] {
+				if j < 0 || j >= k {
+					return &StateError{-1, "checkpoint elastic solid neighbor out of range"}
+				}
+			}
+		}
+	}
+	return nil
+}
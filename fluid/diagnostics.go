@@ -0,0 +1,131 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	"fmt"
+	"io"
+	Math "math"
+)
+
+//Diagnostics - Solver quality measures of a single step. Energies are in J, momentum in kg m/s,
+//density errors are relative to the target density
+type Diagnostics struct {
+	Time            float32
+	Mass            float32 //Total mass of the particles at finite positions in kg
+	Volume          float32 //Sum of m / rho, drifts with the compression while the mass is conserved
+	KineticEnergy   float32
+	PotentialEnergy float32 //Potential energy -m g . x of the body acceleration relative to the origin
+	Momentum        V.Vec32
+	AngularMomentum V.Vec32 //About the world origin
+	AvgDensityError float32 //Mean |rho - rho0| / rho0
+	MaxDensityError float32 //Max |rho - rho0| / rho0
+	MaxVelocity     float32
+	MinNeighbors    int
+	MaxNeighbors    int
+	AvgNeighbors    float32
+}
+
+//DiagnosticsSeries - Time series of diagnostics, one sample per recorded step
+type DiagnosticsSeries struct {
+	Samples []Diagnostics
+}
+
+//Diagnose - Computes diagnostics of the current particle state
+func (fluid *SPHFluid) Diagnose() Diagnostics {
+	d := Diagnostics{Time: fluid.Timer.T}
+	if fluid.Count == 0 {
+		return d
+	}
+	mass := float64(fluid.Mfp.Mass)
+	rho0 := float64(fluid.Mfp.TargetDensity)
+	nl := fluid.neighborList()
+	g := fluid.BodyAcceleration()
+	var total, volume, ke, pe, densErr, maxErr, maxVel float64
+	var mom, ang [3]float64
+	neighbors := 0
+	d.MinNeighbors = Math.MaxInt32
+
+	for i := 0; i < fluid.Count; i++ {
+		p := fluid.Positions[i]
+		v := fluid.Velocities[i]
+		if isFinite(p[0]) && isFinite(p[1]) && isFinite(p[2]) {
+			total += mass
+		}
+		if rho := fluid.Densities[i]; rho > 0 {
+			volume += mass / float64(rho)
+		}
+		vsq := float64(V.Dot(v, v))
+		ke += 0.5 * mass * vsq
+		pe -= mass * float64(V.Dot(g, p))
+		maxVel = Math.Max(maxVel, Math.Sqrt(vsq))
+		l := V.Cross(p, v)
+		for k := 0; k < 3; k++ {
+			mom[k] += mass * float64(v[k])
+			ang[k] += mass * float64(l[k])
+		}
+
+		err := Math.Abs(float64(fluid.Densities[i])-rho0) / rho0
+		densErr += err
+		maxErr = Math.Max(maxErr, err)
+
+		n := nl.Count(i)
+		neighbors += n
+		if n < d.MinNeighbors {
+			d.MinNeighbors = n
+		}
+		if n > d.MaxNeighbors {
+			d.MaxNeighbors = n
+		}
+	}
+
+	count := float64(fluid.Count)
+	d.Mass = float32(total)
+	d.Volume = float32(volume)
+	d.KineticEnergy = float32(ke)
+	d.PotentialEnergy = float32(pe)
+	d.Momentum = V.Vec32{float32(mom[0]), float32(mom[1]), float32(mom[2])}
+	d.AngularMomentum = V.Vec32{float32(ang[0]), float32(ang[1]), float32(ang[2])}
+	d.AvgDensityError = float32(densErr / count)
+	d.MaxDensityError = float32(maxErr)
+	d.MaxVelocity = float32(maxVel)
+	d.AvgNeighbors = float32(float64(neighbors) / count)
+	return d
+}
+
+//TotalEnergy - Kinetic plus potential energy
+func (d *Diagnostics) TotalEnergy() float32 {
+	return d.KineticEnergy + d.PotentialEnergy
+}
+
+//Record - Appends a sample to the series
+func (s *DiagnosticsSeries) Record(d Diagnostics) {
+	s.Samples = append(s.Samples, d)
+}
+
+//Last - Most recent sample, false if nothing was recorded
+func (s *DiagnosticsSeries) Last() (Diagnostics, bool) {
+	if len(s.Samples) == 0 {
+		return Diagnostics{}, false
+	}
+	return s.Samples[len(s.Samples)-1], true
+}
+
+//WriteCSV - Writes the series with a header row for plotting
+func (s *DiagnosticsSeries) WriteCSV(w io.Writer) error {
+	header := "time,mass,volume,kinetic,potential,total,px,py,pz,lx,ly,lz,avg_density_error,max_density_error,max_velocity,min_neighbors,max_neighbors,avg_neighbors\n"
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	for _, d := range s.Samples {
+		_, err := fmt.Fprintf(w, "%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%d,%d,%g\n",
+			d.Time, d.Mass, d.Volume, d.KineticEnergy, d.PotentialEnergy, d.TotalEnergy(),
+			d.Momentum[0], d.Momentum[1], d.Momentum[2],
+			d.AngularMomentum[0], d.AngularMomentum[1], d.AngularMomentum[2],
+			d.AvgDensityError, d.MaxDensityError, d.MaxVelocity,
+			d.MinNeighbors, d.MaxNeighbors, d.AvgNeighbors)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
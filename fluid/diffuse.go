@@ -0,0 +1,283 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"math/rand"
+)
+
+//Secondary (diffuse) whitewater particles following Ihmsen et al. 2012 "Unified Spray, Foam and Bubbles
+//for Particle-Based Fluids". Diffuse particles are generated from trapped air, wave crest and kinetic energy
+//potentials of the SPH particles and are advected one way - they never feed back into the fluid
+
+//DiffuseKind - Classification of a diffuse particle by the number of fluid neighbors
+type DiffuseKind int
+
+const (
+	DiffuseSpray  DiffuseKind = iota //Few fluid neighbors - ballistic motion
+	DiffuseFoam                      //Surface particles - advected with the fluid
+	DiffuseBubble                    //Many fluid neighbors - buoyant and dragged by the fluid
+)
+
+//DiffuseParticle - Single spray / foam / bubble particle
+type DiffuseParticle struct {
+	Position V.Vec32
+	Velocity V.Vec32
+	Lifetime float32
+	Kind     DiffuseKind
+}
+
+//DiffuseSystem - Generation limits, advection coefficients and storage of the diffuse particles.
+//Potential ranges are [min, max] clamps mapping the raw potentials onto [0, 1]
+type DiffuseSystem struct {
+	TrappedAir     [2]float32 //Trapped air potential clamp
+	WaveCrest      [2]float32 //Wave crest potential clamp
+	Energy         [2]float32 //Kinetic energy potential clamp, per unit mass 0.5 v^2 (J/kg)
+	TrappedAirRate float32    //Max diffuse particles per second generated from trapped air
+	WaveCrestRate  float32    //Max diffuse particles per second generated from wave crests
+	Lifetime       float32    //Lifetime of spray, foam and bubbles in seconds
+	Buoyancy       float32    //Bubble buoyancy coefficient
+	Drag           float32    //Bubble drag rate (1/s), bubbles take the fluid velocity within about 1/Drag
+	SprayNeighbors int        //Fewer fluid neighbors than this is spray
+	FoamNeighbors  int        //More fluid neighbors than this is a bubble
+	MaxParticles   int        //Upper bound on live diffuse particles
+	Particles      []DiffuseParticle
+	Rand           *rand.Rand
+}
+
+//NewDiffuseSystem - Diffuse system with the parameters suggested in the paper
+func NewDiffuseSystem(seed int64) *DiffuseSystem {
+	return &DiffuseSystem{
+		TrappedAir:     [2]float32{5, 20},
+		WaveCrest:      [2]float32{2, 8},
+		Energy:         [2]float32{5, 50},
+		TrappedAirRate: 4000,
+		WaveCrestRate:  4000,
+		Lifetime:       3.0,
+		Buoyancy:       2.0,
+		Drag:           50,
+		SprayNeighbors: 6,
+		FoamNeighbors:  20,
+		MaxParticles:   200000,
+		Rand:           rand.New(rand.NewSource(seed))}
+}
+
+//Positions - Diffuse particle positions for export or GL buffer transfer alongside the fluid positions
+func (ds *DiffuseSystem) Positions() []V.Vec32 {
+	pos := make([]V.Vec32, len(ds.Particles))
+	for i := range ds.Particles {
+		pos[i] = ds.Particles[i].Position
+	}
+	return pos
+}
+
+//Count - Number of live diffuse particles of the given kind
+func (ds *DiffuseSystem) Count(kind DiffuseKind) int {
+	count := 0
+	for i := range ds.Particles {
+		if ds.Particles[i].Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+//clampPotential - Maps a potential onto [0, 1] with the min max clamp
+func clampPotential(i float32, r [2]float32) float32 {
+	if r[1] <= r[0] {
+		return 0
+	}
+	return (float32(Math.Min(float64(i), float64(r[1]))) - float32(Math.Min(float64(i), float64(r[0])))) / (r[1] - r[0])
+}
+
+//radialWeight - Radially symmetric weighting used by the potentials, 1 - r/h inside the support
+func radialWeight(dist float32, h float32) float32 {
+	if dist > h {
+		return 0
+	}
+	return 1 - dist/h
+}
+
+//SurfaceNormal - Outward unit surface normal from the (inward pointing) density gradient
+func (fluid *SPHFluid) SurfaceNormal(i int) V.Vec32 {
+	return V.Scale(V.Normalize(fluid.DensityGradient(i)), -1)
+}
+
+//SurfaceNormals - Surface normals of all fluid particles, computed once per step for the potentials
+func (fluid *SPHFluid) SurfaceNormals() []V.Vec32 {
+	normals := make([]V.Vec32, fluid.Count)
+	for i := range normals {
+		normals[i] = fluid.SurfaceNormal(i)
+	}
+	return normals
+}
+
+//DiffusePotentials - Trapped air, wave crest and kinetic energy potentials of fluid particle i with the
+//surface normals of SurfaceNormals. The kinetic energy is per unit mass so the clamp does not depend on
+//the particle size
+func (fluid *SPHFluid) DiffusePotentials(i int, normals []V.Vec32) (float32, float32, float32) {
+	nl := fluid.neighborList()
+	h := fluid.Mfp.InnerRadius
+	vi := fluid.Velocities[i]
+	ni := normals[i]
+	trapped := float32(0.0)
+	curvature := float32(0.0)
+
+	start, end := nl.Range(i)
+	for n := start; n < end; n++ {
+		idx := nl.Indices[n]
+		dist := nl.Distances[n]
+		w := radialWeight(dist, h)
+		if w == 0 || dist == 0 {
+			continue
+		}
+		xij := V.Scale(nl.Directions[n], -1) //Unit vector from the neighbor to i
+		vij := V.Sub(vi, fluid.Velocities[idx])
+		vlen := V.Length(vij)
+		if vlen > 0 {
+			trapped += vlen * (1 - V.Dot(V.Scale(vij, 1/vlen), xij)) * w
+		}
+		//Convex regions only - neighbor lies behind the surface normal
+		if V.Dot(V.Scale(xij, -1), ni) < 0 {
+			nj := normals[idx]
+			curvature += (1 - V.Dot(ni, nj)) * w
+		}
+	}
+
+	//Wave crests only where the particle moves along its normal
+	crest := float32(0.0)
+	if V.Dot(V.Normalize(vi), ni) >= 0.6 {
+		crest = curvature
+	}
+	energy := 0.5 * V.Dot(vi, vi)
+	return trapped, crest, energy
+}
+
+//averageFluidVelocity - Kernel weighted fluid velocity and fluid neighbor count at an arbitrary position
+func (fluid *SPHFluid) averageFluidVelocity(pos *V.Vec32) (V.Vec32, int) {
+	samples, nCount, _ := fluid.SPHGrid.GetSamples(pos)
+	h := fluid.Mfp.InnerRadius
+	avg := V.Vec32{}
+	wsum := float32(0.0)
+	neighbors := 0
+	for j := 0; j < nCount; j++ {
+		idx := samples[j].Index
+		dist := pos.Distance(fluid.Positions[idx])
+		if dist > h {
+			continue
+		}
+		w := fluid.ItrpKernel.F(dist)
+		avg.Add(V.Scale(fluid.Velocities[idx], w))
+		wsum += w
+		neighbors++
+	}
+	if wsum > 0 {
+		avg.Scale(1 / wsum)
+	}
+	return avg, neighbors
+}
+
+//GenerateDiffuse - Emits new diffuse particles in a cylinder around the velocity of every fluid
+//particle proportional to its clamped potentials
+func (fluid *SPHFluid) GenerateDiffuse() {
+	ds := fluid.Diffuse
+	dt := fluid.Timer.TS
+	h := fluid.Mfp.InnerRadius
+	normals := fluid.SurfaceNormals()
+
+	for i := 0; i < fluid.Count; i++ {
+		if len(ds.Particles) >= ds.MaxParticles {
+			return
+		}
+		if fluid.IsSolid(i) {
+			continue
+		}
+		ta, wc, ek := fluid.DiffusePotentials(i, normals)
+		ik := clampPotential(ek, ds.Energy)
+		rate := ik * (ds.TrappedAirRate*clampPotential(ta, ds.TrappedAir) + ds.WaveCrestRate*clampPotential(wc, ds.WaveCrest)) * dt
+		n := int(rate)
+		if ds.Rand.Float32() < rate-float32(n) {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+
+		//Orthonormal basis around the particle velocity
+		vi := fluid.Velocities[i]
+		axis := V.Normalize(vi)
+		e1 := V.Cross(axis, V.Vec32{0, 1, 0})
+		if V.Length(e1) < 1e-4 {
+			e1 = V.Cross(axis, V.Vec32{1, 0, 0})
+		}
+		e1 = V.Normalize(e1)
+		e2 := V.Cross(axis, e1)
+		length := V.Length(vi) * dt
+
+		for k := 0; k < n && len(ds.Particles) < ds.MaxParticles; k++ {
+			r := h * float32(Math.Sqrt(float64(ds.Rand.Float32())))
+			theta := ds.Rand.Float32() * PI2
+			along := ds.Rand.Float32() * length
+			offset := V.Add(V.Scale(e1, r*float32(Math.Cos(float64(theta)))), V.Scale(e2, r*float32(Math.Sin(float64(theta)))))
+			pos := V.Add(fluid.Positions[i], V.Add(offset, V.Scale(axis, along)))
+			vel := V.Add(vi, offset)
+			ds.Particles = append(ds.Particles, DiffuseParticle{pos, vel, ds.Lifetime, DiffuseFoam})
+		}
+	}
+}
+
+//AdvectDiffuse - Classifies diffuse particles by fluid neighbor count and advects them as spray,
+//foam or bubbles under the gravity of the fluid. Particles of every kind age and are removed once their
+//lifetime expires or they leave the collider bounds, periodic axes wrap them like the fluid
+func (fluid *SPHFluid) AdvectDiffuse() {
+	ds := fluid.Diffuse
+	dt := fluid.Timer.TS
+	gravity := fluid.BodyAcceleration()
+	drag := float32(Math.Min(float64(ds.Drag*dt), 1))
+	min, max := fluid.ColliderBounds()
+	live := ds.Particles[:0]
+
+	for _, p := range ds.Particles {
+		avg, neighbors := fluid.averageFluidVelocity(&p.Position)
+		switch {
+		case neighbors < ds.SprayNeighbors:
+			p.Kind = DiffuseSpray
+			p.Velocity.Add(V.Scale(gravity, dt))
+		case neighbors > ds.FoamNeighbors:
+			p.Kind = DiffuseBubble
+			buoyancy := V.Scale(gravity, -ds.Buoyancy*dt)
+			p.Velocity.Add(V.Add(buoyancy, V.Scale(V.Sub(avg, p.Velocity), drag)))
+		default:
+			p.Kind = DiffuseFoam
+			p.Velocity = avg
+		}
+		p.Lifetime -= dt
+		p.Position.Add(V.Scale(p.Velocity, dt))
+		if fluid.Periodic != nil {
+			fluid.Periodic.Wrap(&p.Position)
+		}
+		if p.Lifetime > 0 && insideBounds(p.Position, min, max) {
+			live = append(live, p)
+		}
+	}
+	ds.Particles = live
+}
+
+//insideBounds - Whether the position lies within the axis aligned box
+func insideBounds(p V.Vec32, min V.Vec32, max V.Vec32) bool {
+	for k := 0; k < 3; k++ {
+		if p[k] < min[k] || p[k] > max[k] {
+			return false
+		}
+	}
+	return true
+}
+
+//UpdateDiffuse - Generation and advection step of the diffuse system
+func (fluid *SPHFluid) UpdateDiffuse() {
+	if fluid.Diffuse == nil {
+		return
+	}
+	fluid.AdvectDiffuse()
+	fluid.GenerateDiffuse()
+}
@@ -0,0 +1,70 @@
+package fluid
+
+import (
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	"math/rand"
+	"testing"
+)
+
+//A fast splash generates spray, foam and bubbles, fluid at rest generates nothing
+func TestDiffuseGeneration(t *testing.T) {
+	rest := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.3, 0.3, 0.3, 6, 6, 6})
+	rest.Gravity = &V.Vec32{}
+	rest.Diffuse = NewDiffuseSystem(1)
+	for step := 0; step < 5; step++ {
+		rest.Compute()
+	}
+	if n := len(rest.Diffuse.Particles); n != 0 {
+		t.Errorf("Fluid at rest generated %d diffuse particles\n", n)
+	}
+
+	splash := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.3, 0.3, 0.3, 6, 6, 6})
+	splash.Colliders = G.Box(1, 1, 1, V.Vec32{}) //Room for the spray thrown off the block
+	splash.Diffuse = NewDiffuseSystem(1)
+	r := rand.New(rand.NewSource(7))
+	for i := range splash.Velocities {
+		splash.Velocities[i] = V.Vec32{6 * (r.Float32() - 0.5), 6 * (r.Float32() - 0.5), 6 * (r.Float32() - 0.5)}
+	}
+	for step := 0; step < 5; step++ {
+		splash.Compute()
+	}
+	ds := splash.Diffuse
+	if ds.Count(DiffuseSpray) == 0 || ds.Count(DiffuseFoam) == 0 || ds.Count(DiffuseBubble) == 0 {
+		t.Errorf("Splash should generate all kinds, got %d spray %d foam %d bubbles\n", ds.Count(DiffuseSpray), ds.Count(DiffuseFoam), ds.Count(DiffuseBubble))
+	}
+}
+
+//Diffuse particles are classified by their fluid neighbors, bubbles are dragged at the drag rate and every
+//kind ages until its lifetime expires. Particles leaving the collider bounds are removed
+func TestDiffuseAdvection(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.3, 0.3, 0.3, 6, 6, 6})
+	fluid.Gravity = &V.Vec32{}
+	ds := NewDiffuseSystem(1)
+	fluid.Diffuse = ds
+	dt := fluid.Timer.TS
+	life := 1.5 * dt
+	ds.Particles = []DiffuseParticle{
+		{V.Vec32{0, 0, 0}, V.Vec32{1, 0, 0}, life, DiffuseFoam},                 //Inside the block
+		{V.Vec32{0.13, 0, 0}, V.Vec32{}, life, DiffuseSpray},                    //Next to a face
+		{V.Vec32{0.12, 0.12, 0.12}, V.Vec32{}, life, DiffuseBubble},             //Off a corner
+		{V.Vec32{0.14, 0.14, 0.14}, V.Vec32{10, 0, 0}, 10 * life, DiffuseSpray}} //Leaves the collider box
+
+	fluid.AdvectDiffuse()
+	if len(ds.Particles) != 3 {
+		t.Fatalf("Particle leaving the collider bounds should be removed, have %d particles\n", len(ds.Particles))
+	}
+	for k, kind := range []DiffuseKind{DiffuseBubble, DiffuseFoam, DiffuseSpray} {
+		if ds.Particles[k].Kind != kind {
+			t.Errorf("Particle %d should be classified as %d, got %d\n", k, kind, ds.Particles[k].Kind)
+		}
+	}
+	if v := ds.Particles[0].Velocity[0]; !isClose(v, 1-ds.Drag*dt) {
+		t.Errorf("Bubble should lose %f of its slip velocity in a step, has %f\n", ds.Drag*dt, v)
+	}
+
+	fluid.AdvectDiffuse()
+	if len(ds.Particles) != 0 {
+		t.Errorf("Spray, foam and bubbles should expire after their lifetime, have %d particles\n", len(ds.Particles))
+	}
+}
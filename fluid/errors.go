@@ -0,0 +1,115 @@
+package fluid
+
+import (
+	"fmt"
+	Math "math"
+)
+
+//ParameterError - Invalid simulation input. Struct and Field name the offending parameter so scene
+//generators can report exactly which value was rejected
+type ParameterError struct {
+	Struct string
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("Invalid %s.%s = %v: %s", e.Struct, e.Field, e.Value, e.Reason)
+}
+
+//GridError - Spatial grid could not be built or does not cover the fluid domain
+type GridError struct {
+	Reason string
+}
+
+func (e *GridError) Error() string {
+	return fmt.Sprintf("Spatial grid error: %s", e.Reason)
+}
+
+//StateError - Simulation state became invalid (i.e. NaN densities after initialization)
+type StateError struct {
+	Index  int
+	Reason string
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("Invalid fluid state at particle %d: %s", e.Index, e.Reason)
+}
+
+func isFinite(v float32) bool {
+	return !Math.IsNaN(float64(v)) && !Math.IsInf(float64(v), 0)
+}
+
+//checkPositive - Value must be finite and > 0
+func checkPositive(s string, field string, v float32) error {
+	if !isFinite(v) || v <= 0 {
+		return &ParameterError{s, field, v, "must be positive and finite"}
+	}
+	return nil
+}
+
+//checkNonNegative - Value must be finite and >= 0
+func checkNonNegative(s string, field string, v float32) error {
+	if !isFinite(v) || v < 0 {
+		return &ParameterError{s, field, v, "must be finite and not negative"}
+	}
+	return nil
+}
+
+//Validate - Checks the box dimensions and cell counts
+func (init *BoxFluidSystem) Validate() error {
+	const s = "BoxFluidSystem"
+	for i, o := range init.Origin {
+		if !isFinite(o) {
+			return &ParameterError{s, fmt.Sprintf("Origin[%d]", i), o, "must be finite"}
+		}
+	}
+	checks := []error{
+		checkPositive(s, "Width", init.Width),
+		checkPositive(s, "Height", init.Height),
+		checkPositive(s, "Depth", init.Depth)}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	cells := map[string]int{"WidthCells": init.WidthCells, "HeightCells": init.HeightCells, "DepthCells": init.DepthCells}
+	for _, field := range []string{"WidthCells", "HeightCells", "DepthCells"} {
+		if cells[field] <= 0 {
+			return &ParameterError{s, field, cells[field], "must be at least 1"}
+		}
+	}
+	return nil
+}
+
+//Validate - Checks the particle description is physically meaningful
+func (mfp *MassFluidParticle) Validate() error {
+	const s = "MassFluidParticle"
+	checks := []error{
+		checkPositive(s, "Mass", mfp.Mass),
+		checkNonNegative(s, "Viscosity", mfp.Viscosity),
+		checkPositive(s, "InnerRadius", mfp.InnerRadius),
+		checkNonNegative(s, "OuterRadius", mfp.OuterRadius),
+		checkNonNegative(s, "TimeStep", mfp.TimeStep),
+		checkPositive(s, "SpeedSound", mfp.SpeedSound),
+		checkPositive(s, "TargetDensity", mfp.TargetDensity),
+		checkPositive(s, "EosExp", mfp.EosExp),
+		checkNonNegative(s, "SurfaceTension", mfp.SurfaceTension)}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkIndices - Particle indices handed to material setup must address existing particles
+func (fluid *SPHFluid) checkIndices(s string, indices []int) error {
+	for _, i := range indices {
+		if i < 0 || i >= fluid.Count {
+			return &ParameterError{s, "indices", i, fmt.Sprintf("particle index outside [0, %d)", fluid.Count)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+)
+
+//GranularMaterial - Drucker-Prager elasto-plastic description for sand / snow like particles.
+//Volumetric response comes from the fluid equation of state, the deviatoric stress is integrated
+//hypo-elastically from the strain rate and projected back onto the Drucker-Prager cone each step
+type GranularMaterial struct {
+	FrictionAngle float32 //Internal friction angle in degrees (dry sand ~30-35)
+	Cohesion      float32 //Cohesion (Pa), 0 for dry sand, > 0 for wet sand and snow
+	ShearModulus  float32 //Elastic shear modulus (Pa)
+}
+
+//Drucker - Drucker-Prager cone parameters alpha and k matched to Mohr-Coulomb friction and cohesion
+func (gm *GranularMaterial) Drucker() (float32, float32) {
+	tanPhi := Math.Tan(float64(gm.FrictionAngle) * Math.Pi / 180)
+	denom := Math.Sqrt(9 + 12*tanPhi*tanPhi)
+	return float32(tanPhi / denom), float32(3 * float64(gm.Cohesion) / denom)
+}
+
+//SetGranular - Switches the given particles to the granular phase with the material gm.
+//All granular particles share one material
+func (fluid *SPHFluid) SetGranular(indices []int, gm *GranularMaterial) error {
+	if gm == nil {
+		return &ParameterError{"SPHFluid", "Granular", nil, "granular material is required"}
+	}
+	if err := fluid.checkIndices("GranularMaterial", indices); err != nil {
+		return err
+	}
+	if !isFinite(gm.FrictionAngle) || gm.FrictionAngle < 0 || gm.FrictionAngle >= 90 {
+		return &ParameterError{"GranularMaterial", "FrictionAngle", gm.FrictionAngle, "must be in [0, 90) degrees"}
+	}
+	if err := checkNonNegative("GranularMaterial", "Cohesion", gm.Cohesion); err != nil {
+		return err
+	}
+	if err := checkPositive("GranularMaterial", "ShearModulus", gm.ShearModulus); err != nil {
+		return err
+	}
+	fluid.Granular = gm
+	fluid.ensurePhases()
+	if fluid.Stresses == nil {
+		fluid.Stresses = make([]V.Mat3, fluid.Count)
+	}
+	for _, i := range indices {
+		fluid.Phases[i] = PhaseGranular
+		fluid.Stresses[i] = V.Mat3{}
+	}
+	return nil
+}
+
+//IsGranular - True when the particle is in the granular phase
+func (fluid *SPHFluid) IsGranular(i int) bool {
+	return fluid.Granular != nil && fluid.Phases[i] == PhaseGranular
+}
+
+//UpdateGranularStress - Integrates the deviatoric stress of granular particles (with Jaumann rotation)
+//and applies the Drucker-Prager return mapping using the particle pressure from the EOS
+func (fluid *SPHFluid) UpdateGranularStress() {
+	gm := fluid.Granular
+	if gm == nil {
+		return
+	}
+	alpha, k := gm.Drucker()
+	dt := fluid.Timer.TS
+	mass := fluid.Mfp.Mass
+	nl := fluid.neighborList()
+
+	for i := 0; i < fluid.Count; i++ {
+		if fluid.Phases[i] != PhaseGranular {
+			continue
+		}
+		start, end := nl.Range(i)
+		gradV := V.Mat3{}
+		for n := start; n < end; n++ {
+			idx := nl.Indices[n]
+			dist := nl.Distances[n]
+			if dist == 0 {
+				continue
+			}
+			dir := nl.Directions[n]
+			grad := fluid.GradKernel.Grad(dist, &dir)
+			vji := V.Sub(fluid.Velocities[idx], fluid.Velocities[i])
+			gradV = mat3Add(gradV, mat3Outer(V.Scale(vji, mass/fluid.Densities[idx]), grad))
+		}
+
+		rate := mat3Scale(mat3Add(gradV, mat3Transpose(gradV)), 0.5)
+		spin := mat3Scale(mat3Add(gradV, mat3Scale(mat3Transpose(gradV), -1)), 0.5)
+		s := fluid.Stresses[i]
+		jaumann := mat3Add(mat3Mul(s, mat3Transpose(spin)), mat3Mul(spin, s))
+		ds := mat3Add(mat3Scale(mat3Deviatoric(rate), 2*gm.ShearModulus), jaumann)
+		s = mat3Deviatoric(mat3Add(s, mat3Scale(ds, dt)))
+
+		//Return mapping - sqrt(J2) may not exceed the cone radius at the current pressure
+		p := fluid.Pressures[i]
+		if p < 0 {
+			p = 0
+		}
+		limit := 3*alpha*p + k
+		tau := float32(Math.Sqrt(0.5)) * mat3Norm(s)
+		if tau > limit {
+			s = mat3Scale(s, limit/tau)
+		}
+		fluid.Stresses[i] = s
+	}
+}
+
+//GranularForces - Accumulates the divergence of the granular deviatoric stress into the particle forces.
+//Granular particles still receive the fluid pressure and viscosity forces of the main loop
+func (fluid *SPHFluid) GranularForces() {
+	if fluid.Granular == nil {
+		return
+	}
+	fluid.UpdateGranularStress()
+	mass := fluid.Mfp.Mass
+	nl := fluid.neighborList()
+
+	for i := 0; i < fluid.Count; i++ {
+		if fluid.Phases[i] != PhaseGranular {
+			continue
+		}
+		start, end := nl.Range(i)
+		si := mat3Scale(fluid.Stresses[i], 1/(fluid.Densities[i]*fluid.Densities[i]))
+		for n := start; n < end; n++ {
+			idx := nl.Indices[n]
+			dist := nl.Distances[n]
+			if fluid.Phases[idx] != PhaseGranular || dist == 0 {
+				continue
+			}
+			dir := nl.Directions[n]
+			grad := fluid.GradKernel.Grad(dist, &dir)
+			sj := mat3Scale(fluid.Stresses[idx], 1/(fluid.Densities[idx]*fluid.Densities[idx]))
+			f := mat3MulVec(mat3Add(si, sj), grad)
+			fluid.Forces[i].Add(V.Scale(f, mass*mass))
+		}
+	}
+}
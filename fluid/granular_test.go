@@ -0,0 +1,124 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"testing"
+)
+
+//Stress above the Drucker-Prager cone is scaled back onto it, stress inside the cone is kept
+func TestDruckerPragerReturn(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.3, 0.3, 0.3, 6, 6, 6})
+	gm := &GranularMaterial{FrictionAngle: 30, Cohesion: 10, ShearModulus: 1e4}
+	if err := fluid.SetGranular([]int{0, 1}, gm); err != nil {
+		t.Fatalf("Failed to set granular particles: %s\n", err.Error())
+	}
+	alpha, k := gm.Drucker()
+	if !isClose(alpha, float32(Math.Tan(Math.Pi/6)/Math.Sqrt(9+12*Math.Tan(Math.Pi/6)*Math.Tan(Math.Pi/6)))) || k <= 0 {
+		t.Fatalf("Unexpected Drucker-Prager parameters alpha %f k %f\n", alpha, k)
+	}
+
+	shear := V.Mat3{0, 1, 0, 1, 0, 0, 0, 0, 0} //sqrt(J2) = 1 per unit scale
+	fluid.Pressures[0], fluid.Pressures[1] = 100, 100
+	limit := 3*alpha*100 + k
+	fluid.Stresses[0] = mat3Scale(shear, 10*limit)
+	fluid.Stresses[1] = mat3Scale(shear, 0.5*limit)
+	fluid.UpdateGranularStress()
+
+	if tau := float32(Math.Sqrt(0.5)) * mat3Norm(fluid.Stresses[0]); !isClose(tau/limit, 1) {
+		t.Errorf("Stress above the yield surface should be projected onto it, sqrt(J2) %f limit %f\n", tau, limit)
+	}
+	if !mat3Close(fluid.Stresses[0], mat3Scale(shear, limit), 1e-3*limit) {
+		t.Errorf("Return mapping should keep the direction of the stress, got %v\n", fluid.Stresses[0])
+	}
+	if !mat3Close(fluid.Stresses[1], mat3Scale(shear, 0.5*limit), 1e-3*limit) {
+		t.Errorf("Stress inside the cone should be kept, got %v\n", fluid.Stresses[1])
+	}
+
+	//Tension carries no frictional strength, only the cohesion
+	fluid.Pressures[0] = -100
+	fluid.Stresses[0] = mat3Scale(shear, 10*limit)
+	fluid.UpdateGranularStress()
+	if tau := float32(Math.Sqrt(0.5)) * mat3Norm(fluid.Stresses[0]); !isClose(tau/k, 1) {
+		t.Errorf("Stress under tension should be limited by the cohesion, sqrt(J2) %f cohesion %f\n", tau, k)
+	}
+}
+
+//The return mapping of a step reads the pressures of that step, a compressed cohesionless block keeps
+//frictional strength from the first step on
+func TestGranularFirstStep(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.3, 0.3, 0.3, 6, 6, 6})
+	fluid.Mfp.TargetDensity = 0.9 * fluid.Densities[0] //Compressed, positive pressure everywhere
+	fluid.Gravity = &V.Vec32{}
+	indices := make([]int, fluid.Count)
+	for i := range indices {
+		indices[i] = i
+		fluid.Velocities[i] = V.Vec32{fluid.Positions[i][1], 0, 0} //Simple shear
+	}
+	if err := fluid.SetGranular(indices, &GranularMaterial{FrictionAngle: 30, ShearModulus: 1e4}); err != nil {
+		t.Fatalf("Failed to set granular particles: %s\n", err.Error())
+	}
+	fluid.Compute()
+	for i := range fluid.Stresses {
+		if fluid.Pressures[i] > 0 && mat3Norm(fluid.Stresses[i]) > 0 {
+			return
+		}
+	}
+	t.Errorf("Sheared block under pressure should carry shear stress after the first step\n")
+}
+
+//collapseColumn - Collapses a two dimensional column of width a and height 2a on a no slip floor against a
+//left wall, returning the run out front, the highest particle and the mean squared velocity
+func collapseColumn(t *testing.T, gm *GranularMaterial, duration float32) (float32, float32, float32) {
+	const a = 0.1
+	box := BoxFluidSystem{V.Vec32{a / 2, a, 0}, a, 2 * a, 0.15, 4, 8, 6}
+	fluid, err := sceneFluid(box, 0.01, float32(Math.Sqrt(2*-GRAV*2*a)), V.Vec32{0, 0, 1})
+	if err != nil {
+		t.Fatalf("Failed to set up the column: %s\n", err.Error())
+	}
+	if gm != nil {
+		indices := make([]int, fluid.Count)
+		for i := range indices {
+			indices[i] = i
+		}
+		if err := fluid.SetGranular(indices, gm); err != nil {
+			t.Fatalf("Failed to set granular particles: %s\n", err.Error())
+		}
+	}
+	for fluid.Timer.T < duration {
+		fluid.Compute()
+		for i := range fluid.Positions {
+			p, v := &fluid.Positions[i], &fluid.Velocities[i]
+			if p[0] < 0 {
+				p[0], v[0] = 0, float32(Math.Max(float64(v[0]), 0))
+			}
+			if p[1] < 0 {
+				p[1], *v = 0, V.Vec32{}
+			}
+		}
+	}
+	front, top, v2 := float32(0), float32(0), float32(0)
+	for i, p := range fluid.Positions {
+		front = float32(Math.Max(float64(front), float64(p[0])))
+		top = float32(Math.Max(float64(top), float64(p[1])))
+		v2 += V.Dot(fluid.Velocities[i], fluid.Velocities[i])
+	}
+	return front, top, v2 / float32(fluid.Count)
+}
+
+//A granular column settles into a pile at a finite slope while the same fluid column keeps spreading
+func TestGranularPile(t *testing.T) {
+	const duration = 0.8
+	fluidFront, _, fluidV2 := collapseColumn(t, nil, duration)
+	front, top, v2 := collapseColumn(t, &GranularMaterial{FrictionAngle: 35, ShearModulus: 1e5}, duration)
+
+	if v2 > 1e-3 || fluidV2 < 100*v2 {
+		t.Errorf("Granular pile should come to rest, mean v^2 %f (fluid %f)\n", v2, fluidV2)
+	}
+	if fluidFront < 1.5*front {
+		t.Errorf("Granular pile should run out less than the fluid, front %f (fluid %f)\n", front, fluidFront)
+	}
+	if slope := Math.Atan(float64(top/front)) * 180 / Math.Pi; slope < 10 {
+		t.Errorf("Granular pile should keep a slope, got %f degrees\n", slope)
+	}
+}
@@ -0,0 +1,78 @@
+package fluid
+
+import V "diesel.com/diesel/vector"
+
+//Compact spatial hashing (Ihmsen et al., A Parallel SPH Implementation on Multi-Core CPUs 2011, after
+//Teschner et al. 2003). Integer cell coordinates are hashed with large primes
+//  hash(i, j, k) = (i * p1 xor j * p2 xor k * p3) mod TableSize
+//into buckets that store only the occupied cells with their coordinates. Memory grows with the number of
+//occupied cells instead of the domain volume, and particles may go anywhere. Cells sharing a bucket are
+//told apart by their coordinates, so hash collisions cost a short bucket scan but never add neighbors
+
+const HASH_PRIME_X = 73856093
+const HASH_PRIME_Y = 19349663
+const HASH_PRIME_Z = 83492791
+const MIN_HASH_TABLE = 1021   //Smallest number of buckets
+const MAX_HASH_CELL = 1 << 30 //Cell coordinates are clamped to +-MAX_HASH_CELL
+
+//HashCell - Occupied cell of a compact grid and its handle, the cell key of Start, End and Cells
+type HashCell struct {
+	Cell   [3]int
+	Handle int
+}
+
+//AllocateCompactGrid - Grid of cells of edge length cellSize over an unbounded domain. The hash table gets
+//the first prime above twice the expected particle count buckets
+func AllocateCompactGrid(cellSize float32, particles int) *SpatialHashGrid {
+	return AllocateCompactTable(V.Vec32{}, cellSize, nextPrime(2*particles))
+}
+
+//AllocateCompactTable - Compact grid with an explicit number of hash buckets
+func AllocateCompactTable(origin V.Vec32, cellSize float32, buckets int) *SpatialHashGrid {
+	if buckets < 1 {
+		buckets = 1
+	}
+	return &SpatialHashGrid{Origin: origin, CellSize: cellSize, Table: make([][]HashCell, buckets)}
+}
+
+//bucket - Hash table slot of a cell
+func (s *SpatialHashGrid) bucket(idx [3]int) int {
+	h := uint32(int32(idx[0]))*HASH_PRIME_X ^ uint32(int32(idx[1]))*HASH_PRIME_Y ^ uint32(int32(idx[2]))*HASH_PRIME_Z
+	return int(h % uint32(len(s.Table)))
+}
+
+//handle - Cell key of a compact cell, -1 when the cell never held a particle. With add a handle with an
+//empty range is created for new cells
+func (s *SpatialHashGrid) handle(idx [3]int, add bool) int {
+	b := s.bucket(idx)
+	for _, c := range s.Table[b] {
+		if c.Cell == idx {
+			return c.Handle
+		}
+	}
+	if !add {
+		return -1
+	}
+	h := len(s.Cells)
+	s.Table[b] = append(s.Table[b], HashCell{idx, h})
+	s.Cells = append(s.Cells, idx)
+	s.Start = append(s.Start, 0)
+	s.End = append(s.End, 0)
+	return h
+}
+
+//nextPrime - Smallest prime >= n and >= MIN_HASH_TABLE
+func nextPrime(n int) int {
+	if n < MIN_HASH_TABLE {
+		return MIN_HASH_TABLE
+	}
+	for ; ; n++ {
+		prime := n%2 == 1
+		for d := 3; prime && d*d <= n; d += 2 {
+			prime = n%d != 0
+		}
+		if prime {
+			return n
+		}
+	}
+}
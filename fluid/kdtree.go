@@ -0,0 +1,239 @@
+package fluid
+
+import V "diesel.com/diesel/vector"
+
+//k-d tree over the particle positions. Nodes split their particles at the median of the axis of largest
+//extent, so the tree is balanced for any distribution and needs no cell size. Leaves hold up to LeafSize
+//particles which are scanned linearly
+
+const KDTREE_LEAF = 8
+
+//kdNode - Node of the tree owning Order[Start:End]. Leaves have Axis -1
+type kdNode struct {
+	Start int
+	End   int
+	Axis  int
+	Split float32
+	Left  int
+	Right int
+}
+
+//KDTree - Balanced k-d tree with the root at node 0. Serial builds store the nodes depth first
+type KDTree struct {
+	LeafSize  int
+	Workers   int //Goroutines building the subtrees, 0 or 1 builds serially
+	Positions []V.Vec32
+	Order     []int //Particle indexes, the particles of a node are contiguous
+	Nodes     []kdNode
+	finite    int //Order[finite:] are non finite positions outside the tree
+}
+
+//Build - Rebuilds the tree over the positions. Non finite positions are kept outside the tree and are
+//only found by infinite radius queries
+func (t *KDTree) Build(positions []V.Vec32) error {
+	if t.LeafSize < 1 {
+		t.LeafSize = KDTREE_LEAF
+	}
+	t.Positions = positions
+	t.Order = t.Order[:0]
+	var extra []int
+	for i, p := range positions {
+		if isFinite(p[0]) && isFinite(p[1]) && isFinite(p[2]) {
+			t.Order = append(t.Order, i)
+		} else {
+			extra = append(extra, i)
+		}
+	}
+	t.finite = len(t.Order)
+	t.Order = append(t.Order, extra...)
+	t.Nodes = t.Nodes[:0]
+	if t.finite == 0 {
+		return nil
+	}
+	workers := sortWorkers(t.Workers, t.finite, 0)
+	if workers == 1 {
+		t.split(0, t.finite, -1, nil)
+		return nil
+	}
+
+	//The top levels are split serially until every worker has a subtree, the subtrees are built into their
+	//own node buffers and appended. Splits only depend on the particles, so the tree equals the serial one
+	levels := 0
+	for 1<<uint(levels) < workers {
+		levels++
+	}
+	var tasks []kdTask
+	t.split(0, t.finite, levels, &tasks)
+	subtrees := make([][]kdNode, len(tasks))
+	parallelFor(len(tasks), workers, func(w int, lo int, hi int) {
+		for k := lo; k < hi; k++ {
+			sub := &KDTree{LeafSize: t.LeafSize, Positions: t.Positions, Order: t.Order}
+			sub.split(tasks[k].start, tasks[k].end, -1, nil)
+			subtrees[k] = sub.Nodes
+		}
+	})
+	for k, nodes := range subtrees {
+		offset := len(t.Nodes) - 1 //Local node l > 0 is appended at offset + l, the local root replaces the task node
+		for l := range nodes {
+			if nodes[l].Axis >= 0 {
+				nodes[l].Left += offset
+				nodes[l].Right += offset
+			}
+		}
+		t.Nodes[tasks[k].node] = nodes[0]
+		t.Nodes = append(t.Nodes, nodes[1:]...)
+	}
+	return nil
+}
+
+//kdTask - Subtree of Order[start:end] left to a worker, node is its placeholder leaf
+type kdTask struct {
+	node, start, end int
+}
+
+//split - Appends the node of Order[start:end] and its subtrees, returns the node index. Nodes levels deep
+//are left as leaves and recorded in tasks, negative levels split down to the leaves
+func (t *KDTree) split(start int, end int, levels int, tasks *[]kdTask) int {
+	node := len(t.Nodes)
+	t.Nodes = append(t.Nodes, kdNode{Start: start, End: end, Axis: -1})
+	if end-start <= t.LeafSize {
+		return node
+	}
+	if levels == 0 {
+		*tasks = append(*tasks, kdTask{node, start, end})
+		return node
+	}
+	min, max := t.Positions[t.Order[start]], t.Positions[t.Order[start]]
+	for _, idx := range t.Order[start+1 : end] {
+		p := t.Positions[idx]
+		for k := 0; k < 3; k++ {
+			if p[k] < min[k] {
+				min[k] = p[k]
+			}
+			if p[k] > max[k] {
+				max[k] = p[k]
+			}
+		}
+	}
+	axis := 0
+	for k := 1; k < 3; k++ {
+		if max[k]-min[k] > max[axis]-min[axis] {
+			axis = k
+		}
+	}
+	if !(max[axis] > min[axis]) { //Coincident particles can't be split
+		return node
+	}
+	mid := (start + end) / 2
+	t.selectNth(start, end, mid, axis)
+	split := t.Positions[t.Order[mid]][axis] //Read before the subtrees reorder their particles
+	left := t.split(start, mid, levels-1, tasks)
+	right := t.split(mid, end, levels-1, tasks)
+	t.Nodes[node].Axis = axis
+	t.Nodes[node].Split = split
+	t.Nodes[node].Left = left
+	t.Nodes[node].Right = right
+	return node
+}
+
+//selectNth - Partially orders Order[start:end] so the particle at n is the one of a full sort on the axis,
+//particles before it are not greater and after it are not smaller
+func (t *KDTree) selectNth(start int, end int, n int, axis int) {
+	order := t.Order
+	at := func(i int) float32 { return t.Positions[order[i]][axis] }
+	lo, hi := start, end-1
+	for lo < hi {
+		pivot := at((lo + hi) / 2)
+		i, j := lo, hi
+		for i <= j {
+			for at(i) < pivot {
+				i++
+			}
+			for at(j) > pivot {
+				j--
+			}
+			if i <= j {
+				order[i], order[j] = order[j], order[i]
+				i++
+				j--
+			}
+		}
+		if n <= j {
+			hi = j
+		} else if n >= i {
+			lo = i
+		} else {
+			return
+		}
+	}
+}
+
+//QueryAppend - Appends all particles within radius of the position (inclusive)
+func (t *KDTree) QueryAppend(found []Neighbor, position V.Vec32, radius float32) []Neighbor {
+	if !(radius >= 0) {
+		return found
+	}
+	for _, idx := range t.Order[t.finite:] {
+		if dist := position.Distance(t.Positions[idx]); dist <= radius {
+			found = append(found, Neighbor{idx, dist})
+		}
+	}
+	stack := []int{}
+	if len(t.Nodes) > 0 {
+		stack = append(stack, 0)
+	}
+	for len(stack) > 0 {
+		node := t.Nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if node.Axis < 0 {
+			for _, idx := range t.Order[node.Start:node.End] {
+				dist := position.Distance(t.Positions[idx])
+				if dist <= radius {
+					found = append(found, Neighbor{idx, dist})
+				}
+			}
+			continue
+		}
+		reach := planeDistance(position, node.Axis, node.Split) <= radius //Query sphere crosses the split
+		if reach || position[node.Axis] <= node.Split {
+			stack = append(stack, node.Left)
+		}
+		if reach || position[node.Axis] >= node.Split {
+			stack = append(stack, node.Right)
+		}
+	}
+	return found
+}
+
+//Nearest - The k nearest particles, the near side of every split is descended first
+func (t *KDTree) Nearest(position V.Vec32, k int) []Neighbor {
+	if k <= 0 || len(t.Order) == 0 {
+		return nil
+	}
+	heap := knnHeap{k: k}
+	for _, idx := range t.Order[t.finite:] {
+		heap.push(Neighbor{idx, position.Distance(t.Positions[idx])})
+	}
+	if len(t.Nodes) > 0 {
+		t.nearest(0, position, &heap)
+	}
+	return heap.sorted()
+}
+
+func (t *KDTree) nearest(n int, position V.Vec32, heap *knnHeap) {
+	node := t.Nodes[n]
+	if node.Axis < 0 {
+		for _, idx := range t.Order[node.Start:node.End] {
+			heap.push(Neighbor{idx, position.Distance(t.Positions[idx])})
+		}
+		return
+	}
+	near, far := node.Left, node.Right
+	if position[node.Axis] > node.Split {
+		near, far = far, near
+	}
+	t.nearest(near, position, heap)
+	if planeDistance(position, node.Axis, node.Split) <= heap.bound() {
+		t.nearest(far, position, heap)
+	}
+}
@@ -0,0 +1,125 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+)
+
+//Row major 3 x 3 helpers for the solid mechanics tensors (deformation gradient, strain, stress).
+//Entry (i, j) is stored at i*3 + j, matching vector.mapN
+
+func mat3Identity() V.Mat3 {
+	return V.Mat3{1, 0, 0, 0, 1, 0, 0, 0, 1}
+}
+
+//mat3Outer - Outer product a * b^T
+func mat3Outer(a V.Vec32, b V.Vec32) V.Mat3 {
+	m := V.Mat3{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i*3+j] = a[i] * b[j]
+		}
+	}
+	return m
+}
+
+func mat3Add(a V.Mat3, b V.Mat3) V.Mat3 {
+	for i := range a {
+		a[i] += b[i]
+	}
+	return a
+}
+
+func mat3Scale(a V.Mat3, s float32) V.Mat3 {
+	for i := range a {
+		a[i] *= s
+	}
+	return a
+}
+
+func mat3Transpose(a V.Mat3) V.Mat3 {
+	return V.Mat3{a[0], a[3], a[6], a[1], a[4], a[7], a[2], a[5], a[8]}
+}
+
+func mat3Mul(a V.Mat3, b V.Mat3) V.Mat3 {
+	m := V.Mat3{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i*3+j] = a[i*3]*b[j] + a[i*3+1]*b[3+j] + a[i*3+2]*b[6+j]
+		}
+	}
+	return m
+}
+
+func mat3MulVec(a V.Mat3, v V.Vec32) V.Vec32 {
+	return V.Vec32{
+		a[0]*v[0] + a[1]*v[1] + a[2]*v[2],
+		a[3]*v[0] + a[4]*v[1] + a[5]*v[2],
+		a[6]*v[0] + a[7]*v[1] + a[8]*v[2]}
+}
+
+func mat3Trace(a V.Mat3) float32 {
+	return a[0] + a[4] + a[8]
+}
+
+//mat3Norm - Frobenius norm
+func mat3Norm(a V.Mat3) float32 {
+	sum := float32(0.0)
+	for i := range a {
+		sum += a[i] * a[i]
+	}
+	return float32(Math.Sqrt(float64(sum)))
+}
+
+//mat3Deviatoric - Removes the volumetric (trace) part of a tensor
+func mat3Deviatoric(a V.Mat3) V.Mat3 {
+	return mat3Add(a, mat3Scale(mat3Identity(), -mat3Trace(a)/3))
+}
+
+//mat3Inverse - Adjugate inverse, returns false for singular matrices
+func mat3Inverse(a V.Mat3) (V.Mat3, bool) {
+	det := a.Det()
+	if det == 0 || Math.IsNaN(float64(det)) {
+		return V.Mat3{}, false
+	}
+	inv := V.Mat3{
+		a[4]*a[8] - a[5]*a[7], a[2]*a[7] - a[1]*a[8], a[1]*a[5] - a[2]*a[4],
+		a[5]*a[6] - a[3]*a[8], a[0]*a[8] - a[2]*a[6], a[2]*a[3] - a[0]*a[5],
+		a[3]*a[7] - a[4]*a[6], a[1]*a[6] - a[0]*a[7], a[0]*a[4] - a[1]*a[3]}
+	return mat3Scale(inv, 1/det), true
+}
+
+//mat3AxisAngle - Rotation by angle about the axis with the Rodrigues formula R = I + sin K + (1 - cos) K^2,
+//identity for a zero axis
+func mat3AxisAngle(axis V.Vec32, angle float32) V.Mat3 {
+	length := V.Length(axis)
+	if length == 0 || angle == 0 {
+		return mat3Identity()
+	}
+	k := V.Scale(axis, 1/length)
+	K := V.Mat3{0, -k[2], k[1], k[2], 0, -k[0], -k[1], k[0], 0}
+	sin, cos := float32(Math.Sin(float64(angle))), float32(Math.Cos(float64(angle)))
+	return mat3Add(mat3Identity(), mat3Add(mat3Scale(K, sin), mat3Scale(mat3Mul(K, K), 1-cos)))
+}
+
+//mat3Rotation - Rotational part of the polar decomposition A = R S with Higham iterations
+//R = (R + R^-T) / 2. Falls back to identity for degenerate (flat or collapsed) matrices
+func mat3Rotation(a V.Mat3) V.Mat3 {
+	r := a
+	for k := 0; k < 20; k++ {
+		inv, ok := mat3Inverse(r)
+		if !ok {
+			return mat3Identity()
+		}
+		next := mat3Scale(mat3Add(r, mat3Transpose(inv)), 0.5)
+		diff := mat3Norm(mat3Add(next, mat3Scale(r, -1)))
+		r = next
+		if diff < 1e-6 {
+			break
+		}
+	}
+	if r.Det() < 0 {
+		return mat3Identity()
+	}
+	return r
+}
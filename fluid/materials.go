@@ -0,0 +1,157 @@
+package fluid
+
+import (
+	"encoding/json"
+	"fmt"
+	Math "math"
+	"os"
+	"sort"
+)
+
+//Material - Named fluid preset in SI units with the viscosity of MassFluidParticle, surface tension is
+//N/m and Stiffness is the Tait EOS stiffness B (Pa) which sets the numerical speed of sound
+//c = sqrt(B * EosExp / RestDensity). Stiffness is deliberately far below the physical bulk modulus
+//so time steps stay practical for weakly compressible SPH
+type Material struct {
+	Name           string  `json:"name"`
+	RestDensity    float32 `json:"rest_density"`
+	Viscosity      float32 `json:"viscosity"`
+	SurfaceTension float32 `json:"surface_tension"`
+	Stiffness      float32 `json:"stiffness"`
+	EosExp         float32 `json:"eos_exp"`
+}
+
+//presets - Built in materials, copied into every library returned by Presets
+var presets = []Material{
+	{"water", 1000, 0.001, 0.0728, 2.3e5, 7},
+	{"oil", 910, 0.084, 0.032, 2.1e5, 7},
+	{"honey", 1420, 10.0, 0.050, 3.2e5, 7},
+	{"lava", 2700, 100.0, 0.350, 6.2e5, 7},
+	{"blood", 1060, 0.0035, 0.058, 2.4e5, 7},
+}
+
+//MaterialLibrary - Named materials. Libraries are plain values owned by the caller, the built in presets
+//are never modified
+type MaterialLibrary map[string]Material
+
+//Presets - New library holding the built in presets
+func Presets() MaterialLibrary {
+	lib := MaterialLibrary{}
+	for _, m := range presets {
+		lib[m.Name] = m
+	}
+	return lib
+}
+
+//GetMaterial - Looks up a built in preset by name
+func GetMaterial(name string) (Material, error) {
+	return Presets().Get(name)
+}
+
+//MaterialNames - Sorted names of the built in presets
+func MaterialNames() []string {
+	return Presets().Names()
+}
+
+//Get - Looks up a material by name
+func (lib MaterialLibrary) Get(name string) (Material, error) {
+	m, ok := lib[name]
+	if !ok {
+		return Material{}, fmt.Errorf("Unknown material %q, available: %v", name, lib.Names())
+	}
+	return m, nil
+}
+
+//Names - Sorted names of all materials of the library
+func (lib MaterialLibrary) Names() []string {
+	names := make([]string, 0, len(lib))
+	for name := range lib {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Register - Validates and adds (or replaces) a material in the library
+func (lib MaterialLibrary) Register(m Material) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	lib[m.Name] = m
+	return nil
+}
+
+//LoadMaterials - Reads a JSON array of materials from a file. Returns the presets extended by the file,
+//entries replace presets of the same name. Fails without a library if any entry is invalid
+func LoadMaterials(path string) (MaterialLibrary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Material
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Material file %s: %s", path, err.Error())
+	}
+	lib := Presets()
+	for i := range list {
+		if err := lib.Register(list[i]); err != nil {
+			return nil, fmt.Errorf("Material file %s entry %d: %s", path, i, err.Error())
+		}
+	}
+	return lib, nil
+}
+
+//Validate - Checks the material properties are physically meaningful
+func (m *Material) Validate() error {
+	if m.Name == "" {
+		return &ParameterError{"Material", "Name", m.Name, "must not be empty"}
+	}
+	s := fmt.Sprintf("Material[%s]", m.Name)
+	checks := []error{
+		checkPositive(s, "RestDensity", m.RestDensity),
+		checkNonNegative(s, "Viscosity", m.Viscosity),
+		checkNonNegative(s, "SurfaceTension", m.SurfaceTension),
+		checkNonNegative(s, "Stiffness", m.Stiffness)}
+	if !isFinite(m.EosExp) || m.EosExp < 1 {
+		checks = append(checks, &ParameterError{s, "EosExp", m.EosExp, "must be finite and at least 1"})
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SpeedSound - Numerical speed of sound implied by the EOS stiffness
+func (m *Material) SpeedSound() float32 {
+	return float32(Math.Sqrt(float64(m.Stiffness * m.EosExp / m.RestDensity)))
+}
+
+//Apply - Fills the material dependent fields of a particle description. The speed of sound is the larger
+//of the material one and the one of the description, which NewMassFluidParticle sets to MACH_FACTOR times
+//the max velocity, so a soft material cannot push the flow past Mach 0.1. The time step is recomputed
+//since it depends on the speed of sound and viscosity
+func (m *Material) Apply(mfp *MassFluidParticle) {
+	mfp.TargetDensity = m.RestDensity
+	mfp.Viscosity = m.Viscosity
+	mfp.SurfaceTension = m.SurfaceTension
+	mfp.EosExp = m.EosExp
+	if c := m.SpeedSound(); c > mfp.SpeedSound {
+		mfp.SpeedSound = c
+	}
+	mfp.TimeStep = mfp.StableTimeStep(-GRAV)
+}
+
+//Particle - Particle description of the material for a given particle spacing and neighbor count
+func (m *Material) Particle(spacing float32, neighbors int, maxVelocity float32) (*MassFluidParticle, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	mfp, err := NewMassFluidParticle(spacing, m.RestDensity, neighbors, m.Viscosity, maxVelocity)
+	if err != nil {
+		return nil, err
+	}
+	m.Apply(mfp)
+	return mfp, nil
+}
@@ -0,0 +1,66 @@
+package fluid
+
+import (
+	Math "math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Presets resolve by name and custom materials load from a JSON file
+func TestMaterials(t *testing.T) {
+	honey, err := GetMaterial("honey")
+	if err != nil {
+		t.Fatalf("Missing honey preset %s\n", err.Error())
+	}
+	mfp, err := honey.Particle(0.01, 30, 1.0)
+	if err != nil {
+		t.Fatalf("Honey particle derivation failed %s\n", err.Error())
+	}
+	if mfp.Viscosity != honey.Viscosity || mfp.TargetDensity != honey.RestDensity || mfp.SurfaceTension != honey.SurfaceTension {
+		t.Errorf("Material was not applied to particle description\n")
+	}
+	if mfp.SpeedSound != honey.SpeedSound() {
+		t.Errorf("Stiff material should keep its speed of sound %f, got %f\n", honey.SpeedSound(), mfp.SpeedSound)
+	}
+	if fast, _ := honey.Particle(0.01, 30, 10.0); fast.SpeedSound != 10*MACH_FACTOR {
+		t.Errorf("Fast flow should raise the speed of sound to 10x its max velocity, got %f\n", fast.SpeedSound)
+	}
+	if _, err := GetMaterial("unobtainium"); err == nil {
+		t.Errorf("Expected error for unknown material\n")
+	}
+
+	dir, _ := os.MkdirTemp("", "materials")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "custom.json")
+	os.WriteFile(path, []byte(`[{"name": "syrup", "rest_density": 1330, "viscosity": 2.5, "surface_tension": 0.06, "stiffness": 3e5, "eos_exp": 7}]`), 0644)
+	lib, err := LoadMaterials(path)
+	if err != nil {
+		t.Fatalf("Loading custom materials failed %s\n", err.Error())
+	}
+	if _, err := lib.Get("syrup"); err != nil {
+		t.Errorf("Custom material was not loaded\n")
+	}
+	if _, err := lib.Get("honey"); err != nil {
+		t.Errorf("Loaded library should keep the presets\n")
+	}
+	if _, err := GetMaterial("syrup"); err == nil {
+		t.Errorf("Loading a library must not change the built in presets\n")
+	}
+
+	os.WriteFile(path, []byte(`[{"name": "bad", "rest_density": -1, "eos_exp": 7}]`), 0644)
+	if _, err := LoadMaterials(path); err == nil {
+		t.Errorf("Expected validation error for negative density\n")
+	}
+
+	bad := map[string]Material{
+		"Name":      {RestDensity: 1000, EosExp: 7},
+		"Viscosity": {Name: "nan", RestDensity: 1000, Viscosity: float32(Math.NaN()), EosExp: 7},
+		"Stiffness": {Name: "inf", RestDensity: 1000, Stiffness: float32(Math.Inf(1)), EosExp: 7},
+		"EosExp":    {Name: "soft", RestDensity: 1000, EosExp: 0.5}}
+	for field, m := range bad {
+		if perr, ok := m.Validate().(*ParameterError); !ok || perr.Field != field {
+			t.Errorf("Expected %s parameter error, got %v\n", field, m.Validate())
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	"sort"
+)
+
+//Morton (Z-order) reordering. Particles are sorted along the Z-order curve of their grid cells so that
+//particles close in space are close in memory and the neighbor loops walk mostly contiguous memory.
+//Reordering permutes every per particle buffer, IDs keep the particle numbering stable for callers
+//that track particles across steps
+
+const MORTON_BITS = 21 //Bits per axis of the 63 bit Morton code
+
+//Morton - Interleaves the low MORTON_BITS bits of the cell coordinates, x in the lowest bit
+func Morton(cell [3]uint32) uint64 {
+	code := uint64(0)
+	for k := 0; k < 3; k++ {
+		v := uint64(cell[k]) & (1<<MORTON_BITS - 1)
+		v = (v | v<<32) & 0x1f00000000ffff
+		v = (v | v<<16) & 0x1f0000ff0000ff
+		v = (v | v<<8) & 0x100f00f00f00f00f
+		v = (v | v<<4) & 0x10c30c30c30c30c3
+		v = (v | v<<2) & 0x1249249249249249
+		code |= v << uint(k)
+	}
+	return code
+}
+
+//MortonOrder - Particle indexes sorted by the Morton code of their grid cell. Cells are taken relative to
+//the lowest occupied cell, particles of the same cell keep their order
+func (fluid *SPHFluid) MortonOrder() []int {
+	n := fluid.Count
+	cells := make([][3]int, n)
+	var lo [3]int
+	for i := 0; i < n; i++ {
+		cells[i] = *fluid.SPHGrid.Hash(&fluid.Positions[i])
+		for k := 0; k < 3; k++ {
+			if i == 0 || cells[i][k] < lo[k] {
+				lo[k] = cells[i][k]
+			}
+		}
+	}
+	codes := make([]uint64, n)
+	order := make([]int, n)
+	for i := range order {
+		var c [3]uint32
+		for k := 0; k < 3; k++ {
+			d := cells[i][k] - lo[k]
+			if d >= 1<<MORTON_BITS { //Far outliers share the last cell of the curve
+				d = 1<<MORTON_BITS - 1
+			}
+			c[k] = uint32(d)
+		}
+		codes[i] = Morton(c)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return codes[order[a]] < codes[order[b]] })
+	return order
+}
+
+//Reorder - Sorts all particle buffers into Morton order and rebuilds the grid and the neighbor lists.
+//Particle indexes change, IDs and Index map between them and the stable particle IDs
+func (fluid *SPHFluid) Reorder() {
+	fluid.assignIDs()
+	fluid.sinceReorder = 0
+	order := fluid.MortonOrder()
+	sorted := true
+	for i, j := range order {
+		sorted = sorted && i == j
+	}
+	if sorted {
+		return
+	}
+
+	n := fluid.Count
+	fluid.Positions = permuteVecs(fluid.Positions, order, n)
+	fluid.Velocities = permuteVecs(fluid.Velocities, order, n)
+	fluid.Forces = permuteVecs(fluid.Forces, order, n)
+	fluid.Densities = permuteFloats(fluid.Densities, order, n)
+	fluid.Pressures = permuteFloats(fluid.Pressures, order, n)
+	fluid.Temperatures = permuteFloats(fluid.Temperatures, order, n)
+	fluid.Latent = permuteFloats(fluid.Latent, order, n)
+	fluid.Stresses = permuteMats(fluid.Stresses, order, n)
+	fluid.IDs = permuteInts(fluid.IDs, order, n)
+	if len(fluid.Phases) == n {
+		phases := make([]Phase, n)
+		for k, i := range order {
+			phases[k] = fluid.Phases[i]
+		}
+		fluid.Phases = phases
+	}
+	for _, field := range fluid.Scalars {
+		field.Values = permuteFloats(field.Values, order, n)
+	}
+
+	//Solid particles follow their fluid particles, their own buffers are indexed by solid particle
+	rank := make([]int, n)
+	for k, i := range order {
+		rank[i] = k
+	}
+	for _, solid := range fluid.Solids {
+		for l, i := range solid.Indices {
+			solid.Indices[l] = rank[i]
+		}
+	}
+
+	fluid.slots = nil
+	fluid.SPHGrid.Load(fluid.Positions) //Cannot fail for existing positions
+	fluid.UpdateNeighbors()
+}
+
+//reorderDue - Reorders when ReorderEvery steps passed since the last reordering
+func (fluid *SPHFluid) reorderDue() {
+	if fluid.ReorderEvery > 0 && fluid.sinceReorder >= fluid.ReorderEvery {
+		fluid.Reorder()
+	}
+}
+
+//assignIDs - Numbers particles without an ID (initialization, emitters) after the existing ones
+func (fluid *SPHFluid) assignIDs() {
+	if len(fluid.IDs) > fluid.Count {
+		fluid.IDs = fluid.IDs[:fluid.Count]
+		fluid.slots = nil
+	}
+	for id := len(fluid.IDs); id < fluid.Count; id++ {
+		fluid.IDs = append(fluid.IDs, id)
+	}
+}
+
+//Index - Current index of the particle with the stable ID, -1 for unknown IDs
+func (fluid *SPHFluid) Index(id int) int {
+	fluid.assignIDs()
+	if len(fluid.slots) != len(fluid.IDs) {
+		fluid.slots = make([]int, len(fluid.IDs))
+		for i, id := range fluid.IDs {
+			fluid.slots[id] = i
+		}
+	}
+	if id < 0 || id >= len(fluid.slots) {
+		return -1
+	}
+	return fluid.slots[id]
+}
+
+func permuteVecs(buf []V.Vec32, order []int, n int) []V.Vec32 {
+	if len(buf) != n {
+		return buf
+	}
+	next := make([]V.Vec32, n)
+	for k, i := range order {
+		next[k] = buf[i]
+	}
+	return next
+}
+
+func permuteFloats(buf []float32, order []int, n int) []float32 {
+	if len(buf) != n {
+		return buf
+	}
+	next := make([]float32, n)
+	for k, i := range order {
+		next[k] = buf[i]
+	}
+	return next
+}
+
+func permuteMats(buf []V.Mat3, order []int, n int) []V.Mat3 {
+	if len(buf) != n {
+		return buf
+	}
+	next := make([]V.Mat3, n)
+	for k, i := range order {
+		next[k] = buf[i]
+	}
+	return next
+}
+
+func permuteInts(buf []int, order []int, n int) []int {
+	if len(buf) != n {
+		return buf
+	}
+	next := make([]int, n)
+	for k, i := range order {
+		next[k] = buf[i]
+	}
+	return next
+}
@@ -0,0 +1,168 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+)
+
+//Per step neighbor lists. The neighbor search is queried once per particle and step, the neighbors within the kernel
+//radius are stored in compressed sparse rows together with their distances and directions so the density,
+//pressure and viscosity passes only walk arrays. All buffers are reused between steps
+
+//NeighborList - Neighbors of every particle, the neighbors of particle i are the entries Offsets[i] to
+//Offsets[i+1]. The particle itself is not listed
+type NeighborList struct {
+	Radius     float32
+	Offsets    []int
+	Indices    []int
+	Distances  []float32
+	Directions []V.Vec32 //Unit vectors (x_j - x_i) / r from i to the neighbor, zero for coincident particles
+	scratch    []Neighbor
+	images     []V.Vec32
+	stale      bool //Particles moved since the lists were built
+}
+
+//PeriodicDomain - Axes along which the fluid wraps around. Particles leaving the domain re-enter on the
+//opposite side and find their neighbors across the boundary. Axes of zero length stay open, periodic
+//lengths have to exceed twice the kernel radius
+type PeriodicDomain struct {
+	Min    V.Vec32
+	Length V.Vec32
+}
+
+//Wrap - Moves the position into the domain along the periodic axes
+func (d *PeriodicDomain) Wrap(p *V.Vec32) {
+	for k := 0; k < 3; k++ {
+		if d.Length[k] > 0 {
+			x := p[k] - d.Min[k]
+			p[k] = d.Min[k] + x - d.Length[k]*float32(Math.Floor(float64(x/d.Length[k])))
+		}
+	}
+}
+
+//images - Appends the offsets of the periodic images of the position that lie within radius of the
+//domain, the position itself first
+func (d *PeriodicDomain) images(offsets []V.Vec32, p V.Vec32, radius float32) []V.Vec32 {
+	offsets = append(offsets[:0], V.Vec32{})
+	for k := 0; k < 3; k++ {
+		if d.Length[k] <= 0 {
+			continue
+		}
+		shift := float32(0)
+		if p[k]-radius < d.Min[k] {
+			shift = d.Length[k]
+		} else if p[k]+radius >= d.Min[k]+d.Length[k] {
+			shift = -d.Length[k]
+		}
+		if shift == 0 {
+			continue
+		}
+		for _, o := range offsets {
+			o[k] += shift
+			offsets = append(offsets, o)
+		}
+	}
+	return offsets
+}
+
+//Build - Queries the search for the neighbors of all positions within radius, the search has to be
+//built over the positions
+func (n *NeighborList) Build(search NeighborSearch, positions []V.Vec32, radius float32) {
+	n.BuildPeriodic(search, positions, radius, nil)
+}
+
+//BuildPeriodic - Build that also finds the neighbors across the boundaries of a periodic domain, the
+//positions have to be wrapped into the domain. Directions point to the nearest image of the neighbor
+func (n *NeighborList) BuildPeriodic(search NeighborSearch, positions []V.Vec32, radius float32, domain *PeriodicDomain) {
+	n.Radius = radius
+	n.stale = false
+	n.Offsets = append(n.Offsets[:0], 0)
+	n.Indices = n.Indices[:0]
+	n.Distances = n.Distances[:0]
+	n.Directions = n.Directions[:0]
+	n.images = append(n.images[:0], V.Vec32{})
+	for i := range positions {
+		if domain != nil {
+			n.images = domain.images(n.images, positions[i], radius)
+		}
+		for _, offset := range n.images {
+			query := V.Add(positions[i], offset)
+			n.scratch = search.QueryAppend(n.scratch[:0], query, radius)
+			for _, nb := range n.scratch {
+				if nb.Index == i {
+					continue
+				}
+				dir := V.Vec32{}
+				if nb.Distance > 0 {
+					dir = V.Scale(V.Sub(positions[nb.Index], query), 1/nb.Distance)
+				}
+				n.Indices = append(n.Indices, nb.Index)
+				n.Distances = append(n.Distances, nb.Distance)
+				n.Directions = append(n.Directions, dir)
+			}
+		}
+		n.Offsets = append(n.Offsets, len(n.Indices))
+	}
+}
+
+//Particles - Number of particles the lists were built for
+func (n *NeighborList) Particles() int {
+	if len(n.Offsets) == 0 {
+		return 0
+	}
+	return len(n.Offsets) - 1
+}
+
+//Range - Entries of the neighbors of particle i
+func (n *NeighborList) Range(i int) (int, int) {
+	return n.Offsets[i], n.Offsets[i+1]
+}
+
+//Count - Number of neighbors of particle i
+func (n *NeighborList) Count(i int) int {
+	return n.Offsets[i+1] - n.Offsets[i]
+}
+
+//UpdateNeighbors - Rebuilds the neighbor search and the neighbor lists of all particles within the kernel
+//radius
+func (fluid *SPHFluid) UpdateNeighbors() {
+	if fluid.Neighbors == nil {
+		fluid.Neighbors = &NeighborList{}
+	}
+	positions := fluid.Positions[:fluid.Count]
+	fluid.applyWorkers()
+	if fluid.Search != nil { //The spatial grid is kept current by the step itself
+		fluid.Search.Build(positions)
+	}
+	fluid.Neighbors.BuildPeriodic(fluid.neighborSearch(), positions, fluid.Mfp.InnerRadius, fluid.Periodic)
+}
+
+//neighborSearch - Backend of the neighbor lists, the spatial grid unless another one was selected
+func (fluid *SPHFluid) neighborSearch() NeighborSearch {
+	if fluid.Search == nil {
+		return fluid.SPHGrid
+	}
+	return fluid.Search
+}
+
+//Invalidate - Marks the lists stale after the particles moved, the next use through the fluid rebuilds them
+func (n *NeighborList) Invalidate() {
+	n.stale = true
+}
+
+//invalidateNeighbors - Marks the neighbor lists stale after the particles moved
+func (fluid *SPHFluid) invalidateNeighbors() {
+	if fluid.Neighbors != nil {
+		fluid.Neighbors.Invalidate()
+	}
+}
+
+//neighborList - Neighbor lists of the current positions, built when missing, invalidated or made for another
+//particle count. Passes that move the particles (the end of a step, snapshot restores) invalidate them
+func (fluid *SPHFluid) neighborList() *NeighborList {
+	nl := fluid.Neighbors
+	if nl == nil || nl.stale || nl.Particles() != fluid.Count || nl.Radius != fluid.Mfp.InnerRadius {
+		fluid.UpdateNeighbors()
+	}
+	return fluid.Neighbors
+}
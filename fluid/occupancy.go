@@ -0,0 +1,177 @@
+package fluid
+
+import (
+	"fmt"
+	Math "math"
+	"strings"
+)
+
+//Grid occupancy diagnostics. Radius queries are fast when the cells match the query radius, the particles
+//spread over many cells and the compact hash buckets hold one cell each. The occupancy report measures
+//all three on the loaded particles and recommends a cell size, dense subdivision and table size
+
+const OCCUPANCY_CHAIN = 4     //Hash buckets holding more cells than this slow every cell lookup
+const OCCUPANCY_SPARSE = 0.05 //Dense grids with fewer occupied cells than this fraction waste memory
+
+//GridOccupancy - Occupancy of the grid cells and cost of the radius queries of every particle
+type GridOccupancy struct {
+	Particles     int
+	Cells         int     //Addressable cells of the dense grid, stored cells of the compact table
+	Occupied      int     //Cells holding particles
+	Histogram     []int   //Histogram[k] - cells holding k particles
+	MaxCell       int     //Most particles in one cell
+	Clamped       int     //Particles outside the dense domain, sorted into its border cells
+	Buckets       int     //Hash table buckets, 0 for the dense grid
+	MaxChain      int     //Most cells in one hash bucket
+	Collisions    int     //Cells sharing their hash bucket with an earlier cell
+	Radius        float32 //Query radius the neighbor counts were measured with
+	AvgNeighbors  float32 //Particles within the radius of a particle, the particle itself excluded
+	AvgCandidates float32 //Particles distance tested by a query
+	Efficiency    float32 //Share of the tested particles within the radius
+
+	CellSize  float32  //Recommended cell size, the query radius
+	Dims      [3]int   //Recommended dense subdivision, zero when the domain exceeds MAX_GRID_SUBDIV
+	TableSize int      //Recommended compact table buckets
+	Advice    []string //Problems found, empty when the grid is well tuned
+}
+
+//Occupancy - Measures the occupancy of the loaded grid and the cost of a radius query around every
+//particle. The radius is usually the kernel radius
+func (s *SpatialHashGrid) Occupancy(radius float32) GridOccupancy {
+	o := GridOccupancy{Particles: len(s.Keys), Occupied: s.Occupied, Radius: radius, Buckets: len(s.Table)}
+	if s.Table != nil {
+		o.Cells = len(s.Cells)
+	} else {
+		o.Cells = s.Dims[0] * s.Dims[1] * s.Dims[2]
+	}
+
+	//Cells
+	for c := range s.Start {
+		n := s.End[c] - s.Start[c]
+		for len(o.Histogram) <= n {
+			o.Histogram = append(o.Histogram, 0)
+		}
+		o.Histogram[n]++
+		if n > o.MaxCell {
+			o.MaxCell = n
+		}
+	}
+	for _, bucket := range s.Table {
+		if len(bucket) > o.MaxChain {
+			o.MaxChain = len(bucket)
+		}
+		if len(bucket) > 1 {
+			o.Collisions += len(bucket) - 1
+		}
+	}
+	if s.Table == nil && o.Cells > 0 {
+		o.MaxChain = 1
+	}
+
+	//Queries
+	neighbors, candidates := 0, 0
+	for i := 0; i < o.Particles; i++ {
+		p := s.Positions[i]
+		if s.Table == nil {
+			for k := 0; k < 3; k++ {
+				if c := Math.Floor(float64((p[k] - s.Origin[k]) / s.CellSize)); c < 0 || c >= float64(s.Dims[k]) {
+					o.Clamped++
+					break
+				}
+			}
+		}
+		if !(radius >= 0) {
+			continue
+		}
+		s.visitCells(p, radius, func(indexes []int) {
+			candidates += len(indexes)
+			for _, j := range indexes {
+				if j != i && p.Distance(s.Positions[j]) <= radius {
+					neighbors++
+				}
+			}
+		})
+	}
+	if o.Particles > 0 {
+		o.AvgNeighbors = float32(neighbors) / float32(o.Particles)
+		o.AvgCandidates = float32(candidates) / float32(o.Particles)
+	}
+	if candidates > 0 {
+		o.Efficiency = float32(neighbors+o.Particles) / float32(candidates)
+	}
+
+	//Recommendation
+	o.CellSize = s.CellSize
+	if radius > 0 && isFinite(radius) {
+		o.CellSize = radius
+	}
+	o.TableSize = nextPrime(2 * o.Occupied)
+	compact := o.Particles == 0
+	if o.Particles > 0 {
+		min, max := bounds(s.Positions[:o.Particles])
+		for k := 0; k < 3; k++ {
+			cells := Math.Floor(float64((max[k]-min[k])/o.CellSize)) + 3 //One padding cell per side, see GridForDomain
+			if !(cells <= MAX_GRID_SUBDIV) {
+				compact = true
+				break
+			}
+			o.Dims[k] = int(cells)
+		}
+	}
+	if compact {
+		o.Dims = [3]int{}
+	}
+	o.advise(s, compact)
+	return o
+}
+
+//advise - Collects the problems found in the occupancy
+func (o *GridOccupancy) advise(s *SpatialHashGrid, compact bool) {
+	if o.Particles == 0 {
+		return
+	}
+	if o.Radius > 0 && Math.Abs(float64(s.CellSize-o.Radius)) > 0.01*float64(o.Radius) {
+		o.Advice = append(o.Advice, fmt.Sprintf("cell size %g differs from the query radius %g, queries test %.1f particles for %.1f neighbors: use cell size %g",
+			s.CellSize, o.Radius, o.AvgCandidates, o.AvgNeighbors, o.CellSize))
+	}
+	if s.Table == nil {
+		if o.Clamped > 0 {
+			o.Advice = append(o.Advice, fmt.Sprintf("%d particles left the domain and crowd its border cells: enlarge the domain or use the compact table", o.Clamped))
+		}
+		if compact {
+			o.Advice = append(o.Advice, fmt.Sprintf("the particles span more than %d cells per axis: use the compact table", MAX_GRID_SUBDIV))
+		} else if o.Cells > 0 && float64(o.Occupied) < OCCUPANCY_SPARSE*float64(o.Cells) {
+			o.Advice = append(o.Advice, fmt.Sprintf("only %d of %d cells are occupied: use subdivision %v or the compact table", o.Occupied, o.Cells, o.Dims))
+		}
+		return
+	}
+	if o.MaxChain > OCCUPANCY_CHAIN || o.Buckets < o.Occupied {
+		o.Advice = append(o.Advice, fmt.Sprintf("%d cells share %d hash buckets with up to %d cells per bucket: use %d buckets",
+			o.Occupied, o.Buckets, o.MaxChain, o.TableSize))
+	}
+}
+
+func (o GridOccupancy) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%d particles in %d of %d cells, at most %d per cell", o.Particles, o.Occupied, o.Cells, o.MaxCell)
+	if o.Buckets > 0 {
+		fmt.Fprintf(&b, ", %d buckets with %d collisions and chains up to %d", o.Buckets, o.Collisions, o.MaxChain)
+	}
+	fmt.Fprintf(&b, "\nradius %g: %.1f neighbors of %.1f tested particles (efficiency %.2f)", o.Radius, o.AvgNeighbors, o.AvgCandidates, o.Efficiency)
+	fmt.Fprintf(&b, "\nparticles per cell:")
+	for n, cells := range o.Histogram {
+		if cells > 0 {
+			fmt.Fprintf(&b, " %d:%d", n, cells)
+		}
+	}
+	fmt.Fprintf(&b, "\nrecommended cell size %g, subdivision %v, %d buckets", o.CellSize, o.Dims, o.TableSize)
+	for _, advice := range o.Advice {
+		fmt.Fprintf(&b, "\n- %s", advice)
+	}
+	return b.String()
+}
+
+//GridOccupancy - Occupancy of the spatial grid for queries of the kernel radius
+func (fluid *SPHFluid) GridOccupancy() GridOccupancy {
+	return fluid.SPHGrid.Occupancy(fluid.Mfp.InnerRadius)
+}
@@ -0,0 +1,265 @@
+package fluid
+
+import V "diesel.com/diesel/vector"
+
+//Octree over the particle positions. The root box bounds all particles, nodes holding more than LeafSize
+//particles are divided into their eight octants until MaxDepth. Empty space costs no nodes, which suits
+//sparse spray around a dense pool
+
+const OCTREE_LEAF = 16
+const OCTREE_DEPTH = 21
+
+//octNode - Box [Min, Max] owning Order[Start:End], divided at its center. Children are -1 when empty
+type octNode struct {
+	Min      V.Vec32
+	Max      V.Vec32
+	Start    int
+	End      int
+	Children [8]int
+	Leaf     bool
+}
+
+//Octree - Adaptive octree, the root is node 0
+type Octree struct {
+	LeafSize  int
+	MaxDepth  int
+	Workers   int //Goroutines building the subtrees, 0 or 1 builds serially
+	Positions []V.Vec32
+	Order     []int //Particle indexes, the particles of a node are contiguous
+	Nodes     []octNode
+	finite    int //Order[finite:] are non finite positions outside the tree
+	scratch   []int
+}
+
+//Build - Rebuilds the tree over the positions. Non finite positions are kept outside the tree and are
+//only found by infinite radius queries
+func (o *Octree) Build(positions []V.Vec32) error {
+	if o.LeafSize < 1 {
+		o.LeafSize = OCTREE_LEAF
+	}
+	if o.MaxDepth < 1 {
+		o.MaxDepth = OCTREE_DEPTH
+	}
+	o.Positions = positions
+	o.Order = o.Order[:0]
+	o.Nodes = o.Nodes[:0]
+	var min, max V.Vec32
+	var extra []int
+	for i, p := range positions {
+		if !isFinite(p[0]) || !isFinite(p[1]) || !isFinite(p[2]) {
+			extra = append(extra, i)
+			continue
+		}
+		if len(o.Order) == 0 {
+			min, max = p, p
+		}
+		for k := 0; k < 3; k++ {
+			if p[k] < min[k] {
+				min[k] = p[k]
+			}
+			if p[k] > max[k] {
+				max[k] = p[k]
+			}
+		}
+		o.Order = append(o.Order, i)
+	}
+	o.finite = len(o.Order)
+	if o.finite > 0 {
+		root := octNode{Min: min, Max: max, Start: 0, End: o.finite, Leaf: true}
+		for c := range root.Children {
+			root.Children[c] = -1
+		}
+		o.Nodes = append(o.Nodes, root)
+		o.build()
+	}
+	o.Order = append(o.Order, extra...)
+	return nil
+}
+
+//build - Splits the root. With several workers the top levels are split serially until every worker has
+//a subtree, the subtrees are built into their own node buffers and appended. Splits only depend on the
+//particles, so the tree equals the serial one
+func (o *Octree) build() {
+	workers := sortWorkers(o.Workers, o.finite, 0)
+	if workers == 1 {
+		o.split(0, 0, -1, nil)
+		return
+	}
+	levels := 1
+	for 1<<uint(3*levels) < workers {
+		levels++
+	}
+	var tasks []int
+	o.split(0, 0, levels, &tasks)
+	subtrees := make([][]octNode, len(tasks))
+	parallelFor(len(tasks), workers, func(w int, lo int, hi int) {
+		for k := lo; k < hi; k++ {
+			sub := &Octree{LeafSize: o.LeafSize, MaxDepth: o.MaxDepth, Positions: o.Positions, Order: o.Order}
+			sub.Nodes = []octNode{o.Nodes[tasks[k]]}
+			sub.split(0, levels, -1, nil)
+			subtrees[k] = sub.Nodes
+		}
+	})
+	for k, nodes := range subtrees {
+		offset := len(o.Nodes) - 1 //Local node l > 0 is appended at offset + l, the local root replaces the task node
+		for l := range nodes {
+			for c, child := range nodes[l].Children {
+				if child >= 0 {
+					nodes[l].Children[c] = child + offset
+				}
+			}
+		}
+		o.Nodes[tasks[k]] = nodes[0]
+		o.Nodes = append(o.Nodes, nodes[1:]...)
+	}
+}
+
+//center - Dividing point of the node
+func (node *octNode) center() V.Vec32 {
+	return V.Scale(V.Add(node.Min, node.Max), 0.5)
+}
+
+//octant - Child of the node containing p, points on a center plane belong to the upper octant
+func octant(center V.Vec32, p V.Vec32) int {
+	c := 0
+	for k := 0; k < 3; k++ {
+		if p[k] >= center[k] {
+			c |= 1 << uint(k)
+		}
+	}
+	return c
+}
+
+//split - Divides the node into its octants while it holds more than LeafSize particles. Nodes
+//levels deep are left as leaves and recorded in tasks, negative levels split down to the leaves
+func (o *Octree) split(n int, depth int, levels int, tasks *[]int) {
+	node := o.Nodes[n]
+	extent := V.Sub(node.Max, node.Min)
+	if node.End-node.Start <= o.LeafSize || depth >= o.MaxDepth || !(extent[0] > 0 || extent[1] > 0 || extent[2] > 0) {
+		return
+	}
+	if levels == 0 {
+		*tasks = append(*tasks, n)
+		return
+	}
+	center := node.center()
+	var count, next [8]int
+	for _, idx := range o.Order[node.Start:node.End] {
+		count[octant(center, o.Positions[idx])]++
+	}
+	next[0] = node.Start
+	for c := 1; c < 8; c++ {
+		next[c] = next[c-1] + count[c-1]
+	}
+	o.scratch = append(o.scratch[:0], o.Order[node.Start:node.End]...)
+	for _, idx := range o.scratch {
+		c := octant(center, o.Positions[idx])
+		o.Order[next[c]] = idx
+		next[c]++
+	}
+	o.Nodes[n].Leaf = false
+	for c := 0; c < 8; c++ {
+		if count[c] == 0 {
+			continue
+		}
+		min, max := node.Min, node.Max
+		for k := 0; k < 3; k++ {
+			if c&(1<<uint(k)) != 0 {
+				min[k] = center[k]
+			} else {
+				max[k] = center[k]
+			}
+		}
+		child := octNode{Min: min, Max: max, Start: next[c] - count[c], End: next[c], Leaf: true}
+		for i := range child.Children {
+			child.Children[i] = -1
+		}
+		o.Nodes[n].Children[c] = len(o.Nodes)
+		o.Nodes = append(o.Nodes, child)
+		o.split(o.Nodes[n].Children[c], depth+1, levels-1, tasks)
+	}
+}
+
+//distance - Distance from p to the box of the node, 0 inside
+func (node *octNode) distance(p V.Vec32) float32 {
+	return boxDistance(p, node.Min, node.Max)
+}
+
+//QueryAppend - Appends all particles within radius of the position (inclusive)
+func (o *Octree) QueryAppend(found []Neighbor, position V.Vec32, radius float32) []Neighbor {
+	if !(radius >= 0) {
+		return found
+	}
+	visit := func(indexes []int) {
+		for _, idx := range indexes {
+			dist := position.Distance(o.Positions[idx])
+			if dist <= radius {
+				found = append(found, Neighbor{idx, dist})
+			}
+		}
+	}
+	visit(o.Order[o.finite:])
+	stack := []int{}
+	if len(o.Nodes) > 0 {
+		stack = append(stack, 0)
+	}
+	for len(stack) > 0 {
+		node := &o.Nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if node.Leaf {
+			visit(o.Order[node.Start:node.End])
+			continue
+		}
+		for _, c := range node.Children {
+			if c >= 0 && o.Nodes[c].distance(position) <= radius {
+				stack = append(stack, c)
+			}
+		}
+	}
+	return found
+}
+
+//Nearest - The k nearest particles, children are descended nearest box first
+func (o *Octree) Nearest(position V.Vec32, k int) []Neighbor {
+	if k <= 0 || len(o.Order) == 0 {
+		return nil
+	}
+	heap := knnHeap{k: k}
+	for _, idx := range o.Order[o.finite:] {
+		heap.push(Neighbor{idx, position.Distance(o.Positions[idx])})
+	}
+	if len(o.Nodes) > 0 {
+		o.nearest(0, position, &heap)
+	}
+	return heap.sorted()
+}
+
+func (o *Octree) nearest(n int, position V.Vec32, heap *knnHeap) {
+	node := &o.Nodes[n]
+	if node.Leaf {
+		for _, idx := range o.Order[node.Start:node.End] {
+			heap.push(Neighbor{idx, position.Distance(o.Positions[idx])})
+		}
+		return
+	}
+	var children [8]int
+	var dists [8]float32
+	m := 0
+	for _, c := range node.Children {
+		if c < 0 {
+			continue
+		}
+		d := o.Nodes[c].distance(position)
+		j := m
+		for ; j > 0 && dists[j-1] > d; j-- {
+			children[j], dists[j] = children[j-1], dists[j-1]
+		}
+		children[j], dists[j] = c, d
+		m++
+	}
+	for j := 0; j < m; j++ {
+		if dists[j] <= heap.bound() {
+			o.nearest(children[j], position, heap)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package fluid
+
+import (
+	"runtime"
+	"sync"
+)
+
+//Parallel grid construction. The particles are split into one contiguous chunk per worker for the cell
+//index computation, every worker counts the cell keys of its chunk, a parallel prefix sum over the cells
+//turns the counts into per worker write offsets and every worker scatters its chunk. Chunks are scattered
+//in particle order, so the result equals the serial counting sort for any number of workers
+
+const PARALLEL_GRAIN = 2048 //Fewest particles per worker worth a goroutine
+const PARALLEL_COUNTS = 8   //Per worker cell counts may take up to this many ints per particle
+
+//parallelFor - Runs body on workers contiguous chunks [lo, hi) of [0, n) concurrently, chunk w is
+//[n * w / workers, n * (w + 1) / workers)
+func parallelFor(n int, workers int, body func(w int, lo int, hi int)) {
+	if workers <= 1 {
+		body(0, 0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			body(w, n*w/workers, n*(w+1)/workers)
+		}(w)
+	}
+	wg.Wait()
+}
+
+//workers - Goroutines of the grid and neighbor search builds of the fluid
+func (fluid *SPHFluid) workers() int {
+	if fluid.Workers > 0 {
+		return fluid.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+//applyWorkers - Hands the worker count to the grid and the selected search backend
+func (fluid *SPHFluid) applyWorkers() {
+	workers := fluid.workers()
+	if fluid.SPHGrid != nil {
+		fluid.SPHGrid.Workers = workers
+	}
+	switch search := fluid.Search.(type) {
+	case *SpatialHashGrid:
+		search.Workers = workers
+	case *KDTree:
+		search.Workers = workers
+	case *Octree:
+		search.Workers = workers
+	}
+}
+
+//sortWorkers - Workers worth using for n particles over the given number of cells
+func sortWorkers(workers int, n int, cells int) int {
+	if max := n / PARALLEL_GRAIN; workers > max {
+		workers = max
+	}
+	if cells > 0 {
+		if max := PARALLEL_COUNTS * n / cells; workers > max { //Sparse dense grids, count arrays would dominate
+			workers = max
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+//CountingSort - Stable counting sort of the particle indexes by cell key. Key keys[i] of particle i has to
+//lie in [0, len(start)), start and end receive the range of every key in sorted, which has to hold
+//len(keys) entries. Up to workers goroutines are used. Returns the number of keys holding particles
+func CountingSort(keys []int, workers int, sorted []int, start []int, end []int) int {
+	n, cells := len(keys), len(start)
+	workers = sortWorkers(workers, n, cells)
+
+	if workers == 1 {
+		return countingSort(keys, sorted, start, end)
+	}
+
+	//Count
+	counts := make([][]int, workers)
+	parallelFor(n, workers, func(w int, lo int, hi int) {
+		counts[w] = make([]int, cells)
+		count := counts[w]
+		for _, k := range keys[lo:hi] {
+			count[k]++
+		}
+	})
+
+	//Prefix sum, every block of cells is summed, the block totals are scanned and the blocks write their
+	//ranges. The counts become the first write offset of every worker
+	totals := make([]int, workers)
+	occupied := make([]int, workers)
+	parallelFor(cells, workers, func(b int, lo int, hi int) {
+		for c := lo; c < hi; c++ {
+			sum := 0
+			for w := range counts {
+				sum += counts[w][c]
+			}
+			totals[b] += sum
+			if sum > 0 {
+				occupied[b]++
+			}
+		}
+	})
+	first := 0
+	for b := range totals {
+		first, totals[b] = first+totals[b], first
+	}
+	parallelFor(cells, workers, func(b int, lo int, hi int) {
+		next := totals[b]
+		for c := lo; c < hi; c++ {
+			start[c] = next
+			for w := range counts {
+				next, counts[w][c] = next+counts[w][c], next
+			}
+			end[c] = next
+		}
+	})
+
+	//Scatter
+	parallelFor(n, workers, func(w int, lo int, hi int) {
+		offset := counts[w]
+		for i := lo; i < hi; i++ {
+			sorted[offset[keys[i]]] = i
+			offset[keys[i]]++
+		}
+	})
+	sum := 0
+	for _, o := range occupied {
+		sum += o
+	}
+	return sum
+}
+
+//countingSort - Serial counting sort, the keys are counted into end which then holds the write offsets
+func countingSort(keys []int, sorted []int, start []int, end []int) int {
+	for c := range end {
+		end[c] = 0
+	}
+	for _, k := range keys {
+		end[k]++
+	}
+	first, occupied := 0, 0
+	for c := range start {
+		count := end[c]
+		start[c] = first
+		end[c] = first
+		first += count
+		if count > 0 {
+			occupied++
+		}
+	}
+	for i, k := range keys {
+		sorted[end[k]] = i
+		end[k]++
+	}
+	return occupied
+}
+
+//cellKeys - Computes the cell coordinates and keys of all positions with up to workers goroutines
+func (s *SpatialHashGrid) cellKeys(workers int) {
+	n := len(s.Positions)
+	workers = sortWorkers(workers, n, 0)
+	parallelFor(n, workers, func(w int, lo int, hi int) {
+		for i := lo; i < hi; i++ {
+			s.Coords[i] = *s.Hash(&s.Positions[i])
+			if s.Table == nil {
+				s.Keys[i] = s.key(s.Coords[i], false)
+			}
+		}
+	})
+	if s.Table != nil {
+		s.handles(workers)
+	}
+}
+
+//handles - Assigns the compact handles of all particle cells of the emptied table. Worker w owns the hash
+//buckets b with b % workers == w and numbers its new cells locally, the cells are then renumbered in the order
+//of their first particle. The handles equal those of the serial pass for any number of workers
+func (s *SpatialHashGrid) handles(workers int) {
+	n := len(s.Keys)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			s.Keys[i] = s.key(s.Coords[i], true)
+		}
+		return
+	}
+	buckets := make([]int, n)
+	parallelFor(n, workers, func(w int, lo int, hi int) {
+		for i := lo; i < hi; i++ {
+			buckets[i] = s.bucket(s.Coords[i])
+		}
+	})
+	local := make([]int, workers)
+	created := make([]bool, n)
+	parallelFor(workers, workers, func(w int, lo int, hi int) {
+		for i, b := range buckets {
+			if b%workers != w {
+				continue
+			}
+			s.Keys[i] = -1
+			for _, c := range s.Table[b] {
+				if c.Cell == s.Coords[i] {
+					s.Keys[i] = c.Handle
+					break
+				}
+			}
+			if s.Keys[i] < 0 {
+				s.Keys[i] = local[w]
+				s.Table[b] = append(s.Table[b], HashCell{s.Coords[i], local[w]})
+				created[i] = true
+				local[w]++
+			}
+		}
+	})
+
+	//Canonical handles, a cell is created by its first particle
+	canonical := make([][]int, workers)
+	for w := range canonical {
+		canonical[w] = make([]int, local[w])
+	}
+	for i, first := range created {
+		if first {
+			canonical[buckets[i]%workers][s.Keys[i]] = len(s.Cells)
+			s.Cells = append(s.Cells, s.Coords[i])
+		}
+	}
+	s.Start = append(s.Start, make([]int, len(s.Cells)-len(s.Start))...)
+	s.End = append(s.End, make([]int, len(s.Cells)-len(s.End))...)
+	parallelFor(n, workers, func(w int, lo int, hi int) {
+		for i := lo; i < hi; i++ {
+			s.Keys[i] = canonical[buckets[i]%workers][s.Keys[i]]
+		}
+	})
+	parallelFor(len(s.Table), workers, func(w int, lo int, hi int) {
+		for b := lo; b < hi; b++ {
+			for k := range s.Table[b] {
+				s.Table[b][k].Handle = canonical[b%workers][s.Table[b][k].Handle]
+			}
+		}
+	})
+}
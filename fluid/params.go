@@ -0,0 +1,104 @@
+package fluid
+
+import (
+	"fmt"
+	Math "math"
+)
+
+//Parameter derivation for weakly compressible SPH. Mass follows from the particle spacing and rest
+//density, the support radius from the number of neighbors a particle should see, the speed of sound
+//from the expected maximum velocity (Mach 0.1 keeps density fluctuations near 1%) and the time step
+//from the CFL, viscous and body force stability conditions
+
+const CFL_NUMBER = 0.4       //Courant number for the acoustic time step
+const VISCOUS_NUMBER = 0.125 //Stability factor for the viscous time step
+const FORCE_NUMBER = 0.25    //Stability factor for the body force time step
+const MACH_FACTOR = 10.0     //Speed of sound as multiple of the max expected velocity
+const TAIT_EXP = 7.0         //Tait equation of state exponent for water like fluids
+const MIN_NEIGHBORS = 10
+const MAX_NEIGHBORS = 200
+
+//NewMassFluidParticle - Derives a consistent particle description from particle spacing (m), rest
+//density (kg/m^3), target neighbor count, dynamic viscosity (Pa s) and the max expected velocity (m/s)
+func NewMassFluidParticle(spacing float32, restDensity float32, neighbors int, viscosity float32, maxVelocity float32) (*MassFluidParticle, error) {
+	const s = "MassFluidParticle"
+	checks := []error{
+		checkPositive(s, "Spacing", spacing),
+		checkPositive(s, "RestDensity", restDensity),
+		checkNonNegative(s, "Viscosity", viscosity),
+		checkPositive(s, "MaxVelocity", maxVelocity)}
+	if neighbors < MIN_NEIGHBORS || neighbors > MAX_NEIGHBORS {
+		checks = append(checks, &ParameterError{s, "Neighbors", neighbors, fmt.Sprintf("must be within [%d, %d]", MIN_NEIGHBORS, MAX_NEIGHBORS)})
+	}
+	for _, err := range checks {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mass := restDensity * spacing * spacing * spacing
+	radius := SupportRadius(spacing, neighbors)
+	sos := float32(MACH_FACTOR) * maxVelocity
+
+	mfp := &MassFluidParticle{
+		Mass:          mass,
+		Viscosity:     viscosity,
+		InnerRadius:   radius,
+		OuterRadius:   radius,
+		SpeedSound:    sos,
+		TargetDensity: restDensity,
+		EosExp:        TAIT_EXP}
+	mfp.TimeStep = mfp.StableTimeStep(-GRAV)
+	return mfp, nil
+}
+
+//NewBoxMassFluidParticle - Derives the particle description from the cell spacing of a box fluid system,
+//so the particle mass always matches the lattice Initialize creates. Cells must be (near) cubic
+func NewBoxMassFluidParticle(init *BoxFluidSystem, restDensity float32, neighbors int, viscosity float32, maxVelocity float32) (*MassFluidParticle, error) {
+	if err := init.Validate(); err != nil {
+		return nil, err
+	}
+	spacing := init.Spacing()
+	min, max := spacing[0], spacing[0]
+	for _, d := range spacing {
+		min = float32(Math.Min(float64(min), float64(d)))
+		max = float32(Math.Max(float64(max), float64(d)))
+	}
+	if (max-min)/min > 0.01 {
+		return nil, &ParameterError{"BoxFluidSystem", "Spacing", spacing, "cells must be cubic within 1%"}
+	}
+	return NewMassFluidParticle((spacing[0]+spacing[1]+spacing[2])/3, restDensity, neighbors, viscosity, maxVelocity)
+}
+
+//Spacing - Particle spacing along width, height and depth of the box lattice
+func (init *BoxFluidSystem) Spacing() [3]float32 {
+	return [3]float32{
+		init.Width / float32(init.WidthCells),
+		init.Height / float32(init.HeightCells),
+		init.Depth / float32(init.DepthCells)}
+}
+
+//SupportRadius - Kernel support radius so a sphere of that radius holds the target number of particles
+func SupportRadius(spacing float32, neighbors int) float32 {
+	return spacing * float32(Math.Cbrt(3*float64(neighbors)/(4*Math.Pi)))
+}
+
+//StableTimeStep - Minimum of the acoustic CFL, viscous diffusion and body force time step limits of the
+//particle description, gravity is the magnitude of the body acceleration (m/s^2)
+func (mfp *MassFluidParticle) StableTimeStep(gravity float32) float32 {
+	radius := mfp.InnerRadius
+	ts := float32(CFL_NUMBER) * radius / mfp.SpeedSound
+	if mfp.Viscosity > 0 {
+		visc := float32(VISCOUS_NUMBER) * radius * radius * mfp.TargetDensity / mfp.Viscosity
+		if visc < ts {
+			ts = visc
+		}
+	}
+	if gravity > 0 {
+		force := float32(FORCE_NUMBER) * float32(Math.Sqrt(float64(radius/gravity)))
+		if force < ts {
+			ts = force
+		}
+	}
+	return ts
+}
@@ -0,0 +1,68 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"testing"
+)
+
+//Derived particle parameters should be consistent with the particle spacing and rest density
+func TestMassFluidParticle(t *testing.T) {
+	mfp, err := NewMassFluidParticle(0.02, 1000, 30, 1e-3, 2.0)
+	if err != nil {
+		t.Fatalf("Unexpected error %s\n", err.Error())
+	}
+	if !isClose(mfp.Mass, 0.008) {
+		t.Errorf("Mass should be rho * spacing^3, got %f\n", mfp.Mass)
+	}
+	if !isClose(mfp.SpeedSound, 20) {
+		t.Errorf("Speed of sound should be 10x max velocity, got %f\n", mfp.SpeedSound)
+	}
+	if mfp.TimeStep <= 0 || mfp.TimeStep > CFL_NUMBER*mfp.InnerRadius/mfp.SpeedSound {
+		t.Errorf("Time step violates CFL condition %f\n", mfp.TimeStep)
+	}
+	if mfp.InnerRadius <= 0.02 {
+		t.Errorf("Support radius should exceed particle spacing %f\n", mfp.InnerRadius)
+	}
+
+	slow, _ := NewMassFluidParticle(0.02, 1000, 30, 0, 1e-3)
+	if limit := FORCE_NUMBER * float32(Math.Sqrt(float64(slow.InnerRadius/-GRAV))); !isClose(slow.TimeStep, limit) {
+		t.Errorf("Slow fluids should be limited by gravity to %f, got %f\n", limit, slow.TimeStep)
+	}
+	if ts := slow.StableTimeStep(0); ts <= slow.TimeStep {
+		t.Errorf("Time step without body force should only follow the CFL condition, got %f\n", ts)
+	}
+
+	bad := map[string][5]float32{
+		"Spacing":     {0, 1000, 30, 0, 1},
+		"RestDensity": {0.02, -1, 30, 0, 1},
+		"Neighbors":   {0.02, 1000, 2, 0, 1},
+		"Viscosity":   {0.02, 1000, 30, float32(Math.NaN()), 1},
+		"MaxVelocity": {0.02, 1000, 30, 0, float32(Math.Inf(1))}}
+	for field, b := range bad {
+		if _, err := NewMassFluidParticle(b[0], b[1], int(b[2]), b[3], b[4]); err == nil {
+			t.Errorf("Expected error for inconsistent parameters %v\n", b)
+		} else if perr, ok := err.(*ParameterError); !ok || perr.Field != field {
+			t.Errorf("Expected %s parameter error, got %v\n", field, err)
+		}
+	}
+
+	box := BoxFluidSystem{V.Vec32{}, 1, 2, 1, 10, 10, 10}
+	if _, err := NewBoxMassFluidParticle(&box, 1000, 30, 0, 1); err == nil {
+		t.Errorf("Expected error for non uniform box spacing\n")
+	}
+	box = BoxFluidSystem{V.Vec32{}, 1, 1, 1, 10, 0, 10}
+	if _, err := NewBoxMassFluidParticle(&box, 1000, 30, 0, 1); err == nil {
+		t.Errorf("Expected error for a box without cells\n")
+	} else if perr, ok := err.(*ParameterError); !ok || perr.Field != "HeightCells" {
+		t.Errorf("Expected HeightCells parameter error, got %v\n", err)
+	}
+}
+
+func isClose(a float32, b float32) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return d <= 1e-5*(1+b)
+}
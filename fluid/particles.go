@@ -0,0 +1,122 @@
+package fluid
+
+import (
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	"fmt"
+	Math "math"
+)
+
+//InitializeParticles - Initializes the fluid from arbitrary particle positions (scene files, shape fills)
+//instead of a box lattice. The grid covers the particles and the collider mesh. Without colliders the
+//particles are enclosed by a box one kernel radius larger than their bounds. Starting without particles
+//is allowed when colliders size the domain (emitters fill it later). The fluid is left untouched on error
+func (fluid *SPHFluid) InitializeParticles(positions []V.Vec32, colliders *G.Mesh, mpf *MassFluidParticle) error {
+	if mpf == nil {
+		return &ParameterError{"SPHFluid", "InitializeParticles", nil, "particle description is required"}
+	}
+	if len(positions) == 0 && (colliders == nil || len(colliders.Vertexes) == 0) {
+		return &ParameterError{"SPHFluid", "positions", 0, "particles or colliders are required to size the domain"}
+	}
+	if err := mpf.Validate(); err != nil {
+		return err
+	}
+	if err := checkPositions("positions", positions); err != nil {
+		return err
+	}
+
+	var min, max V.Vec32
+	if colliders == nil {
+		min, max = bounds(positions)
+		r := V.Vec32{mpf.InnerRadius, mpf.InnerRadius, mpf.InnerRadius}
+		min.Sub(r)
+		max.Add(r)
+		size := V.Sub(max, min)
+		colliders = G.Box(size[0], size[1], size[2], V.Scale(V.Add(min, max), 0.5))
+	} else {
+		min, _ = bounds(append(append([]V.Vec32(nil), positions...), colliders.Vertexes...))
+	}
+
+	next, err := buildParticles(append([]V.Vec32(nil), positions...), colliders, min, mpf, fluid.Workers)
+	if err != nil {
+		return err
+	}
+	fluid.commit(next)
+	return nil
+}
+
+//AddParticles - Appends particles to a running simulation (emitters, inflow). Velocities may be nil
+//for particles at rest. New particles start at the rest density with zero scalar values. With phase change
+//enabled they start at the ambient temperature and take the phase it implies. Returns the first new index
+func (fluid *SPHFluid) AddParticles(positions []V.Vec32, velocities []V.Vec32) (int, error) {
+	if velocities != nil && len(velocities) != len(positions) {
+		return 0, &ParameterError{"SPHFluid", "velocities", len(velocities), "must match the number of positions"}
+	}
+	if err := checkPositions("positions", positions); err != nil {
+		return 0, err
+	}
+	if err := checkPositions("velocities", velocities); err != nil {
+		return 0, err
+	}
+
+	first := fluid.Count
+	n := len(positions)
+	fluid.Positions = append(fluid.Positions, positions...)
+	if velocities == nil {
+		velocities = make([]V.Vec32, n)
+	}
+	fluid.Velocities = append(fluid.Velocities, velocities...)
+	fluid.Forces = append(fluid.Forces, make([]V.Vec32, n)...)
+	fluid.Pressures = append(fluid.Pressures, make([]float32, n)...)
+	for i := 0; i < n; i++ {
+		fluid.Densities = append(fluid.Densities, fluid.Mfp.TargetDensity)
+	}
+	if fluid.Phases != nil && len(fluid.Phases) == first {
+		fluid.Phases = append(fluid.Phases, make([]Phase, n)...)
+	}
+	if fluid.Granular != nil {
+		fluid.Stresses = append(fluid.Stresses, make([]V.Mat3, n)...)
+	}
+	for _, field := range fluid.Scalars {
+		field.Values = append(field.Values, make([]float32, n)...)
+	}
+	fluid.Count += n
+	fluid.assignIDs()
+
+	if fluid.Thermal != nil {
+		fluid.Temperatures = append(fluid.Temperatures, make([]float32, n)...)
+		fluid.Latent = append(fluid.Latent, make([]float32, n)...)
+		for i := first; i < fluid.Count; i++ {
+			fluid.SetTemperature(i, fluid.Thermal.Ambient)
+		}
+	}
+
+	if err := fluid.SPHGrid.Update(fluid.Positions); err != nil {
+		return first, &GridError{err.Error()}
+	}
+	return first, nil
+}
+
+//checkPositions - Every component must be finite
+func checkPositions(field string, positions []V.Vec32) error {
+	for i, p := range positions {
+		for k := 0; k < 3; k++ {
+			if !isFinite(p[k]) {
+				return &ParameterError{"SPHFluid", fmt.Sprintf("%s[%d]", field, i), p, "must be finite"}
+			}
+		}
+	}
+	return nil
+}
+
+//bounds - Axis aligned bounding box of a point set
+func bounds(points []V.Vec32) (V.Vec32, V.Vec32) {
+	min, max := points[0], points[0]
+	for _, p := range points {
+		for k := 0; k < 3; k++ {
+			min[k] = float32(Math.Min(float64(min[k]), float64(p[k])))
+			max[k] = float32(Math.Max(float64(max[k]), float64(p[k])))
+		}
+	}
+	return min, max
+}
@@ -0,0 +1,280 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+)
+
+//Phase - Material state of a single particle. Fluid particles take part in the full
+//SPH force loop, solid particles still contribute density but are advanced by SolidMotion.
+//Granular particles keep their phase regardless of temperature
+type Phase int
+
+const (
+	PhaseFluid Phase = iota
+	PhaseSolid
+	PhaseGranular
+)
+
+//SolidMotion - Determines how solidified particles are advanced each step
+type SolidMotion int
+
+const (
+	SolidFixed SolidMotion = iota //Solid particles are pinned in place (i.e. cooled lava crust)
+	SolidRigid                    //Connected solid regions move as rigid bodies (i.e. floating wax)
+)
+
+//PhaseChange - Thermal description of the fluid material used for melting and solidification.
+//Temperatures are Kelvin, heat quantities are per unit mass (J/kg). Latent heat is stored per particle
+//so a particle sits at the melting point until the full latent heat has been exchanged
+type PhaseChange struct {
+	MeltingPoint   float32     //Melting / freezing temperature
+	LatentHeat     float32     //Latent heat of fusion
+	SpecificHeat   float32     //Specific heat capacity
+	Diffusivity    float32     //Thermal diffusivity for particle - particle heat exchange
+	Ambient        float32     //Ambient temperature for newtonian cooling
+	CoolingRate    float32     //Newtonian cooling coefficient (1/s), 0 disables cooling
+	ViscosityBand  float32     //Temperature band above the melting point where viscosity ramps up
+	ViscosityScale float32     //Viscosity multiplier reached at the melting point
+	Motion         SolidMotion //Solid particle motion model
+}
+
+//EnablePhaseChange - Allocates per particle temperature, latent heat and phase buffers and sets every
+//particle to the given temperature. Particles at or above the melting point start as fluid
+func (fluid *SPHFluid) EnablePhaseChange(pc *PhaseChange, temperature float32) error {
+	if pc == nil {
+		return &ParameterError{"SPHFluid", "Thermal", nil, "phase change description is required"}
+	}
+	if err := pc.Validate(); err != nil {
+		return err
+	}
+	if !isFinite(temperature) || temperature < 0 {
+		return &ParameterError{"SPHFluid", "temperature", temperature, "must be a finite absolute temperature"}
+	}
+	fluid.Thermal = pc
+	fluid.Temperatures = make([]float32, fluid.Count)
+	fluid.Latent = make([]float32, fluid.Count)
+	fluid.ensurePhases()
+	for i := 0; i < fluid.Count; i++ {
+		fluid.SetTemperature(i, temperature)
+	}
+	return nil
+}
+
+//Validate - Checks the thermal material description
+func (pc *PhaseChange) Validate() error {
+	const s = "PhaseChange"
+	checks := []error{
+		checkPositive(s, "MeltingPoint", pc.MeltingPoint),
+		checkNonNegative(s, "LatentHeat", pc.LatentHeat),
+		checkPositive(s, "SpecificHeat", pc.SpecificHeat),
+		checkNonNegative(s, "Diffusivity", pc.Diffusivity),
+		checkNonNegative(s, "Ambient", pc.Ambient),
+		checkNonNegative(s, "CoolingRate", pc.CoolingRate),
+		checkNonNegative(s, "ViscosityBand", pc.ViscosityBand),
+		checkNonNegative(s, "ViscosityScale", pc.ViscosityScale)}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	if pc.Motion != SolidFixed && pc.Motion != SolidRigid {
+		return &ParameterError{s, "Motion", pc.Motion, "unknown solid motion model"}
+	}
+	return nil
+}
+
+//ensurePhases - Allocates the per particle phase buffer shared by phase change and granular materials
+func (fluid *SPHFluid) ensurePhases() {
+	if len(fluid.Phases) != fluid.Count {
+		fluid.Phases = make([]Phase, fluid.Count)
+	}
+}
+
+//SetTemperature - Sets particle temperature and resets its latent heat and phase consistently
+func (fluid *SPHFluid) SetTemperature(i int, temperature float32) {
+	pc := fluid.Thermal
+	fluid.Temperatures[i] = temperature
+	if temperature >= pc.MeltingPoint {
+		fluid.Latent[i] = pc.LatentHeat
+		fluid.setThermalPhase(i, PhaseFluid)
+	} else {
+		fluid.Latent[i] = 0
+		fluid.setThermalPhase(i, PhaseSolid)
+	}
+}
+
+//setThermalPhase - Phase change never converts granular particles
+func (fluid *SPHFluid) setThermalPhase(i int, phase Phase) {
+	if fluid.Phases[i] != PhaseGranular {
+		fluid.Phases[i] = phase
+	}
+}
+
+//IsSolid - True when phase change is enabled and the particle is solid
+func (fluid *SPHFluid) IsSolid(i int) bool {
+	return fluid.Thermal != nil && fluid.Phases[i] == PhaseSolid
+}
+
+//ViscosityFactor - Multiplier applied to the fluid viscosity. Rises exponentially towards
+//ViscosityScale as the particle temperature approaches the melting point
+func (fluid *SPHFluid) ViscosityFactor(i int) float32 {
+	pc := fluid.Thermal
+	if pc == nil || pc.ViscosityScale <= 1 || pc.ViscosityBand <= 0 {
+		return 1.0
+	}
+	dt := fluid.Temperatures[i] - pc.MeltingPoint
+	if dt < 0 {
+		dt = 0
+	}
+	ramp := float32(Math.Exp(float64(-dt / pc.ViscosityBand)))
+	return 1.0 + (pc.ViscosityScale-1.0)*ramp
+}
+
+//UpdateTemperatures - Exchanges heat between neighboring particles with the SPH Laplacian,
+//applies newtonian cooling and resolves melting / solidification through the latent heat buffer
+func (fluid *SPHFluid) UpdateTemperatures() {
+	pc := fluid.Thermal
+	if pc == nil {
+		return
+	}
+	dt := fluid.Timer.TS
+	heat := make([]float32, fluid.Count)
+
+	for i := 0; i < fluid.Count; i++ {
+		dT := pc.Diffusivity * fluid.ScalarLaplacian(i, fluid.Temperatures)
+		dT -= pc.CoolingRate * (fluid.Temperatures[i] - pc.Ambient)
+		heat[i] = dT * pc.SpecificHeat * dt
+	}
+
+	for i := 0; i < fluid.Count; i++ {
+		fluid.exchangeHeat(i, heat[i])
+	}
+}
+
+//exchangeHeat - Adds heat (J/kg) to a particle. Enthalpy between the solidus and liquidus is held
+//as latent heat at the melting point; the particle phase only flips once it is fully frozen or melted
+func (fluid *SPHFluid) exchangeHeat(i int, heat float32) {
+	pc := fluid.Thermal
+	c := pc.SpecificHeat
+	solidus := c * pc.MeltingPoint
+	liquidus := solidus + pc.LatentHeat
+
+	enthalpy := c*fluid.Temperatures[i] + fluid.Latent[i] + heat
+
+	switch {
+	case enthalpy <= solidus:
+		fluid.Temperatures[i] = enthalpy / c
+		fluid.Latent[i] = 0
+		fluid.setThermalPhase(i, PhaseSolid)
+	case enthalpy >= liquidus:
+		fluid.Temperatures[i] = (enthalpy - pc.LatentHeat) / c
+		fluid.Latent[i] = pc.LatentHeat
+		fluid.setThermalPhase(i, PhaseFluid)
+	default:
+		fluid.Temperatures[i] = pc.MeltingPoint
+		fluid.Latent[i] = enthalpy - solidus
+	}
+}
+
+//UpdateSolids - Advances solid particles according to the SolidMotion model. Fixed solids are
+//pinned, every connected region of rigid solids keeps its linear and angular momentum as one rigid body
+func (fluid *SPHFluid) UpdateSolids() {
+	if fluid.Thermal == nil {
+		return
+	}
+	if fluid.Thermal.Motion == SolidFixed {
+		for i := 0; i < fluid.Count; i++ {
+			if fluid.Phases[i] == PhaseSolid {
+				fluid.Velocities[i].Clear()
+			}
+		}
+		return
+	}
+
+	for _, body := range fluid.solidBodies() {
+		fluid.moveRigid(body)
+	}
+}
+
+//solidBodies - Connected regions of solid particles, solid particles within the kernel radius of each
+//other belong to the same body
+func (fluid *SPHFluid) solidBodies() [][]int {
+	root := make([]int, fluid.Count)
+	for i := range root {
+		root[i] = i
+	}
+	find := func(i int) int {
+		for root[i] != i {
+			root[i] = root[root[i]]
+			i = root[i]
+		}
+		return i
+	}
+	nl := fluid.neighborList()
+	for i := 0; i < fluid.Count; i++ {
+		if fluid.Phases[i] != PhaseSolid {
+			continue
+		}
+		start, end := nl.Range(i)
+		for n := start; n < end; n++ {
+			if j := nl.Indices[n]; fluid.Phases[j] == PhaseSolid {
+				root[find(i)] = find(j)
+			}
+		}
+	}
+
+	bodies := [][]int{}
+	index := map[int]int{}
+	for i := 0; i < fluid.Count; i++ {
+		if fluid.Phases[i] != PhaseSolid {
+			continue
+		}
+		r := find(i)
+		b, ok := index[r]
+		if !ok {
+			b = len(bodies)
+			index[r] = b
+			bodies = append(bodies, nil)
+		}
+		bodies[b] = append(bodies[b], i)
+	}
+	return bodies
+}
+
+//moveRigid - Replaces the velocities of the body particles by the rigid motion with the same linear and
+//angular momentum and advances the body by it. Particles share one mass so it drops out of the momenta
+func (fluid *SPHFluid) moveRigid(body []int) {
+	count := float32(len(body))
+	center, velocity := V.Vec32{}, V.Vec32{}
+	for _, i := range body {
+		center.Add(fluid.Positions[i])
+		velocity.Add(fluid.Velocities[i])
+	}
+	center.Scale(1 / count)
+	velocity.Scale(1 / count)
+
+	momentum := V.Vec32{}
+	inertia := V.Mat3{}
+	for _, i := range body {
+		r := V.Sub(fluid.Positions[i], center)
+		momentum.Add(V.Cross(r, V.Sub(fluid.Velocities[i], velocity)))
+		inertia = mat3Add(inertia, mat3Add(mat3Scale(mat3Identity(), V.Dot(r, r)), mat3Scale(mat3Outer(r, r), -1)))
+	}
+	omega := V.Vec32{}
+	if trace := mat3Trace(inertia); trace > 0 {
+		//Bodies in a line have no inertia about it, a small isotropic part keeps the tensor invertible
+		if inv, ok := mat3Inverse(mat3Add(inertia, mat3Scale(mat3Identity(), 1e-4*trace))); ok {
+			omega = mat3MulVec(inv, momentum)
+		}
+	}
+
+	dt := fluid.Timer.TS
+	R := mat3AxisAngle(omega, V.Length(omega)*dt)
+	next := V.Add(center, V.Scale(velocity, dt))
+	for _, i := range body {
+		r := mat3MulVec(R, V.Sub(fluid.Positions[i], center))
+		fluid.Positions[i] = V.Add(next, r)
+		fluid.Velocities[i] = V.Add(velocity, V.Cross(omega, r))
+	}
+}
@@ -0,0 +1,141 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"testing"
+)
+
+//Heated solid particles hold at the melting point until the latent heat is absorbed, then melt
+func TestLatentHeat(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 2, 2, 2})
+	pc := &PhaseChange{MeltingPoint: 300, LatentHeat: 1000, SpecificHeat: 100, Ambient: 400, CoolingRate: 1}
+	if err := fluid.EnablePhaseChange(pc, 290); err != nil {
+		t.Fatalf("Failed to enable phase change: %s\n", err.Error())
+	}
+	fluid.Timer.TS = 0.01
+
+	absorbing := false
+	for step := 0; step < 1000 && fluid.Phases[0] == PhaseSolid; step++ {
+		fluid.UpdateTemperatures()
+		T, latent := fluid.Temperatures[0], fluid.Latent[0]
+		if fluid.Phases[0] != PhaseSolid {
+			break
+		}
+		if T > pc.MeltingPoint {
+			t.Fatalf("Solid particle heated past the melting point %f before melting\n", T)
+		}
+		if latent > 0 {
+			absorbing = true
+			if T != pc.MeltingPoint || latent >= pc.LatentHeat {
+				t.Fatalf("Particle absorbing latent heat should stay at the melting point, T %f latent %f\n", T, latent)
+			}
+		}
+	}
+	if !absorbing || fluid.Phases[0] != PhaseFluid || fluid.Latent[0] != pc.LatentHeat {
+		t.Fatalf("Particle should melt after absorbing the latent heat, phase %d latent %f\n", fluid.Phases[0], fluid.Latent[0])
+	}
+	fluid.UpdateTemperatures()
+	if fluid.Temperatures[0] <= pc.MeltingPoint {
+		t.Errorf("Melted particle should heat up again, T %f\n", fluid.Temperatures[0])
+	}
+
+	//Cooling releases the latent heat before freezing
+	fluid.exchangeHeat(1, -pc.SpecificHeat*(fluid.Temperatures[1]-pc.MeltingPoint)-pc.LatentHeat/2)
+	if fluid.Phases[1] != PhaseFluid || fluid.Temperatures[1] != pc.MeltingPoint || !isClose(fluid.Latent[1], pc.LatentHeat/2) {
+		t.Errorf("Half frozen particle should stay fluid at the melting point\n")
+	}
+	fluid.exchangeHeat(1, -pc.LatentHeat)
+	if fluid.Phases[1] != PhaseSolid || fluid.Latent[1] != 0 || !isClose(fluid.Temperatures[1], pc.MeltingPoint-pc.LatentHeat/2/pc.SpecificHeat) {
+		t.Errorf("Particle should freeze once the latent heat is released, T %f\n", fluid.Temperatures[1])
+	}
+}
+
+//Viscosity ramps towards the solid, fixed solids are pinned and rigid solids share their mean velocity
+func TestSolidParticles(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 2, 2, 2})
+	pc := &PhaseChange{MeltingPoint: 300, SpecificHeat: 100, ViscosityBand: 10, ViscosityScale: 50}
+	if err := fluid.EnablePhaseChange(pc, 400); err != nil {
+		t.Fatalf("Failed to enable phase change: %s\n", err.Error())
+	}
+	fluid.SetTemperature(0, 250)
+	fluid.SetTemperature(1, 250)
+	fluid.SetTemperature(2, 300)
+	if !fluid.IsSolid(0) || !fluid.IsSolid(1) || fluid.IsSolid(2) || fluid.IsSolid(3) {
+		t.Fatalf("Particles below the melting point should be solid\n")
+	}
+	if fluid.ViscosityFactor(0) != 50 || fluid.ViscosityFactor(2) != 50 {
+		t.Errorf("Viscosity should reach its scale at and below the melting point, got %f %f\n", fluid.ViscosityFactor(0), fluid.ViscosityFactor(2))
+	}
+	if f := fluid.ViscosityFactor(3); f < 1 || f > 1.01 {
+		t.Errorf("Hot fluid should keep its viscosity, factor %f\n", f)
+	}
+
+	velocities := []V.Vec32{{1, 0, 0}, {3, 0, 0}, {0, 2, 0}}
+	for i, v := range velocities {
+		fluid.Velocities[i] = v
+	}
+	fluid.UpdateSolids()
+	if fluid.Velocities[0] != (V.Vec32{}) || fluid.Velocities[1] != (V.Vec32{}) || fluid.Velocities[2] != velocities[2] {
+		t.Errorf("Fixed solids should be pinned and fluid particles left alone\n")
+	}
+}
+
+//bodyMomenta - Linear and angular momentum per unit mass of the particles about the origin
+func bodyMomenta(fluid *SPHFluid, body []int) (V.Vec32, V.Vec32) {
+	linear, angular := V.Vec32{}, V.Vec32{}
+	for _, i := range body {
+		linear.Add(fluid.Velocities[i])
+		angular.Add(V.Cross(fluid.Positions[i], fluid.Velocities[i]))
+	}
+	return linear, angular
+}
+
+//Every connected solid region moves as its own rigid body with the linear and angular momentum of its
+//particles and keeps its shape
+func TestRigidBodies(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.8, 0.1, 0.1, 8, 1, 1})
+	pc := &PhaseChange{MeltingPoint: 300, SpecificHeat: 100, Motion: SolidRigid}
+	if err := fluid.EnablePhaseChange(pc, 400); err != nil {
+		t.Fatalf("Failed to enable phase change: %s\n", err.Error())
+	}
+	sliding, spinning := []int{0, 1}, []int{4, 5, 6}
+	for _, i := range append(sliding, spinning...) {
+		fluid.SetTemperature(i, 250)
+	}
+	if bodies := fluid.solidBodies(); len(bodies) != 2 || len(bodies[0]) != 2 || len(bodies[1]) != 3 {
+		t.Fatalf("Expected two separate solid bodies, got %v\n", bodies)
+	}
+
+	velocities := map[int]V.Vec32{0: {1, 0, 0}, 1: {3, 0, 0}, 4: {0, -1, 0}, 5: {0.5, 0, 0}, 6: {0, 1, 0}, 2: {0, 2, 0}}
+	for i, v := range velocities {
+		fluid.Velocities[i] = v
+	}
+	slideLinear, _ := bodyMomenta(fluid, sliding)
+	spinLinear, spinAngular := bodyMomenta(fluid, spinning)
+	p0, p1, p2 := fluid.Positions[0], fluid.Positions[1], fluid.Positions[2]
+	gap := fluid.Positions[6].Distance(fluid.Positions[4])
+	fluid.Timer.TS = 0.01
+	fluid.UpdateSolids()
+
+	if fluid.Velocities[0] != (V.Vec32{2, 0, 0}) || fluid.Velocities[1] != (V.Vec32{2, 0, 0}) || fluid.Velocities[2] != velocities[2] {
+		t.Errorf("Sliding body should share its mean velocity, got %v %v\n", fluid.Velocities[0], fluid.Velocities[1])
+	}
+	if !isClose(fluid.Positions[0][0]-p0[0], 0.02) || !isClose(fluid.Positions[1][0]-p1[0], 0.02) || fluid.Positions[2] != p2 {
+		t.Errorf("Sliding body should move with its mean velocity\n")
+	}
+
+	linear, angular := bodyMomenta(fluid, spinning)
+	if V.Length(V.Sub(linear, spinLinear)) > 1e-5 || V.Length(V.Sub(angular, spinAngular)) > 1e-4 {
+		t.Errorf("Spinning body should keep its momenta, linear %v -> %v angular %v -> %v\n", spinLinear, linear, spinAngular, angular)
+	}
+	if linear, _ := bodyMomenta(fluid, sliding); linear != slideLinear {
+		t.Errorf("Sliding body should keep its momentum, %v -> %v\n", slideLinear, linear)
+	}
+	if omega := V.Length(V.Sub(fluid.Velocities[6], fluid.Velocities[5])) / fluid.Positions[6].Distance(fluid.Positions[5]); Math.Abs(float64(omega-10)) > 1e-2 {
+		t.Errorf("Spinning body should turn at 10 rad/s, got %f\n", omega)
+	}
+	if d := fluid.Positions[6].Distance(fluid.Positions[4]); !isClose(d, gap) {
+		t.Errorf("Spinning body should keep its shape, extent %f -> %f\n", gap, d)
+	}
+}
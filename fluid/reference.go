@@ -0,0 +1,127 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	"fmt"
+)
+
+//Reference neighbor search. Every query tests every particle, which is too slow for simulation but
+//trivially exact, so any other backend can be checked against it on a given particle set
+
+//BruteForce - O(n) per query reference search over the positions of the last Build
+type BruteForce struct {
+	Positions []V.Vec32
+}
+
+//Build - Keeps the positions, there is no index to build
+func (b *BruteForce) Build(positions []V.Vec32) error {
+	b.Positions = positions
+	return nil
+}
+
+//QueryAppend - Appends all particles within radius of the position (inclusive) in index order
+func (b *BruteForce) QueryAppend(found []Neighbor, position V.Vec32, radius float32) []Neighbor {
+	for idx := range b.Positions {
+		if dist := position.Distance(b.Positions[idx]); dist <= radius {
+			found = append(found, Neighbor{idx, dist})
+		}
+	}
+	return found
+}
+
+//Nearest - The k nearest particles
+func (b *BruteForce) Nearest(position V.Vec32, k int) []Neighbor {
+	if k <= 0 {
+		return nil
+	}
+	heap := knnHeap{k: k}
+	for idx := range b.Positions {
+		heap.push(Neighbor{idx, position.Distance(b.Positions[idx])})
+	}
+	return heap.sorted()
+}
+
+//SearchMismatch - Neighbor Index of the particle Query that a search got wrong, Distance is the true one
+type SearchMismatch struct {
+	Query    int
+	Index    int
+	Distance float32
+}
+
+//SearchReport - Differences of a neighbor search to the reference search
+type SearchReport struct {
+	Queries   int
+	Neighbors int              //Pairs found by the reference search, the particles themselves included
+	Missing   []SearchMismatch //Within the radius but not returned
+	Spurious  []SearchMismatch //Returned but outside the radius, or returned more than once
+	Distances []SearchMismatch //Returned with a wrong distance
+}
+
+//Exact - The search returned exactly the reference neighbors
+func (r *SearchReport) Exact() bool {
+	return len(r.Missing) == 0 && len(r.Spurious) == 0 && len(r.Distances) == 0
+}
+
+func (r *SearchReport) String() string {
+	s := fmt.Sprintf("%d queries, %d neighbors: %d missing, %d spurious, %d wrong distances", r.Queries, r.Neighbors, len(r.Missing), len(r.Spurious), len(r.Distances))
+	if m := r.first(); m != nil {
+		s += fmt.Sprintf(" (first: particle %d neighbor %d at %g)", m.Query, m.Index, m.Distance)
+	}
+	return s
+}
+
+func (r *SearchReport) first() *SearchMismatch {
+	for _, list := range [][]SearchMismatch{r.Missing, r.Spurious, r.Distances} {
+		if len(list) > 0 {
+			return &list[0]
+		}
+	}
+	return nil
+}
+
+//CheckNeighborSearch - Builds the search over the positions and compares the radius query of every
+//particle with the reference search
+func CheckNeighborSearch(search NeighborSearch, positions []V.Vec32, radius float32) (*SearchReport, error) {
+	if !isFinite(radius) || radius < 0 {
+		return nil, &ParameterError{"CheckNeighborSearch", "radius", radius, "must not be negative"}
+	}
+	if err := search.Build(positions); err != nil {
+		return nil, err
+	}
+	ref := &BruteForce{positions}
+	report := &SearchReport{Queries: len(positions)}
+	var found, want []Neighbor
+	seen := make([]int, len(positions)) //Query index + 1 of the last query that returned the particle
+	for i, p := range positions {
+		found = search.QueryAppend(found[:0], p, radius)
+		want = ref.QueryAppend(want[:0], p, radius)
+		report.Neighbors += len(want)
+		for _, n := range found {
+			if n.Index < 0 || n.Index >= len(positions) {
+				report.Spurious = append(report.Spurious, SearchMismatch{i, n.Index, n.Distance})
+				continue
+			}
+			dist := p.Distance(positions[n.Index])
+			if seen[n.Index] == i+1 || !(dist <= radius) {
+				report.Spurious = append(report.Spurious, SearchMismatch{i, n.Index, dist})
+				continue
+			}
+			seen[n.Index] = i + 1
+			if n.Distance != dist {
+				report.Distances = append(report.Distances, SearchMismatch{i, n.Index, dist})
+			}
+		}
+		for _, n := range want {
+			if seen[n.Index] != i+1 {
+				report.Missing = append(report.Missing, SearchMismatch{i, n.Index, n.Distance})
+			}
+		}
+	}
+	return report, nil
+}
+
+//CheckNeighbors - Compares the neighbor search of the fluid at the kernel radius with the reference
+//search, the search is rebuilt over the current positions
+func (fluid *SPHFluid) CheckNeighbors() (*SearchReport, error) {
+	return CheckNeighborSearch(fluid.neighborSearch(), fluid.Positions[:fluid.Count], fluid.Mfp.InnerRadius)
+}
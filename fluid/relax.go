@@ -0,0 +1,125 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+)
+
+//Initial relaxation. Particles placed on lattices or by sampling do not sit at the rest density, the
+//first EOS pressures then push them apart in one violent step. Relax moves the particles (without time
+//integration) until the density constraint C_i = rho_i / rho_0 - 1 is met, using position based density
+//corrections (Macklin & Mueller, Position Based Fluids 2013)
+
+const RELAX_EPSILON = 0.1     //Constraint force mixing in 1 / spacing^2, softens corrections of sparse particles
+const RELAX_MAX_SHIFT = 0.1   //Largest move per iteration in particle spacings
+const RELAX_MIN_NEIGHBORS = 4 //Particles with fewer neighbors are treated as free surface and not pulled in
+
+//RelaxResult - Density error after relaxation
+type RelaxResult struct {
+	Iterations int
+	RMSError   float32 //Root mean square of rho / rho_0 - 1
+	MaxError   float32 //Largest |rho / rho_0 - 1|
+}
+
+//Relax - Iterates particle positions towards uniform rest density before the simulation starts. Stops
+//after iterations or once the RMS density error drops below tolerance. Particles that would leave the
+//constraint volume (nil for none) stay in place. Velocities are not modified, the grid and densities are
+//updated for the relaxed positions
+func (fluid *SPHFluid) Relax(iterations int, tolerance float32, constraint Volume) (RelaxResult, error) {
+	if iterations < 0 {
+		return RelaxResult{}, &ParameterError{"Relax", "iterations", iterations, "must not be negative"}
+	}
+	if err := checkNonNegative("Relax", "tolerance", tolerance); err != nil {
+		return RelaxResult{}, err
+	}
+	rho0 := fluid.Mfp.TargetDensity
+	mass := fluid.Mfp.Mass
+	spacing := float32(Math.Cbrt(float64(mass / rho0)))
+	maxShift := float32(RELAX_MAX_SHIFT) * spacing
+	lambda := make([]float32, fluid.Count)
+	shift := make([]V.Vec32, fluid.Count)
+
+	fluid.UpdateNeighbors()
+	fluid.UpdateDensities()
+	result := fluid.densityError()
+	for result.Iterations < iterations && result.RMSError > tolerance {
+		//Constraint multipliers
+		for i := 0; i < fluid.Count; i++ {
+			c := fluid.Densities[i]/rho0 - 1
+			sum, grad, n := fluid.relaxGradients(i, func(j int, g V.Vec32) {})
+			if n < RELAX_MIN_NEIGHBORS && c < 0 {
+				c = 0
+			}
+			sum += V.Dot(grad, grad)
+			lambda[i] = -c / (sum + RELAX_EPSILON/(spacing*spacing))
+		}
+		//Position corrections
+		for i := 0; i < fluid.Count; i++ {
+			dp := V.Vec32{}
+			fluid.relaxGradients(i, func(j int, g V.Vec32) {
+				dp.Add(V.Scale(g, (lambda[i]+lambda[j])*mass/rho0))
+			})
+			if l := V.Length(dp); l > maxShift {
+				dp = V.Scale(dp, maxShift/l)
+			}
+			shift[i] = dp
+		}
+		for i := 0; i < fluid.Count; i++ {
+			p := V.Add(fluid.Positions[i], shift[i])
+			if isFinite(p[0]) && isFinite(p[1]) && isFinite(p[2]) && (constraint == nil || constraint.Contains(p)) {
+				fluid.Positions[i] = p
+			}
+		}
+		if err := fluid.SPHGrid.Update(fluid.Positions); err != nil {
+			return result, &GridError{err.Error()}
+		}
+		fluid.UpdateNeighbors()
+		fluid.UpdateDensities()
+		iteration := result.Iterations + 1
+		result = fluid.densityError()
+		result.Iterations = iteration
+	}
+	return result, nil
+}
+
+//relaxGradients - Calls f with every neighbor j of the neighbor lists and the gradient m / rho_0 * grad_i W_ij
+//of the interpolation kernel. Returns the sum of squared neighbor gradients, their sum and the neighbor count
+func (fluid *SPHFluid) relaxGradients(i int, f func(j int, g V.Vec32)) (float32, V.Vec32, int) {
+	nl := fluid.neighborList()
+	scale := fluid.Mfp.Mass / fluid.Mfp.TargetDensity
+	sum := float32(0)
+	grad := V.Vec32{}
+	n := 0
+	start, end := nl.Range(i)
+	for s := start; s < end; s++ {
+		j := nl.Indices[s]
+		dist := nl.Distances[s]
+		if dist == 0 {
+			continue
+		}
+		dir := nl.Directions[s]
+		g := fluid.ItrpKernel.Grad(dist, &dir)
+		f(j, g)
+		g = V.Scale(g, scale)
+		sum += V.Dot(g, g)
+		grad.Add(g)
+		n++
+	}
+	return sum, grad, n
+}
+
+//densityError - RMS and max relative deviation from the rest density
+func (fluid *SPHFluid) densityError() RelaxResult {
+	r := RelaxResult{}
+	if fluid.Count == 0 {
+		return r
+	}
+	sum := 0.0
+	for i := 0; i < fluid.Count; i++ {
+		e := float64(fluid.Densities[i]/fluid.Mfp.TargetDensity - 1)
+		sum += e * e
+		r.MaxError = float32(Math.Max(float64(r.MaxError), Math.Abs(e)))
+	}
+	r.RMSError = float32(Math.Sqrt(sum / float64(fluid.Count)))
+	return r
+}
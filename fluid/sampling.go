@@ -0,0 +1,180 @@
+package fluid
+
+import (
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"math/rand"
+)
+
+//Blue noise particle sampling. Poisson disk samples keep a minimum distance between all particles but
+//have no preferred directions, which avoids the grid artifacts and anisotropic pressure of lattices.
+//Volumes are sampled with Bridson's algorithm (Fast Poisson Disk Sampling, 2007), surfaces by sample
+//elimination from a dense random pool
+
+const POISSON_CANDIDATES = 30 //Candidates tried around every active sample
+//POISSON_PACKING - Number density of maximal Poisson disk samples relative to 1 / r^3, measured for
+//Bridson sampling in 3D. PoissonSpacing uses it to match a lattice of the same particle count
+const POISSON_PACKING = 0.58
+
+//poissonGrid - Background grid of cell size r / sqrt(3) so every cell holds at most one sample
+type poissonGrid struct {
+	cell   float32
+	radius float32
+	cells  map[[3]int32][]int
+	points []V.Vec32
+}
+
+func newPoissonGrid(radius float32) *poissonGrid {
+	return &poissonGrid{radius / float32(Math.Sqrt(3)), radius, map[[3]int32][]int{}, nil}
+}
+
+func (g *poissonGrid) key(p V.Vec32) [3]int32 {
+	return [3]int32{int32(Math.Floor(float64(p[0] / g.cell))), int32(Math.Floor(float64(p[1] / g.cell))), int32(Math.Floor(float64(p[2] / g.cell)))}
+}
+
+//free - No sample closer than the radius
+func (g *poissonGrid) free(p V.Vec32) bool {
+	k := g.key(p)
+	const reach = 2 //radius spans ceil(sqrt(3)) cells
+	for i := k[0] - reach; i <= k[0]+reach; i++ {
+		for j := k[1] - reach; j <= k[1]+reach; j++ {
+			for l := k[2] - reach; l <= k[2]+reach; l++ {
+				for _, idx := range g.cells[[3]int32{i, j, l}] {
+					if p.Distance(g.points[idx]) < g.radius {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (g *poissonGrid) insert(p V.Vec32) int {
+	k := g.key(p)
+	g.points = append(g.points, p)
+	g.cells[k] = append(g.cells[k], len(g.points)-1)
+	return len(g.points) - 1
+}
+
+//PoissonSpacing - Poisson disk radius giving the same number density as a lattice of the given spacing
+func PoissonSpacing(spacing float32) float32 {
+	return spacing * float32(Math.Cbrt(POISSON_PACKING))
+}
+
+//PoissonDisk - Samples the volume with a minimum distance radius between samples. Seeds are taken from a
+//coarse lattice so disconnected parts of the volume are filled as well. Deterministic for a seed
+func PoissonDisk(v Volume, radius float32, seed int64) ([]V.Vec32, error) {
+	if err := checkPositive("PoissonDisk", "radius", radius); err != nil {
+		return nil, err
+	}
+	min, max := v.Bounds()
+	cells := 1.0
+	for k := 0; k < 3; k++ {
+		if !isFinite(max[k]-min[k]) || max[k] < min[k] {
+			return nil, &ParameterError{"PoissonDisk", "bounds", [2]V.Vec32{min, max}, "volume bounds must be finite"}
+		}
+		cells *= float64((max[k]-min[k])/radius) + 1
+	}
+	if cells > 1<<26 {
+		return nil, &ParameterError{"PoissonDisk", "radius", radius, "too many samples for the volume bounds"}
+	}
+
+	rnd := rand.New(rand.NewSource(seed))
+	g := newPoissonGrid(radius)
+	inside := func(p V.Vec32) bool {
+		for k := 0; k < 3; k++ {
+			if p[k] < min[k] || p[k] > max[k] {
+				return false
+			}
+		}
+		return v.Contains(p)
+	}
+
+	//Seeds on a lattice of 2r, the active list grows from each free seed
+	seeds, _ := FillVolume(v, 2*radius, 0, 0)
+	var active []int
+	for _, s := range seeds {
+		if !g.free(s) {
+			continue
+		}
+		active = append(active, g.insert(s))
+		for len(active) > 0 {
+			a := rnd.Intn(len(active))
+			center := g.points[active[a]]
+			found := false
+			for c := 0; c < POISSON_CANDIDATES; c++ {
+				p := V.Add(center, randomShell(rnd, radius, 2*radius))
+				if inside(p) && g.free(p) {
+					active = append(active, g.insert(p))
+					found = true
+					break
+				}
+			}
+			if !found {
+				active[a] = active[len(active)-1]
+				active = active[:len(active)-1]
+			}
+		}
+	}
+	return g.points, nil
+}
+
+//randomShell - Uniformly distributed offset in the spherical shell [r0, r1]
+func randomShell(rnd *rand.Rand, r0 float32, r1 float32) V.Vec32 {
+	z := 2*rnd.Float64() - 1
+	phi := 2 * Math.Pi * rnd.Float64()
+	s := Math.Sqrt(1 - z*z)
+	a, b := float64(r0*r0*r0), float64(r1*r1*r1)
+	r := float32(Math.Cbrt(a + rnd.Float64()*(b-a)))
+	return V.Vec32{r * float32(s*Math.Cos(phi)), r * float32(s*Math.Sin(phi)), r * float32(z)}
+}
+
+//PoissonSurface - Samples the triangles of a mesh with a minimum distance radius between samples. A random
+//pool of area weighted surface points is thinned greedily, surface particles for boundaries and emitters
+func PoissonSurface(mesh *G.Mesh, radius float32, seed int64) ([]V.Vec32, error) {
+	if err := checkPositive("PoissonSurface", "radius", radius); err != nil {
+		return nil, err
+	}
+	if mesh == nil || len(mesh.Vertexes) < 3 {
+		return nil, &ParameterError{"PoissonSurface", "mesh", nil, "mesh has no triangles"}
+	}
+	tris := len(mesh.Vertexes) / 3
+	area := make([]float64, tris) //Cumulative triangle areas
+	total := 0.0
+	for t := 0; t < tris; t++ {
+		a, b, c := mesh.Vertexes[3*t], mesh.Vertexes[3*t+1], mesh.Vertexes[3*t+2]
+		total += 0.5 * float64(V.Length(V.Cross(V.Sub(b, a), V.Sub(c, a))))
+		area[t] = total
+	}
+	pool := int(Math.Ceil(total / float64(radius*radius) * 20)) //~20 candidates per r^2
+	if pool > 1<<24 {
+		return nil, &ParameterError{"PoissonSurface", "radius", radius, "too many samples for the mesh area"}
+	}
+
+	rnd := rand.New(rand.NewSource(seed))
+	g := newPoissonGrid(radius)
+	for i := 0; i < pool; i++ {
+		x := rnd.Float64() * total
+		lo, hi := 0, tris-1
+		for lo < hi { //First triangle with cumulative area >= x
+			mid := (lo + hi) / 2
+			if area[mid] < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		a, b, c := mesh.Vertexes[3*lo], mesh.Vertexes[3*lo+1], mesh.Vertexes[3*lo+2]
+		u, w := rnd.Float32(), rnd.Float32()
+		if u+w > 1 {
+			u, w = 1-u, 1-w
+		}
+		p := V.Add(a, V.Add(V.Scale(V.Sub(b, a), u), V.Scale(V.Sub(c, a), w)))
+		if g.free(p) {
+			g.insert(p)
+		}
+	}
+	return g.points, nil
+}
@@ -0,0 +1,74 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"testing"
+)
+
+//scalarBox - Fluid at rest in a periodic box of length 0.4 along x with a sine mode of the scalar along x
+func scalarBox(t *testing.T, diffusion float32) (*SPHFluid, *ScalarField, float32) {
+	box := BoxFluidSystem{V.Vec32{}, 0.4, 0.15, 0.15, 16, 6, 6}
+	fluid, err := sceneFluid(box, 0.1, 0.1, V.Vec32{1, 1, 1})
+	if err != nil {
+		t.Fatalf("Failed to set up the box: %s\n", err.Error())
+	}
+	fluid.Gravity = &V.Vec32{}
+	k := float32(2 * Math.Pi / 0.4)
+	field := fluid.AddScalar("dye", diffusion, 0)
+	for i, p := range fluid.Positions {
+		field.Values[i] = 0.5 + 0.5*float32(Math.Sin(float64(k*(p[0]-fluid.Periodic.Min[0]))))
+	}
+	return fluid, field, k
+}
+
+//sineAmplitude - Amplitude of the sine mode of wavenumber k along x, projected out of the scalar
+func sineAmplitude(fluid *SPHFluid, field *ScalarField, k float32) float32 {
+	sum := float32(0)
+	for i, p := range fluid.Positions {
+		sum += (field.Values[i] - 0.5) * float32(Math.Sin(float64(k*(p[0]-fluid.Periodic.Min[0]))))
+	}
+	return 2 * sum / float32(fluid.Count)
+}
+
+//A sine mode diffuses from high to low at exp(-D k^2 t) while the total amount of scalar is kept
+func TestScalarDiffusion(t *testing.T) {
+	const D = 4e-3
+	fluid, field, k := scalarBox(t, D)
+	total, a0 := field.Mean(), sineAmplitude(fluid, field, k)
+	for fluid.Timer.T < 0.5 {
+		fluid.Compute()
+	}
+	if !isClose(field.Mean(), total) {
+		t.Errorf("Diffusion should conserve the scalar, mean %f -> %f\n", total, field.Mean())
+	}
+	ref := float32(Math.Exp(float64(-D * k * k * fluid.Timer.T)))
+	if a := sineAmplitude(fluid, field, k) / a0; Math.Abs(float64(a/ref-1)) > 0.02 {
+		t.Errorf("Sine mode should decay to %f of its amplitude, got %f\n", ref, a)
+	}
+	min, max := field.Range()
+	if min < 0 || max > 1 {
+		t.Errorf("Diffusion should stay within the initial range, got [%f, %f]\n", min, max)
+	}
+}
+
+//Diffusion mixes a segregated field, two halves of 0 and 1
+func TestScalarMixing(t *testing.T) {
+	fluid, field, _ := scalarBox(t, 4e-3)
+	for i, p := range fluid.Positions {
+		field.Values[i] = 0
+		if p[0] > 0 {
+			field.Values[i] = 1
+		}
+	}
+	start := field.SegregationIndex()
+	if !isClose(start, 1) {
+		t.Fatalf("Segregated field should have an index of 1, got %f\n", start)
+	}
+	for step := 0; step < 20; step++ {
+		fluid.Compute()
+	}
+	if s := field.SegregationIndex(); s >= 0.9*start || s <= 0 {
+		t.Errorf("Diffusion should lower the segregation index, %f -> %f\n", start, s)
+	}
+}
@@ -0,0 +1,169 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	"fmt"
+	Math "math"
+	"sort"
+)
+
+//Neighbor search backends. The uniform grid is fastest for dense fluids with one smoothing length, trees
+//adapt to sparse splashes and variable radii. All backends answer radius queries (unordered) and k nearest
+//queries (ascending distance, equal distances by lower index) over the positions of their last Build
+
+//NeighborSearch - Spatial index over particle positions
+type NeighborSearch interface {
+	Build(positions []V.Vec32) error                                           //Indexes the positions, called again after they moved
+	QueryAppend(found []Neighbor, position V.Vec32, radius float32) []Neighbor //Appends all particles within radius
+	Nearest(position V.Vec32, k int) []Neighbor                                //The k nearest particles
+}
+
+const SEARCH_GRID = "grid"
+const SEARCH_KDTREE = "kdtree"
+const SEARCH_OCTREE = "octree"
+
+//NeighborSearches - Names of the available backends
+var NeighborSearches = []string{SEARCH_GRID, SEARCH_KDTREE, SEARCH_OCTREE}
+
+//NewNeighborSearch - Empty backend by name. The grid uses compact hashing with cells of cellSize
+func NewNeighborSearch(name string, cellSize float32) (NeighborSearch, error) {
+	switch name {
+	case SEARCH_GRID:
+		if !isFinite(cellSize) || cellSize <= 0 {
+			return nil, &ParameterError{"NeighborSearch", "cellSize", cellSize, "must be positive"}
+		}
+		return AllocateCompactGrid(cellSize, 0), nil
+	case SEARCH_KDTREE:
+		return &KDTree{LeafSize: KDTREE_LEAF}, nil
+	case SEARCH_OCTREE:
+		return &Octree{LeafSize: OCTREE_LEAF, MaxDepth: OCTREE_DEPTH}, nil
+	}
+	return nil, &ParameterError{"NeighborSearch", "name", name, fmt.Sprintf("unknown backend, expected one of %v", NeighborSearches)}
+}
+
+//SetNeighborSearch - Selects the backend of the neighbor lists by name. The spatial grid of the fluid
+//stays in use for grid based passes, "grid" makes it the backend of the neighbor lists again
+func (fluid *SPHFluid) SetNeighborSearch(name string) error {
+	if name == SEARCH_GRID {
+		fluid.Search = nil
+	} else {
+		search, err := NewNeighborSearch(name, fluid.Mfp.InnerRadius)
+		if err != nil {
+			return err
+		}
+		fluid.Search = search
+	}
+	fluid.UpdateNeighbors()
+	return nil
+}
+
+//Build - Sorts the positions into the grid, incrementally when only few particles changed cell
+func (shg *SpatialHashGrid) Build(positions []V.Vec32) error {
+	return shg.Update(positions)
+}
+
+//Nearest - The k nearest particles. The search radius starts at one cell and doubles until k particles
+//are found or every particle was searched
+func (shg *SpatialHashGrid) Nearest(position V.Vec32, k int) []Neighbor {
+	if k <= 0 || len(shg.Positions) == 0 {
+		return nil
+	}
+	var found []Neighbor
+	for radius := shg.CellSize; ; radius *= 2 {
+		found = shg.gather(found[:0], position, radius)
+		if len(found) >= k || len(found) == len(shg.Positions) || Math.IsInf(float64(radius), 0) {
+			break
+		}
+	}
+	sortNeighbors(found)
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found
+}
+
+//sortNeighbors - Ascending distance, equal distances by lower index
+func sortNeighbors(found []Neighbor) {
+	sort.Slice(found, func(a, b int) bool { return closer(found[a], found[b]) })
+}
+
+func closer(a Neighbor, b Neighbor) bool {
+	return a.Distance < b.Distance || (a.Distance == b.Distance && a.Index < b.Index)
+}
+
+//knnHeap - The k nearest neighbors seen so far as a max heap on distance
+type knnHeap struct {
+	k     int
+	items []Neighbor
+}
+
+//bound - Distance a candidate has to beat, infinite until k neighbors were seen
+func (h *knnHeap) bound() float32 {
+	if len(h.items) < h.k {
+		return float32(Math.Inf(1))
+	}
+	return h.items[0].Distance
+}
+
+//push - Keeps n when it is among the k nearest, NaN distances of non finite positions are skipped
+func (h *knnHeap) push(n Neighbor) {
+	if n.Distance != n.Distance {
+		return
+	}
+	if len(h.items) < h.k {
+		h.items = append(h.items, n)
+		for c := len(h.items) - 1; c > 0; {
+			p := (c - 1) / 2
+			if !closer(h.items[p], h.items[c]) {
+				break
+			}
+			h.items[p], h.items[c] = h.items[c], h.items[p]
+			c = p
+		}
+		return
+	}
+	if !closer(n, h.items[0]) {
+		return
+	}
+	h.items[0] = n
+	for p := 0; ; {
+		far := p
+		for _, c := range []int{2*p + 1, 2*p + 2} {
+			if c < len(h.items) && closer(h.items[far], h.items[c]) {
+				far = c
+			}
+		}
+		if far == p {
+			break
+		}
+		h.items[p], h.items[far] = h.items[far], h.items[p]
+		p = far
+	}
+}
+
+//sorted - Neighbors in ascending distance
+func (h *knnHeap) sorted() []Neighbor {
+	sortNeighbors(h.items)
+	return h.items
+}
+
+//boxDistance - Distance from p to the axis aligned box [min, max], 0 inside. Measured with Distance to
+//the nearest point of the box so rounding never makes it exceed the distance to a particle inside
+func boxDistance(p V.Vec32, min V.Vec32, max V.Vec32) float32 {
+	c := p
+	for k := 0; k < 3; k++ {
+		if c[k] < min[k] {
+			c[k] = min[k]
+		} else if c[k] > max[k] {
+			c[k] = max[k]
+		}
+	}
+	return p.Distance(c)
+}
+
+//planeDistance - Distance from p to the plane of the axis through split, see boxDistance
+func planeDistance(p V.Vec32, axis int, split float32) float32 {
+	c := p
+	c[axis] = split
+	return p.Distance(c)
+}
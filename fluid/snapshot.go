@@ -0,0 +1,109 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+)
+
+//FluidState - Deep copy of the mutable per step simulation state. Used by the watchdog to roll back
+//unstable steps. Material descriptions, kernels and colliders are shared, not copied
+type FluidState struct {
+	Timer        Timer
+	Positions    []V.Vec32
+	Velocities   []V.Vec32
+	Forces       []V.Vec32
+	Densities    []float32
+	Pressures    []float32
+	Temperatures []float32
+	Latent       []float32
+	Phases       []Phase
+	Stresses     []V.Mat3
+	Scalars      [][]float32
+	SolidGrad    [][]V.Mat3
+	SolidPlastic [][]V.Mat3
+	Diffuse      []DiffuseParticle
+	SinceReorder int //Steps since the last reordering, the buffers are in the order of the snapshot
+}
+
+func copyVec(src []V.Vec32) []V.Vec32 {
+	if src == nil {
+		return nil
+	}
+	return append([]V.Vec32(nil), src...)
+}
+
+func copyFloat(src []float32) []float32 {
+	if src == nil {
+		return nil
+	}
+	return append([]float32(nil), src...)
+}
+
+func copyMat(src []V.Mat3) []V.Mat3 {
+	if src == nil {
+		return nil
+	}
+	return append([]V.Mat3(nil), src...)
+}
+
+//Snapshot - Captures the current simulation state
+func (fluid *SPHFluid) Snapshot() *FluidState {
+	s := &FluidState{
+		Timer:        fluid.Timer,
+		Positions:    copyVec(fluid.Positions),
+		Velocities:   copyVec(fluid.Velocities),
+		Forces:       copyVec(fluid.Forces),
+		Densities:    copyFloat(fluid.Densities),
+		Pressures:    copyFloat(fluid.Pressures),
+		Temperatures: copyFloat(fluid.Temperatures),
+		Latent:       copyFloat(fluid.Latent),
+		Stresses:     copyMat(fluid.Stresses),
+		SinceReorder: fluid.sinceReorder}
+	if fluid.Phases != nil {
+		s.Phases = append([]Phase(nil), fluid.Phases...)
+	}
+	for _, field := range fluid.Scalars {
+		s.Scalars = append(s.Scalars, copyFloat(field.Values))
+	}
+	for _, solid := range fluid.Solids {
+		s.SolidGrad = append(s.SolidGrad, copyMat(solid.DeformGrad))
+		s.SolidPlastic = append(s.SolidPlastic, copyMat(solid.Plastic))
+	}
+	if fluid.Diffuse != nil {
+		s.Diffuse = append([]DiffuseParticle(nil), fluid.Diffuse.Particles...)
+	}
+	return s
+}
+
+//Restore - Resets the simulation to a snapshot taken from this fluid and updates the spatial grid for the
+//restored positions. The snapshot stays valid so it can be restored repeatedly
+func (fluid *SPHFluid) Restore(s *FluidState) {
+	fluid.Timer = s.Timer
+	fluid.sinceReorder = s.SinceReorder
+	copy(fluid.Positions, s.Positions)
+	copy(fluid.Velocities, s.Velocities)
+	copy(fluid.Forces, s.Forces)
+	copy(fluid.Densities, s.Densities)
+	copy(fluid.Pressures, s.Pressures)
+	copy(fluid.Temperatures, s.Temperatures)
+	copy(fluid.Latent, s.Latent)
+	copy(fluid.Phases, s.Phases)
+	copy(fluid.Stresses, s.Stresses)
+	for i := range s.Scalars {
+		if i < len(fluid.Scalars) {
+			copy(fluid.Scalars[i].Values, s.Scalars[i])
+		}
+	}
+	for i := range s.SolidGrad {
+		if i < len(fluid.Solids) {
+			copy(fluid.Solids[i].DeformGrad, s.SolidGrad[i])
+			copy(fluid.Solids[i].Plastic, s.SolidPlastic[i])
+		}
+	}
+	if fluid.Diffuse != nil {
+		fluid.Diffuse.Particles = append(fluid.Diffuse.Particles[:0], s.Diffuse...)
+	}
+	if fluid.SPHGrid != nil {
+		fluid.SPHGrid.Update(fluid.Positions) //Cannot fail for existing positions
+		fluid.invalidateNeighbors()
+	}
+}
@@ -0,0 +1,166 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+)
+
+//ElasticSolid - Deformable solid made from a subset of the SPH particles. Uses corotated linear SPH
+//elasticity (Becker, Ihmsen, Teschner 2009) with a per particle deformation gradient and an optional
+//creep / yield plasticity model (Muller 2004). Particles of the solid stay in the SPH pipeline so they
+//share the neighbor search and integrator with the fluid and couple through pressure and viscosity
+type ElasticSolid struct {
+	YoungModulus float32 //Stiffness (Pa)
+	PoissonRatio float32 //Volume preservation in [0, 0.5)
+	Yield        float32 //Elastic strain norm where plastic flow starts, 0 is purely elastic (jelly, rubber)
+	Creep        float32 //Plastic flow rate (1/s) once yielded (clay)
+	MaxPlastic   float32 //Upper bound on the plastic strain norm
+
+	Indices    []int       //Fluid particle index of every solid particle
+	Rest       []V.Vec32   //Rest positions
+	Volumes    []float32   //Rest volumes m / rho0
+	Neighbors  [][]int     //Rest configuration neighbors (local solid indexes)
+	Gradients  [][]V.Vec32 //Corrected rest kernel gradients for every rest neighbor
+	DeformGrad []V.Mat3    //Deformation gradient F = R (I + grad u)
+	Plastic    []V.Mat3    //Accumulated plastic strain
+}
+
+//AddElasticSolid - Turns the given fluid particles into an elastic solid, using their current positions
+//as the rest configuration. Rest neighbors are gathered through the SPH grid and never change afterwards
+func (fluid *SPHFluid) AddElasticSolid(indices []int, young float32, poisson float32) (*ElasticSolid, error) {
+	if err := fluid.checkIndices("ElasticSolid", indices); err != nil {
+		return nil, err
+	}
+	if err := checkPositive("ElasticSolid", "YoungModulus", young); err != nil {
+		return nil, err
+	}
+	if !isFinite(poisson) || poisson < 0 || poisson >= 0.5 {
+		return nil, &ParameterError{"ElasticSolid", "PoissonRatio", poisson, "must be in [0, 0.5)"}
+	}
+	n := len(indices)
+	solid := &ElasticSolid{
+		YoungModulus: young,
+		PoissonRatio: poisson,
+		Indices:      indices,
+		Rest:         make([]V.Vec32, n),
+		Volumes:      make([]float32, n),
+		Neighbors:    make([][]int, n),
+		Gradients:    make([][]V.Vec32, n),
+		DeformGrad:   make([]V.Mat3, n),
+		Plastic:      make([]V.Mat3, n)}
+
+	local := make(map[int]int, n)
+	for k, idx := range indices {
+		local[idx] = k
+		solid.Rest[k] = fluid.Positions[idx]
+		solid.Volumes[k] = fluid.Mfp.Mass / fluid.Mfp.TargetDensity
+		solid.DeformGrad[k] = mat3Identity()
+	}
+
+	h := fluid.Mfp.InnerRadius
+	for k, idx := range indices {
+		samples, nCount, _ := fluid.SPHGrid.GetSamples(&fluid.Positions[idx])
+		correction := V.Mat3{}
+		for j := 0; j < nCount; j++ {
+			l, ok := local[samples[j].Index]
+			if !ok || l == k {
+				continue
+			}
+			xji := V.Sub(solid.Rest[l], solid.Rest[k])
+			dist := V.Length(xji)
+			if dist == 0 || dist > h {
+				continue
+			}
+			dir := V.Scale(xji, 1/dist)
+			grad := fluid.GradKernel.Grad(dist, &dir)
+			solid.Neighbors[k] = append(solid.Neighbors[k], l)
+			solid.Gradients[k] = append(solid.Gradients[k], grad)
+			correction = mat3Add(correction, mat3Outer(V.Scale(xji, solid.Volumes[l]), grad))
+		}
+
+		//Kernel gradient correction so that sum V_j X_ji (x) L g_ji = I
+		inv, ok := mat3Inverse(correction)
+		if !ok {
+			continue
+		}
+		L := mat3Transpose(inv)
+		for g := range solid.Gradients[k] {
+			solid.Gradients[k][g] = mat3MulVec(L, solid.Gradients[k][g])
+		}
+	}
+
+	fluid.Solids = append(fluid.Solids, solid)
+	return solid, nil
+}
+
+//Lame - First and second Lame parameters from Young's modulus and Poisson ratio
+func (solid *ElasticSolid) Lame() (float32, float32) {
+	E := solid.YoungModulus
+	nu := solid.PoissonRatio
+	mu := E / (2 * (1 + nu))
+	lambda := E * nu / ((1 + nu) * (1 - 2*nu))
+	return lambda, mu
+}
+
+//ElasticForces - Accumulates corotated elastic forces of every solid into the particle forces.
+//Runs ahead of the main force loop since Update clears the accumulated forces
+func (fluid *SPHFluid) ElasticForces() {
+	for _, solid := range fluid.Solids {
+		fluid.elasticForces(solid)
+	}
+}
+
+func (fluid *SPHFluid) elasticForces(solid *ElasticSolid) {
+	lambda, mu := solid.Lame()
+	mass := fluid.Mfp.Mass
+	dt := fluid.Timer.TS
+
+	for k, idx := range solid.Indices {
+		xi := fluid.Positions[idx]
+
+		//Rotation from the moment matrix of current and rest neighbor offsets
+		moment := V.Mat3{}
+		for _, l := range solid.Neighbors[k] {
+			Xji := V.Sub(solid.Rest[l], solid.Rest[k])
+			xji := V.Sub(fluid.Positions[solid.Indices[l]], xi)
+			w := fluid.ItrpKernel.F(V.Length(Xji))
+			moment = mat3Add(moment, mat3Scale(mat3Outer(xji, Xji), mass*w))
+		}
+		R := mat3Rotation(moment)
+		Rt := mat3Transpose(R)
+
+		//Displacement gradient in the unrotated frame
+		gradU := V.Mat3{}
+		for g, l := range solid.Neighbors[k] {
+			Xji := V.Sub(solid.Rest[l], solid.Rest[k])
+			xji := V.Sub(fluid.Positions[solid.Indices[l]], xi)
+			uji := V.Sub(mat3MulVec(Rt, xji), Xji)
+			gradU = mat3Add(gradU, mat3Outer(V.Scale(uji, solid.Volumes[l]), solid.Gradients[k][g]))
+		}
+		solid.DeformGrad[k] = mat3Mul(R, mat3Add(mat3Identity(), gradU))
+
+		//Linear strain minus the plastic part
+		strain := mat3Scale(mat3Add(gradU, mat3Transpose(gradU)), 0.5)
+		elastic := mat3Add(strain, mat3Scale(solid.Plastic[k], -1))
+		if solid.Yield > 0 {
+			dev := mat3Deviatoric(elastic)
+			if mat3Norm(dev) > solid.Yield {
+				solid.Plastic[k] = mat3Add(solid.Plastic[k], mat3Scale(dev, dt*solid.Creep))
+				norm := mat3Norm(solid.Plastic[k])
+				if solid.MaxPlastic > 0 && norm > solid.MaxPlastic {
+					solid.Plastic[k] = mat3Scale(solid.Plastic[k], solid.MaxPlastic/norm)
+				}
+				elastic = mat3Add(strain, mat3Scale(solid.Plastic[k], -1))
+			}
+		}
+		stress := mat3Add(mat3Scale(elastic, 2*mu), mat3Scale(mat3Identity(), lambda*mat3Trace(elastic)))
+
+		//Equal and opposite pair forces rotated back into the world frame
+		vi := solid.Volumes[k]
+		for g, l := range solid.Neighbors[k] {
+			f := mat3MulVec(R, mat3MulVec(stress, solid.Gradients[k][g]))
+			f = V.Scale(f, vi*solid.Volumes[l])
+			fluid.Forces[solid.Indices[l]].Sub(f)
+			fluid.Forces[idx].Add(f)
+		}
+	}
+}
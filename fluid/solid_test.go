@@ -0,0 +1,90 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"testing"
+)
+
+//rotationZ - Rotation matrix about the z axis
+func rotationZ(angle float64) V.Mat3 {
+	c, s := float32(Math.Cos(angle)), float32(Math.Sin(angle))
+	return V.Mat3{c, -s, 0, s, c, 0, 0, 0, 1}
+}
+
+//mat3Close - Entry wise comparison of two tensors
+func mat3Close(a V.Mat3, b V.Mat3, tol float32) bool {
+	return mat3Norm(mat3Add(a, mat3Scale(b, -1))) <= tol
+}
+
+//Polar decomposition recovers the rotation of A = R S and rejects degenerate or mirrored matrices
+func TestMat3Rotation(t *testing.T) {
+	R := rotationZ(0.7)
+	S := V.Mat3{2, 0.3, 0.1, 0.3, 1.5, 0.2, 0.1, 0.2, 0.8}
+	if got := mat3Rotation(mat3Mul(R, S)); !mat3Close(got, R, 1e-4) {
+		t.Errorf("Expected rotation %v, got %v\n", R, got)
+	}
+	if got := mat3Rotation(S); !mat3Close(got, mat3Identity(), 1e-4) {
+		t.Errorf("Symmetric positive matrix should have no rotation, got %v\n", got)
+	}
+	if got := mat3Rotation(V.Mat3{1, 0, 0, 0, 1, 0, 0, 0, 0}); got != mat3Identity() {
+		t.Errorf("Flat matrix should fall back to identity, got %v\n", got)
+	}
+	if got := mat3Rotation(V.Mat3{-1, 0, 0, 0, 1, 0, 0, 0, 1}); got != mat3Identity() {
+		t.Errorf("Reflection should fall back to identity, got %v\n", got)
+	}
+}
+
+//solidBlock - Fluid whose particles all belong to one elastic solid, with the block center
+func solidBlock(t *testing.T) (*SPHFluid, *ElasticSolid, V.Vec32) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.3, 0.3, 0.3, 6, 6, 6})
+	indices := make([]int, fluid.Count)
+	center := V.Vec32{}
+	for i := range indices {
+		indices[i] = i
+		center.Add(fluid.Positions[i])
+	}
+	center.Scale(1 / float32(fluid.Count))
+	solid, err := fluid.AddElasticSolid(indices, 1e5, 0.3)
+	if err != nil {
+		t.Fatalf("Failed to add solid: %s\n", err.Error())
+	}
+	return fluid, solid, center
+}
+
+//deform - Moves the solid particles to center + A (rest - center) and returns the elastic forces
+func deform(fluid *SPHFluid, solid *ElasticSolid, center V.Vec32, A V.Mat3) []V.Vec32 {
+	for k, idx := range solid.Indices {
+		fluid.Positions[idx] = V.Add(center, mat3MulVec(A, V.Sub(solid.Rest[k], center)))
+		fluid.Forces[idx] = V.Vec32{}
+	}
+	fluid.ElasticForces()
+	return fluid.Forces
+}
+
+//A compressed block pushes back outwards while a rigidly rotated block stays stress free
+func TestElasticSolid(t *testing.T) {
+	fluid, solid, center := solidBlock(t)
+
+	forces := deform(fluid, solid, center, V.Mat3{0.95, 0, 0, 0, 1, 0, 0, 0, 1})
+	work := float32(0.0)
+	largest := float32(0.0)
+	for k, idx := range solid.Indices {
+		work += forces[idx][0] * (solid.Rest[k][0] - center[0])
+		largest = float32(Math.Max(float64(largest), float64(V.Length(forces[idx]))))
+	}
+	if work <= 0 {
+		t.Errorf("Compressed block should push back outwards, virial %f\n", work)
+	}
+
+	R := rotationZ(0.5)
+	forces = deform(fluid, solid, center, R)
+	for k, idx := range solid.Indices {
+		if f := V.Length(forces[idx]); f > 1e-3*largest {
+			t.Fatalf("Rigid rotation should be stress free, particle %d force %f (compression %f)\n", k, f, largest)
+		}
+		if len(solid.Neighbors[k]) > 3 && !mat3Close(solid.DeformGrad[k], R, 1e-3) {
+			t.Fatalf("Deformation gradient of particle %d should be the rotation, got %v\n", k, solid.DeformGrad[k])
+		}
+	}
+}
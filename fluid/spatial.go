@@ -3,19 +3,53 @@ package fluid
 import (
 	V "diesel.com/diesel/vector"
 	"fmt"
+	Math "math"
+	"sort"
 )
 
-const NEIGHBORS = 7
-const COLLIDER_SAMPLES = 10
-const PARTICLE_SAMPLES = 40
-
-//Spatial Hash Grid - Stores a Grid of IDNode entry point locations with a simple spatial hash
-//See Hash Function Below (float32:Scale - Width of the data structure determines how much wrapping / int:Subiv how many times that width is divided for the lenght depth width of the cube)
+const NEIGHBORS = 27             //Cells searched around a position, the cell itself and its 26 neighbors
+const PARTICLE_SAMPLES = 40      //Initial capacity of the sample list, it grows as needed
+const MAX_GRID_SUBDIV = 256      //Dense grid memory grows with Dims[0] * Dims[1] * Dims[2]
+const GRID_MOVED_FRACTION = 0.25 //Update sorts everything again once more particles than this changed cell
+
+//Spatial Hash Grid - Uniform grid of cells holding particle indexes. Positions map to the cell
+//floor((p - Origin) / CellSize). With CellSize equal to the kernel support radius all neighbors of a
+//particle lie in its own or one of the 26 adjacent cells. Cells are addressed either densely over an axis
+//aligned domain, where positions outside the domain are clamped onto the border cells, or through a
+//compact hash table of the occupied cells only (see hashing.go), which places no bounds on the domain.
+//
+//Particle indexes are counting sorted by cell key into Sorted, cell key c holds Sorted[Start[c]:End[c]].
+//Keys are linear cell indexes of the dense grid or cell handles of the compact table.
+//
+//Samples and queries return every particle found unless MaxSamples is set. Then a search finding more
+//than MaxSamples particles keeps the MaxSamples nearest to the searched position (equal distances by
+//lower index, the particle itself counts when it is found) and records the overflow in Stats
 type SpatialHashGrid struct {
-	//V Valued Attributes Affect the Mapping Function and May be updated
-	Scale  float32       //Scale positional wrapping
-	Subdiv int           //Subdiv of the Grid
-	Grid   [][][]*IDNode //Chained Grid mapping Hash V
+	Origin     V.Vec32      //Lower corner of cell [0, 0, 0]
+	CellSize   float32      //Edge length of a cell
+	Dims       [3]int       //Cells per axis of the dense grid
+	Table      [][]HashCell //Compact hash buckets of the occupied cells, nil for the dense grid
+	Cells      [][3]int     //Cell coordinates of the compact handles
+	Occupied   int          //Cells holding particles
+	Start      []int        //First Sorted entry of every cell key
+	End        []int        //One past the last Sorted entry of every cell key
+	Sorted     []int        //Particle indexes ordered by cell key
+	Keys       []int        //Cell key of every particle
+	Coords     [][3]int     //Cell coordinates of every particle
+	Positions  []V.Vec32    //Positions the stored indexes refer to, set by Load
+	MaxSamples int          //Nearest particles kept per search, 0 for no limit
+	Workers    int          //Goroutines of Load and Update, 0 or 1 runs serially (see parallel.go)
+	Stats      SampleStats  //Searches and overflows since the last ResetStats
+	merged     []int        //Scratch buffer of Update
+}
+
+//SampleStats - Neighbor search counters. Searches above MaxSamples are overflows, Dropped counts the
+//particles they discarded and Largest the most particles a single search found before capping
+type SampleStats struct {
+	Searches  int
+	Overflows int
+	Dropped   int
+	Largest   int
 }
 
 //-----------------------Utility Structs--------------------------------//
@@ -34,221 +68,429 @@ type IDNodeIter struct {
 }
 
 //Radial Grid Search Return Valued
-type NeighborGrid [7][3]int
+type NeighborGrid [NEIGHBORS][3]int
+
+//Neighbor - Particle index found by a radius query and its distance to the query position
+type Neighbor struct {
+	Index    int
+	Distance float32
+}
 
 //----------------------------------------------------------------------//
 
-//AllocateGrid - Allocates default Grid. 20 x 20 x 20 -- 15,625 Grid Locations
-//Radial domain of 1.0 centered about origin (-10, 10) on all axis
+//AllocateGrid - Allocates default Grid. 20 x 20 x 20 -- 8,000 Grid Locations
+//Unit cells centered about origin (-10, 10) on all axis
 func AllocateGrid() *SpatialHashGrid {
-	sphGrid := SpatialHashGrid{20, 20, make([][][]*IDNode, 20)}
-	//Initialize Dimensional Grid
-	for i := 0; i < sphGrid.Subdiv; i++ {
-		sphGrid.Grid[i] = make([][]*IDNode, sphGrid.Subdiv)
-		for j := 0; j < sphGrid.Subdiv; j++ {
-			sphGrid.Grid[i][j] = make([]*IDNode, sphGrid.Subdiv)
-		}
-	}
-
-	return &sphGrid
+	return AllocateUniformGrid(V.Vec32{-10, -10, -10}, 1, [3]int{20, 20, 20})
 }
 
-//Grid Searching methods
-
-//Returns NeighborGrid Index Structure for accessing Left-Right-Top-Bottom Potential Collider Positions
-//Passes in V.Vec32:particle Position - for determing grid index point
-func (shg *SpatialHashGrid) GetNeighborGrid(node [3]int) (*NeighborGrid, error) {
-	initial := node
-	this := initial
-	left := [3]int{0, 0, 0}
-	right := [3]int{0, 0, 0}
-	top := [3]int{0, 0, 0}
-	bottom := [3]int{0, 0, 0}
-	back := [3]int{0, 0, 0}
-	front := [3]int{0, 0, 0}
-
-	copyIndexes(initial, left)
-	copyIndexes(initial, right)
-	copyIndexes(initial, top)
-	copyIndexes(initial, bottom)
-
-	left[0] = left[0] - 1
-	right[0] = right[0] + 1
-
-	bottom[1] = bottom[1] - 1
-	top[1] = top[1] + 1
-
-	front[2] = front[2] - 1
-	back[2] = back[2] + 1
-
-	//Wrap collider Bounds // Check for boundary collision
-	if left[0] <= 0 {
-		left[0] = shg.Subdiv - 1
-	}
-	if right[0] >= shg.Subdiv-1 {
-		right[0] = 0
-	}
-	if top[1] >= shg.Subdiv-1 {
-		top[1] = 0
-	}
-	if bottom[1] <= 0 {
-		bottom[1] = shg.Subdiv - 1
+//AllocateGridUserDefined - Allocates a cube of edge length scale centered about the origin, divided into dim
+//cells per axis
+//
+//Deprecated: Use GridForDomain for a grid bounding the domain or AllocateCompactGrid for unbounded domains
+func AllocateGridUserDefined(scale float32, dim int) *SpatialHashGrid {
+	if dim < 1 {
+		dim = 1
+	} else if dim > MAX_GRID_SUBDIV {
+		dim = MAX_GRID_SUBDIV
 	}
+	half := scale / 2
+	return AllocateUniformGrid(V.Vec32{-half, -half, -half}, scale/float32(dim), [3]int{dim, dim, dim})
+}
+
+//AllocateUniformGrid - Allocates an empty grid of dims cells of edge length cellSize starting at origin
+func AllocateUniformGrid(origin V.Vec32, cellSize float32, dims [3]int) *SpatialHashGrid {
+	cells := dims[0] * dims[1] * dims[2]
+	return &SpatialHashGrid{Origin: origin, CellSize: cellSize, Dims: dims, Start: make([]int, cells), End: make([]int, cells)}
+}
 
-	if back[2] >= shg.Subdiv-1 {
-		back[2] = 0
+//GridForDomain - Grid with cells of edge length cellSize covering the domain [min, max] plus one cell of
+//padding on every side for particles that slightly leave the domain
+func GridForDomain(min V.Vec32, max V.Vec32, cellSize float32) (*SpatialHashGrid, error) {
+	if !isFinite(cellSize) || cellSize <= 0 {
+		return nil, &GridError{fmt.Sprintf("cell size %f must be positive", cellSize)}
 	}
-	if front[2] <= 0 {
-		front[2] = shg.Subdiv - 1
+	dims := [3]int{}
+	origin := V.Vec32{}
+	for k := 0; k < 3; k++ {
+		size := max[k] - min[k]
+		if !isFinite(min[k]) || !isFinite(size) || size < 0 {
+			return nil, &GridError{fmt.Sprintf("invalid domain [%v, %v]", min, max)}
+		}
+		cells := Math.Floor(float64(size/cellSize)) + 3
+		if cells > MAX_GRID_SUBDIV {
+			return nil, &GridError{fmt.Sprintf("domain extent %f needs %d cells on axis %d with cell size %f, limit is %d", size, int(cells), k, cellSize, MAX_GRID_SUBDIV)}
+		}
+		dims[k] = int(cells)
+		origin[k] = min[k] - cellSize
 	}
+	return AllocateUniformGrid(origin, cellSize, dims), nil
+}
 
-	nhGrid := NeighborGrid{this, left, right, top, bottom, back, front}
+//Grid Searching methods
 
+//Returns NeighborGrid Index Structure of the cell and its 26 neighbors. Cells beyond the grid border are
+//returned as they are and rejected by getHash, they are never wrapped around
+func (shg *SpatialHashGrid) GetNeighborGrid(node [3]int) (*NeighborGrid, error) {
+	nhGrid := NeighborGrid{}
+	n := 0
+	for i := -1; i <= 1; i++ {
+		for j := -1; j <= 1; j++ {
+			for k := -1; k <= 1; k++ {
+				nhGrid[n] = [3]int{node[0] + i, node[1] + j, node[2] + k}
+				n++
+			}
+		}
+	}
 	return &nhGrid, nil
 }
 
-//Gathers all particles within a search radius and returns a list once 20 particles are found
-//We need to expand the search for the neighbor grid if particles arent found and keep going until list is full
-//Given a position, search for a particle set to sample nearby. For now just return a count of samples returned
-//The beauty here is that we can just sample any position easily
+//Gathers all particles stored in the cell of the position and its 26 neighbors. These are candidates,
+//particles in the corners of the neighbor cells may be further away than one cell size (see Query)
 func (shg *SpatialHashGrid) GetSamples(position *V.Vec32) ([]IDNode, int, error) {
 	head := shg.Hash(position)
 	neighbors, _ := shg.GetNeighborGrid(*head)
-	samples := make([]IDNode, PARTICLE_SAMPLES) //Currently Set at 40
-	count := 0
+	samples := make([]IDNode, 0, PARTICLE_SAMPLES)
 
 	//Iterate through the Neigbors grid lists and append IDs as they are found
 	for i := 0; i < NEIGHBORS; i++ {
-		PNode, err := shg.getHash(neighbors[i]) //Neighbors actually searchits own first index first
-
+		indexes, err := shg.getHash(neighbors[i])
 		if err != nil {
-			//Ignore Error For Now But We are getting a repeated [-1,-1,-1] Index from gethash
-		} else {
-			if PNode != nil {
-				PNodeIter := NewIter(*PNode)
-				for PNodeIter.Next() {
-					samples[count] = *PNodeIter.P
-					count++
-				}
-			}
+			continue //Beyond the grid border
+		}
+		for _, idx := range indexes {
+			samples = append(samples, IDNode{idx, nil})
 		}
-	} //End loop
+	}
 
-	return samples, count, nil
+	if shg.record(len(samples)) {
+		dist := func(n int) float32 { return position.Distance(shg.Positions[samples[n].Index]) }
+		sort.Slice(samples, func(a, b int) bool {
+			da, db := dist(a), dist(b)
+			return da < db || (da == db && samples[a].Index < samples[b].Index)
+		})
+		samples = samples[:shg.MaxSamples]
+	}
+	return samples, len(samples), nil
 }
 
-//Allows us to copy and preserve some indexes when we check the neighbors.
-func copyIndexes(index [3]int, cpyIndex [3]int) error {
-	cpyIndex[0] = index[0]
-	cpyIndex[1] = index[1]
-	cpyIndex[2] = index[2]
-	return nil
+//record - Counts a search that found n particles, true when it has to be capped to MaxSamples
+func (shg *SpatialHashGrid) record(n int) bool {
+	shg.Stats.Searches++
+	if n > shg.Stats.Largest {
+		shg.Stats.Largest = n
+	}
+	if shg.MaxSamples <= 0 || n <= shg.MaxSamples || shg.Positions == nil {
+		return false
+	}
+	shg.Stats.Overflows++
+	shg.Stats.Dropped += n - shg.MaxSamples
+	return true
+}
+
+//ResetStats - Clears the search counters
+func (shg *SpatialHashGrid) ResetStats() {
+	shg.Stats = SampleStats{}
 }
 
-//Creates a custom storage Grid cube with specified int:Scale wrapping domains and  int:dim specifying  subdivisions in the  cube
-func AllocateGridUserDefined(Scale float32, dim int) *SpatialHashGrid {
+//Query - All particles within radius of the position (inclusive) with their distances, the MaxSamples
+//nearest when capped. Any radius is supported, the cells overlapping the query sphere's bounding box
+//are searched
+func (shg *SpatialHashGrid) Query(position V.Vec32, radius float32) []Neighbor {
+	return shg.QueryAppend(nil, position, radius)
+}
 
-	sphGrid := SpatialHashGrid{Scale, dim, make([][][]*IDNode, dim)}
-	//Initialize Dimensional Grid
-	for i := 0; i < dim; i++ {
-		sphGrid.Grid[i] = make([][]*IDNode, dim)
-		for j := 0; j < sphGrid.Subdiv; j++ {
-			sphGrid.Grid[i][j] = make([]*IDNode, sphGrid.Subdiv)
+//QueryAppend - Query appending to found, reuses the memory of found for repeated queries
+func (shg *SpatialHashGrid) QueryAppend(found []Neighbor, position V.Vec32, radius float32) []Neighbor {
+	if shg.Positions == nil || !(radius >= 0) {
+		return found
+	}
+	first := len(found)
+	found = shg.gather(found, position, radius)
+	if shg.record(len(found) - first) {
+		sortNeighbors(found[first:])
+		found = found[:first+shg.MaxSamples]
+	}
+	return found
+}
+
+//gather - Appends all particles within radius of the position
+func (shg *SpatialHashGrid) gather(found []Neighbor, position V.Vec32, radius float32) []Neighbor {
+	shg.visitCells(position, radius, func(indexes []int) {
+		for _, idx := range indexes {
+			dist := position.Distance(shg.Positions[idx])
+			if dist <= radius {
+				found = append(found, Neighbor{idx, dist})
+			}
 		}
+	})
+	return found
+}
+
+//visitCells - Calls visit with the particles of every cell overlapping the bounding box of the query sphere
+func (shg *SpatialHashGrid) visitCells(position V.Vec32, radius float32, visit func(indexes []int)) {
+	var lo, hi [3]int
+	cells := 1.0
+	for k := 0; k < 3; k++ {
+		lo[k] = shg.cell(position[k]-radius, k)
+		hi[k] = shg.cell(position[k]+radius, k)
+		cells *= float64(hi[k]-lo[k]) + 1
 	}
 
-	return &sphGrid
+	//Large radii in the unbounded compact table, cheaper to test every occupied cell
+	if shg.Table != nil && cells > float64(len(shg.Cells)) {
+		for key, c := range shg.Cells {
+			if c[0] >= lo[0] && c[0] <= hi[0] && c[1] >= lo[1] && c[1] <= hi[1] && c[2] >= lo[2] && c[2] <= hi[2] {
+				visit(shg.Sorted[shg.Start[key]:shg.End[key]])
+			}
+		}
+		return
+	}
+	for i := lo[0]; i <= hi[0]; i++ {
+		for j := lo[1]; j <= hi[1]; j++ {
+			for k := lo[2]; k <= hi[2]; k++ {
+				indexes, _ := shg.getHash([3]int{i, j, k})
+				visit(indexes)
+			}
+		}
+	}
 }
 
-//Returns Spatial Hash Index where index Range{0, N*N*N}
-//Modulus of Subdiv retains Locality Clustering
+//cell - Cell coordinate of x along axis k, clamped to the dense grid
+func (s *SpatialHashGrid) cell(x float32, k int) int {
+	c := Math.Floor(float64((x - s.Origin[k]) / s.CellSize))
+	if c != c { //NaN
+		return 0
+	}
+	if s.Table != nil {
+		return int(Math.Max(-MAX_HASH_CELL, Math.Min(MAX_HASH_CELL, c)))
+	}
+	if c < 0 {
+		return 0
+	}
+	if c > float64(s.Dims[k]-1) {
+		return s.Dims[k] - 1
+	}
+	return int(c)
+}
+
+//Returns the grid cell of the position. Positions outside a dense grid map to the nearest border cell
 func (s *SpatialHashGrid) Hash(p *V.Vec32) *[3]int {
-	d := s.Subdiv
-	vecPos := V.Scale(V.Abs(*p), s.Scale*s.Scale) //Need to make this homogenous based on the input vector and grid dimension
-	q := int(vecPos[0]) % d
-	r := int(vecPos[1]) % d
-	x := int(vecPos[2]) % d
-	idx := [3]int{q, r, x}
+	idx := [3]int{s.cell(p[0], 0), s.cell(p[1], 1), s.cell(p[2], 2)}
 	return &idx
 }
 
-//Loads particle grid with particle system positional data by Inserting nodes Based
-//On indexed positional data
+//key - Cell key of the cell coordinates, -1 for cells outside the dense grid or cells of the compact
+//table that never held a particle. With add a handle is created for new compact cells
+func (s *SpatialHashGrid) key(idx [3]int, add bool) int {
+	if s.Table != nil {
+		return s.handle(idx, add)
+	}
+	for k := 0; k < 3; k++ {
+		if idx[k] < 0 || idx[k] > s.Dims[k]-1 {
+			return -1
+		}
+	}
+	return (idx[0]*s.Dims[1]+idx[1])*s.Dims[2] + idx[2]
+}
+
+//Loads particle grid with particle system positional data. All particles are counting sorted by cell:
+//cell keys are counted, the prefix sum of the counts gives every cell its range and a scatter pass
+//writes the particle indexes into their ranges. With Workers above one every pass runs in parallel
 func (s *SpatialHashGrid) Load(Positions []V.Vec32) error {
 	if Positions == nil {
 		return fmt.Errorf("Positions Don't Exist")
 	}
-	length := len(Positions)
-
-	for i := 0; i < length; i++ {
-		s.InsertNode(&Positions[i], i)
-	}
+	n := len(Positions)
+	s.Positions = Positions
+	s.reset(n)
+	s.Keys = resizeInts(s.Keys, n)
+	s.Coords = append(s.Coords[:0], make([][3]int, n)...)
+	s.Sorted = resizeInts(s.Sorted, n)
+	s.cellKeys(s.Workers)
+	s.Occupied = CountingSort(s.Keys, s.Workers, s.Sorted, s.Start, s.End)
 	return nil
 }
 
-func (s *SpatialHashGrid) getHash(idx [3]int) (*IDNode, error) {
-	//Sanitize indexes
-	if idx[0] < 0 || idx[0] > s.Subdiv-1 || idx[1] < 0 || idx[1] > s.Subdiv-1 || idx[2] < 0 || idx[2] > s.Subdiv-1 {
-		err := fmt.Errorf("Error Spatial Hash Index Out of Bounds: %d %d %d", idx[0], idx[1], idx[2])
-		return nil, err
+//reset - Empties all cells. The compact table is cleared and grown for n particles
+func (s *SpatialHashGrid) reset(n int) {
+	s.Occupied = 0
+	if s.Table == nil {
+		for c := range s.Start {
+			s.Start[c] = 0
+			s.End[c] = 0
+		}
+		return
+	}
+	if len(s.Table) < n {
+		s.Table = make([][]HashCell, nextPrime(2*n))
+	}
+	for b := range s.Table {
+		s.Table[b] = s.Table[b][:0]
 	}
-	return s.Grid[idx[0]][idx[1]][idx[2]], nil
+	s.Cells = s.Cells[:0]
+	s.Start = s.Start[:0]
+	s.End = s.End[:0]
 }
 
-//Finds particle by its index location and position. This typically wont conern us with fluids
-//But we added the function as a utility
-func (s *SpatialHashGrid) findNode(index int, pos *V.Vec32) error {
-
-	//Setup Node Iterator with a Grid Index
-	sphPosition := s.Hash(pos)
-	sphNode, err := s.getHash(*sphPosition)
-	found := false
-	iter := NewIter(*sphNode)
+//Reload - Clears the grid and sorts all positions again
+func (s *SpatialHashGrid) Reload(Positions []V.Vec32) error {
+	return s.Load(Positions)
+}
 
-	if err != nil {
-		return err
+//Update - Brings the grid up to date after particles moved or were appended. Particles that stay in their
+//cell keep their place, the few that changed cell are merged back into the sorted buffer. Once more than
+//GRID_MOVED_FRACTION of the particles changed cell (or particles were removed) everything is sorted again.
+//The moved particles are found by Workers goroutines
+func (s *SpatialHashGrid) Update(Positions []V.Vec32) error {
+	if Positions == nil {
+		return fmt.Errorf("Positions Don't Exist")
 	}
-
-	//Particle front of Grid
-	if index == sphNode.Index {
-		found = true
+	n := len(Positions)
+	if n < len(s.Keys) {
+		return s.Load(Positions)
 	}
+	s.Positions = Positions
+	workers := sortWorkers(s.Workers, n, 0)
+	chunks := make([][]int, workers)
+	parallelFor(n, workers, func(w int, lo int, hi int) {
+		for i := lo; i < hi; i++ {
+			if i >= len(s.Coords) || *s.Hash(&Positions[i]) != s.Coords[i] {
+				chunks[w] = append(chunks[w], i)
+			}
+		}
+	})
+	moved := chunks[0]
+	for _, chunk := range chunks[1:] {
+		moved = append(moved, chunk...)
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	if float64(len(moved)) > GRID_MOVED_FRACTION*float64(n) {
+		return s.Load(Positions)
+	}
+	s.move(moved)
+	return nil
+}
 
-	for iter.Next() && found != true {
+//move - Re-files the moved particles (ascending, appended particles last) under their new cells and
+//merges them with the unmoved, still sorted, particles
+func (s *SpatialHashGrid) move(moved []int) {
+	//Take the moved particles out of their old ranges
+	for _, i := range moved {
+		if i < len(s.Keys) {
+			s.Keys[i] = -1
+		}
+	}
+	kept := s.merged[:0]
+	for _, i := range s.Sorted {
+		if s.Keys[i] >= 0 {
+			kept = append(kept, i)
+		}
+	}
+	for _, i := range moved {
+		c := *s.Hash(&s.Positions[i])
+		if i >= len(s.Keys) {
+			s.Keys = append(s.Keys, 0)
+			s.Coords = append(s.Coords, c)
+		}
+		s.Coords[i] = c
+		s.Keys[i] = s.key(c, true)
+	}
+	sort.SliceStable(moved, func(a, b int) bool { return s.Keys[moved[a]] < s.Keys[moved[b]] })
+
+	//Merge both key ordered lists into Sorted
+	sorted := s.Sorted[:0]
+	a, b := 0, 0
+	for a < len(kept) || b < len(moved) {
+		if b == len(moved) || (a < len(kept) && s.Keys[kept[a]] <= s.Keys[moved[b]]) {
+			sorted = append(sorted, kept[a])
+			a++
+		} else {
+			sorted = append(sorted, moved[b])
+			b++
+		}
+	}
+	s.Sorted, s.merged = sorted, kept
 
-		if iter.P.Index == index {
-			found = true
-			break
+	//Ranges of the merged list, emptied cells keep Start == End
+	for c := range s.Start {
+		s.Start[c] = 0
+		s.End[c] = 0
+	}
+	s.Occupied = 0
+	for p := 0; p < len(s.Sorted); p++ {
+		c := s.Keys[s.Sorted[p]]
+		if p == 0 || s.Keys[s.Sorted[p-1]] != c {
+			s.Start[c] = p
+			s.Occupied++
 		}
+		s.End[c] = p + 1
+	}
+}
 
+//Covers - True when the axis aligned domain [min, max] lies inside the grid without clamping. The
+//compact table covers any domain
+func (s *SpatialHashGrid) Covers(min V.Vec32, max V.Vec32) bool {
+	if s.Table != nil {
+		return true
 	}
-	if found == false {
-		return fmt.Errorf("Particle not found")
+	for k := 0; k < 3; k++ {
+		lo := Math.Floor(float64((min[k] - s.Origin[k]) / s.CellSize))
+		hi := Math.Floor(float64((max[k] - s.Origin[k]) / s.CellSize))
+		if !(lo >= 0) || !(hi < float64(s.Dims[k])) {
+			return false
+		}
 	}
-	return nil
+	return true
 }
 
-//Inserts a IDNode into the Spatial Hash Grid based on a given position. Index with that position is stored in the tree.
-//Just makes this latest hash the front of the the queue and links to end node. End Node has nil link. Return previous Nodes only.
-func (s *SpatialHashGrid) InsertNode(pos *V.Vec32, index int) error {
-	gIdx := s.Hash(pos)
-	currNode, err := s.getHash(*gIdx)
+//getHash - Particle indexes stored in the cell
+func (s *SpatialHashGrid) getHash(idx [3]int) ([]int, error) {
+	key := s.key(idx, false)
+	if key < 0 {
+		if s.Table != nil {
+			return nil, nil //Empty compact cell
+		}
+		return nil, fmt.Errorf("Error Spatial Hash Index Out of Bounds: %d %d %d", idx[0], idx[1], idx[2])
+	}
+	return s.Sorted[s.Start[key]:s.End[key]], nil
+}
 
+//Finds particle by its index location and position. This typically wont conern us with fluids
+//But we added the function as a utility
+func (s *SpatialHashGrid) findNode(index int, pos *V.Vec32) error {
+	indexes, err := s.getHash(*s.Hash(pos))
 	if err != nil {
 		return err
 	}
+	for _, idx := range indexes {
+		if idx == index {
+			return nil
+		}
+	}
+	return fmt.Errorf("Particle not found")
+}
 
-	if currNode == nil {
-		newNode := IDNode{index, nil}
-		s.Grid[gIdx[0]][gIdx[1]][gIdx[2]] = &newNode
-	} else {
-		newNode := IDNode{index, currNode}
-		newNode.Link = currNode
-		s.Grid[gIdx[0]][gIdx[1]][gIdx[2]] = &newNode
+//Inserts the particle index stored at pos into the grid. Particles are appended in index order, the
+//grid's Positions must hold the particle (Update inserts all appended particles at once)
+func (s *SpatialHashGrid) InsertNode(pos *V.Vec32, index int) error {
+	if index != len(s.Keys) || index >= len(s.Positions) || &s.Positions[index] != pos {
+		return fmt.Errorf("Particle %d must be appended to the grid positions in index order", index)
 	}
+	s.move([]int{index})
 	return nil
 }
 
+//resizeInts - Slice of length n reusing the capacity of buf
+func resizeInts(buf []int, n int) []int {
+	if cap(buf) < n {
+		return make([]int, n)
+	}
+	return buf[:n]
+}
+
 //Inserts the node into the current node tree.Inserts and updates links
 func (p *IDNodeIter) Insert(nextNode IDNode) error {
 	//Make sure Particle Node Address Isn't Referenced
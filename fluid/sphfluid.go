@@ -3,6 +3,7 @@ package fluid
 import (
 	G "diesel.com/diesel/geometry"
 	V "diesel.com/diesel/vector"
+	"fmt"
 	Math "math"
 )
 
@@ -22,6 +23,8 @@ const EOS_EXP = 1 //EOS Stiffness Parameter
 //SPHFluid - Is a PCISPH Fluid with Predictive Correction of Pressures
 type SPHFluid struct {
 	SPHGrid    *SpatialHashGrid   //Spatial Hash Grid For Neighbor Particles
+	Neighbors  *NeighborList      //Neighbors of the current step, built by UpdateDensities
+	Search     NeighborSearch     //Backend of the neighbor lists, nil for the spatial hash grid
 	Colliders  *G.Mesh            //Collider Triangle Meshes
 	Mfp        *MassFluidParticle //Fluid Particle Descriptor
 	ItrpKernel GaussianKernel     //Gaussian Kernel Typically
@@ -33,20 +36,46 @@ type SPHFluid struct {
 	Forces     []V.Vec32 //Particle
 	Densities  []float32 //Densities
 	Pressures  []float32 //Pressures
+	IDs        []int     //Stable particle ID of every particle, indexes change when reordering
+
+	ReorderEvery int //Steps between Morton reorderings of the particle buffers, 0 disables
+	sinceReorder int
+	slots        []int //Index of every particle ID, built on demand
+
+	Thermal      *PhaseChange //Melting / solidification description, nil disables phase change
+	Temperatures []float32    //Particle temperature (K)
+	Latent       []float32    //Particle stored latent heat (J/kg)
+	Phases       []Phase      //Particle material state
+
+	Scalars []*ScalarField  //Passive scalars advected with the particles (dye, salinity)
+	Diffuse *DiffuseSystem  //Spray, foam and bubble particles, nil disables whitewater
+	Solids  []*ElasticSolid //Elastic / plastic solids sharing the particle buffers
+
+	Granular *GranularMaterial //Drucker-Prager material of PhaseGranular particles
+	Stresses []V.Mat3          //Granular deviatoric stress
+
+	Watchdog *Watchdog          //Instability detection and rollback for SafeCompute, nil disables
+	Recorder *DiagnosticsSeries //Diagnostics recorded after every accepted step, nil disables
+	Gravity  *V.Vec32           //Overrides the default GRAV acceleration when set (i.e. zero gravity, driven flows)
+	Periodic *PeriodicDomain    //Wraps particles around the periodic axes and finds neighbors across them, nil disables
+	Workers  int                //Goroutines of the grid and neighbor search builds, 0 uses GOMAXPROCS
 }
 
 //MassFluidParticle - Fluid system particle properties extended to system
-//mass is in kg / viscosity scalar coefficient / innerRadius is the innerParticle
-//boundary, outerRadius is utilized for surface reconstruction
+//mass is in kg / viscosity is the dynamic viscosity (Pa s) everywhere in this package, the kinematic
+//viscosity is Viscosity / TargetDensity / innerRadius is the innerParticle boundary, outerRadius is
+//utilized for surface reconstruction / surface tension N/m is material data (see Material), Compute
+//applies no surface tension force
 type MassFluidParticle struct {
-	Mass          float32
-	Viscosity     float32
-	InnerRadius   float32
-	OuterRadius   float32
-	TimeStep      float32
-	SpeedSound    float32
-	TargetDensity float32
-	EosExp        float32
+	Mass           float32
+	Viscosity      float32
+	InnerRadius    float32
+	OuterRadius    float32
+	TimeStep       float32
+	SpeedSound     float32
+	TargetDensity  float32
+	EosExp         float32
+	SurfaceTension float32
 }
 
 type Timer struct {
@@ -74,30 +103,29 @@ type BoxFluidSystem struct {
 //-----------------------------------------------------------------------------
 //-----------------------------------------------------------------------------
 //Initialize does heavy lifting of setting up the Grid Data and Computing Initial
-//Particle Densities
-func (fluid *SPHFluid) Initialize(init *BoxFluidSystem, mpf *MassFluidParticle) {
+//Particle Densities. Inputs are validated first and the fluid is only modified once
+//the new particle field, grid and densities are complete - on error the fluid is left untouched
+func (fluid *SPHFluid) Initialize(init *BoxFluidSystem, mpf *MassFluidParticle) error {
+
+	if init == nil || mpf == nil {
+		return &ParameterError{"SPHFluid", "Initialize", nil, "box system and particle description are required"}
+	}
+	if err := init.Validate(); err != nil {
+		return err
+	}
+	if err := mpf.Validate(); err != nil {
+		return err
+	}
 
 	//Initialize Particles
-	fluid.Count = init.WidthCells * init.HeightCells * init.DepthCells
-	fluid.Mfp = mpf
-	fluid.ItrpKernel = InitGaussian(mpf.InnerRadius)
-	fluid.GradKernel = InitCubic(fluid.Mfp.InnerRadius)
+	count := init.WidthCells * init.HeightCells * init.DepthCells
 	wStep := init.Width / float32(init.WidthCells)
 	hStep := init.Height / float32(init.HeightCells)
 	dStep := init.Depth / float32(init.DepthCells)
 	minW := init.Origin[0] - (init.Width / 2)
 	minH := init.Origin[1] - (init.Height / 2)
 	minD := init.Origin[2] - (init.Depth / 2)
-
-	//Initialize buffers //
-	fluid.Positions = make([]V.Vec32, fluid.Count) //Must set positions
-	fluid.Velocities = make([]V.Vec32, fluid.Count)
-	fluid.Pressures = make([]float32, fluid.Count)
-	fluid.Densities = make([]float32, fluid.Count)
-	fluid.Forces = make([]V.Vec32, fluid.Count)
-
-	//Spatial Acceleration Grid -- We're having an issue with the spatial hashing modulus due to rounding modulus error
-	fluid.SPHGrid = AllocateGridUserDefined(init.Width, 7) //Constructs a cubic grid the 7 constant needs to be change
+	positions := make([]V.Vec32, count) //Must set positions
 
 	//Initialize Particle Positions and Stuff
 	for i := 0; i < init.WidthCells; i++ {
@@ -107,36 +135,110 @@ func (fluid *SPHFluid) Initialize(init *BoxFluidSystem, mpf *MassFluidParticle)
 				jf32 := float32(j)
 				kf32 := float32(k)
 				nPos := V.Vec32{float32(minW + wStep*if32), float32(minH + hStep*jf32), float32(minD + dStep*kf32)} //removed wStep , dSteh, hStep
-				index := i*init.WidthCells*init.HeightCells + int(j*init.HeightCells) + int(k)
-				fluid.Positions[index] = nPos
+				index := (i*init.HeightCells+j)*init.DepthCells + k
+				positions[index] = nPos
 			}
 		}
 	} //End Particle Init
 
-	fluid.Colliders = G.Box(init.Width, init.Height, init.Depth, init.Origin) //Initialize Collider Box
+	//Create Collider Mesh Box From List of triangles (12)
+	colliders := G.Box(init.Width, init.Height, init.Depth, init.Origin) //Initialize Collider Box
+	next, err := buildParticles(positions, colliders, V.Vec32{minW, minH, minD}, mpf, fluid.Workers)
+	if err != nil {
+		return err
+	}
+	fluid.commit(next)
+	return nil
+}
+
+//buildParticles - Allocates the particle buffers, the spatial grid with cells aligned to origin and computes
+//the initial densities with the given workers. Returns a new fluid, nothing is shared with an existing one
+func buildParticles(positions []V.Vec32, colliders *G.Mesh, origin V.Vec32, mpf *MassFluidParticle, workers int) (*SPHFluid, error) {
+	next := &SPHFluid{Workers: workers}
+	next.Count = len(positions)
+	next.Mfp = mpf
+	next.ItrpKernel = InitGaussian(mpf.InnerRadius)
+	next.GradKernel = InitCubic(mpf.InnerRadius)
+	next.Colliders = colliders
+
+	//Initialize buffers //
+	next.Positions = positions
+	next.Velocities = make([]V.Vec32, next.Count)
+	next.Pressures = make([]float32, next.Count)
+	next.Densities = make([]float32, next.Count)
+	next.Forces = make([]V.Vec32, next.Count)
+	next.assignIDs()
+
+	//Spatial Acceleration Grid -- compact hashed cells of the kernel radius, particles may leave the domain
+	next.SPHGrid = AllocateCompactTable(origin, mpf.InnerRadius, nextPrime(2*next.Count))
+	next.SPHGrid.Workers = next.workers()
 
 	//Allocates Particles to Spatial Hash Grid
-	fluid.SPHGrid.Load(fluid.Positions)
-	//Create Collider Mesh Box From List of triangles (12)
-	fluid.UpdateDensities()
+	if err := next.SPHGrid.Load(next.Positions); err != nil {
+		return nil, &GridError{err.Error()}
+	}
+	next.UpdateDensities()
+	for i, d := range next.Densities {
+		if !isFinite(d) || d <= 0 {
+			return nil, &StateError{i, fmt.Sprintf("initial density %f", d)}
+		}
+	}
+	return next, nil
+}
+
+//commit - Replaces the particle field of the fluid with a freshly built one. Per particle state of the old
+//field (phase change, scalars, solids, granular stress, diffuse particles) is dropped, run settings such as
+//the watchdog, recorder, gravity, periodic domain and reordering interval are kept
+func (fluid *SPHFluid) commit(next *SPHFluid) {
+	fluid.Count = next.Count
+	fluid.Mfp = next.Mfp
+	fluid.ItrpKernel = next.ItrpKernel
+	fluid.GradKernel = next.GradKernel
+	fluid.Positions = next.Positions
+	fluid.Velocities = next.Velocities
+	fluid.Pressures = next.Pressures
+	fluid.Densities = next.Densities
+	fluid.Forces = next.Forces
+	fluid.IDs = next.IDs
+	fluid.slots = nil
+	fluid.SPHGrid = next.SPHGrid
+	fluid.Neighbors = next.Neighbors
+	fluid.Search = next.Search
+	fluid.Colliders = next.Colliders
+	fluid.sinceReorder = 0
+	fluid.Thermal = nil
+	fluid.Temperatures = nil
+	fluid.Latent = nil
+	fluid.Phases = nil
+	fluid.Scalars = nil
+	fluid.Solids = nil
+	fluid.Granular = nil
+	fluid.Stresses = nil
+	fluid.Diffuse = nil
+
 	//Time step dependent on propogation of particle collisions
 	fluid.Timer.TS = 0.01 //(fluid.Mfp.InnerRadius * 0.4) / (fluid.Mfp.SpeedSound) //Time Step Per Iteration
+	if fluid.Mfp.TimeStep > 0 {
+		fluid.Timer.TS = fluid.Mfp.TimeStep //Derived stable time step (see NewMassFluidParticle)
+	}
 }
 
-//Updates Densities associated with each particle position with Gaussian Kernel
+//Updates Densities associated with each particle position with Gaussian Kernel. Rebuilds the neighbor
+//lists that the following passes of the step share. The particle's own contribution mass * W(0) is
+//added directly
 func (fluid *SPHFluid) UpdateDensities() {
 	FIELD := fluid.Count
+	mass := fluid.Mfp.Mass
+	self := mass * fluid.ItrpKernel.F(0)
+	fluid.UpdateNeighbors()
+	nl := fluid.Neighbors
 	//Compute Density Fieldsa
 	for i := 0; i < int(FIELD); i++ {
 		//For Each Particle Calculate Kernel Based Summation
-
-		samples, nCollide, _ := fluid.SPHGrid.GetSamples(&fluid.Positions[i])
-
-		mass := fluid.Mfp.Mass
-		density := mass
-		for j := 0; j < nCollide; j++ {
-			dist := V.Length(V.Sub(fluid.Positions[i], fluid.Positions[samples[j].Index]))
-			density += mass * fluid.ItrpKernel.F(dist)
+		density := self
+		start, end := nl.Range(i)
+		for n := start; n < end; n++ {
+			density += mass * fluid.ItrpKernel.F(nl.Distances[n])
 		}
 
 		fluid.Densities[i] = density
@@ -149,16 +251,18 @@ func (fluid *SPHFluid) DensityGradient(i int) V.Vec32 {
 
 	//For Each Particle Calculate Kernel Based Summation
 	DensityGrad := V.Vec32{}
-	samples, nCount, _ := fluid.SPHGrid.GetSamples(&fluid.Positions[i])
 	mass := fluid.Mfp.Mass
 	iDensity := fluid.Densities[i]
+	nl := fluid.neighborList()
 
-	for j := 0; j < nCount; j++ {
-		jDensity := fluid.Densities[samples[j].Index]
-		dir := V.Sub(fluid.Positions[samples[j].Index], fluid.Positions[i])
-		dist := V.Length(dir)
-		dir = V.Scale(dir, 1/dist)
-		grad := fluid.GradKernel.Grad(dist, &dir)
+	start, end := nl.Range(i)
+	for n := start; n < end; n++ {
+		if nl.Distances[n] == 0 {
+			continue
+		}
+		jDensity := fluid.Densities[nl.Indices[n]]
+		dir := nl.Directions[n]
+		grad := fluid.GradKernel.Grad(nl.Distances[n], &dir)
 		estm := (mass / iDensity) + (mass / jDensity)
 		DensityGrad.Add(*grad.Scale(estm)) //Mutation
 	}
@@ -166,58 +270,80 @@ func (fluid *SPHFluid) DensityGradient(i int) V.Vec32 {
 	return DensityGrad
 }
 
-//Updates gradient associated with each particle position with Gaussian Kernel -- these should be
-//Gradient Value Vectors
+//Accumulates the symmetric pressure force -m_i sum m_j (p_i / rho_i^2 + p_j / rho_j^2) grad W_ij with the
+//spiky kernel gradient. Pressures of all particles have to be computed by PressureEOS first
 func (fluid *SPHFluid) Pressure(i int) {
 
 	//For Each Particle Calculate Kernel Based Summation
-
-	samples, nCount, _ := fluid.SPHGrid.GetSamples(&fluid.Positions[i])
 	mass := fluid.Mfp.Mass
 	dens := fluid.Densities[i]
 	msq := mass * mass
-	F := float32(0.0)
-
-	for j := 0; j < nCount; j++ {
+	pi := fluid.Pressures[i] / (dens * dens)
+	nl := fluid.neighborList()
 
-		jDensity := fluid.Densities[samples[j].Index]
-		dir := V.Sub(fluid.Positions[samples[j].Index], fluid.Positions[i])
-		dist := V.Length(dir)
-		dir = V.Scale(dir, 1/dist)
-		grad := fluid.GradKernel.Grad(dist, &dir)
-		F = F - (msq * ((fluid.Pressures[i] / dens * dens) + (fluid.Pressures[samples[j].Index] / jDensity * jDensity)))
+	start, end := nl.Range(i)
+	for n := start; n < end; n++ {
+		if nl.Distances[n] == 0 {
+			continue
+		}
+		j := nl.Indices[n]
+		jDensity := fluid.Densities[j]
+		dir := nl.Directions[n]
+		grad := fluid.GradKernel.Grad(nl.Distances[n], &dir)
+		F := -msq * (pi + fluid.Pressures[j]/(jDensity*jDensity))
 		fluid.Forces[i].Add(*grad.Scale(F)) //Mutation
 	}
 
 }
 
-//Updates gradient associated with each particle position with Gaussian Kernel -- these should be
-//Gradient Value Vectors
+//Accumulates the laminar viscous force of Morris et al. 1997
+//m_i sum m_j (mu_i + mu_j) / (rho_i rho_j) (x_ij . grad W_ij) / (r^2 + 0.01 h^2) v_ij
+//with the dynamic viscosity mu scaled by the phase change viscosity factor. With the few neighbors of a
+//particle the sum falls short of the Laplacian (0.88 of it in a lattice of 20 neighbors) and is renormalized
+//with laplacianScale
 func (fluid *SPHFluid) Viscosity(i int) {
 
 	//For Each Particle Calculate Kernel Based Summation
-
-	samples, nCount, _ := fluid.SPHGrid.GetSamples(&fluid.Positions[i])
 	mass := fluid.Mfp.Mass
+	h := fluid.Mfp.InnerRadius
+	eta := 0.01 * h * h
 
 	iDensity := fluid.Densities[i]
-	v := 1.30 / iDensity //viscosity
+	mu := fluid.Mfp.Viscosity * fluid.ViscosityFactor(i) //viscosity
 	vi := fluid.Velocities[i]
-
-	for j := 0; j < nCount; j++ {
-		vj := fluid.Velocities[samples[j].Index]
-		jDensity := fluid.Densities[samples[j].Index]
-
-		coeff_vec := V.Scale(V.Sub(vj, vi), jDensity)
-		dist := fluid.Positions[i].Distance(fluid.Positions[samples[j].Index])
-		lap := fluid.GradKernel.O2D(dist)
-		force := V.Scale(coeff_vec, v*mass*lap)
-		fluid.Forces[i].Add(force)
+	nl := fluid.neighborList()
+
+	F := V.Vec32{}
+	moment := float32(0)
+	start, end := nl.Range(i)
+	for n := start; n < end; n++ {
+		j := nl.Indices[n]
+		r := nl.Distances[n]
+		vj := fluid.Velocities[j]
+		jDensity := fluid.Densities[j]
+		muj := fluid.Mfp.Viscosity * fluid.ViscosityFactor(j)
+
+		//x_ij . grad W_ij = r dW/dr, pulls v_i towards v_j
+		w := -r * fluid.GradKernel.O1D(r) / (r*r + eta)
+		coeff := mass * mass * (mu + muj) / (iDensity * jDensity) * w
+		F.Add(V.Scale(V.Sub(vj, vi), coeff))
+		moment += mass / jDensity * w * r * r
 	}
+	fluid.Forces[i].Add(V.Scale(F, laplacianScale(moment)))
 
 	return
 }
 
+//laplacianScale - Renormalization of a kernel Laplacian sum whose second moment
+//sum m_j / rho_j (-x_ij . grad W_ij) r^2 / (r^2 + 0.01 h^2) is moment instead of the dimension 3. Free surface
+//particles whose neighborhood holds less than a third of it keep the plain sum
+func laplacianScale(moment float32) float32 {
+	if moment > 1 {
+		return 3 / moment
+	}
+	return 1
+}
+
 //Updates particle system with accumalted External Force (I.E. Gravity)
 func (fluid *SPHFluid) External(i int, f V.Vec32) {
 	fluid.Forces[i].Add(f)
@@ -232,8 +358,8 @@ func (fluid *SPHFluid) PressureEOS(i int, negativePressure float32) {
 	exp := fluid.Mfp.EosExp
 	tgt := fluid.Mfp.TargetDensity
 	density := fluid.Densities[i]
-	eosScale := tgt * float32(Math.Sqrt(float64(sos))) / exp
-	p := eosScale / exp * float32(Math.Pow(float64(tgt/density), float64(exp))-1.0)
+	eosScale := tgt * sos * sos / exp //Tait stiffness B = rho0 c^2 / gamma
+	p := eosScale * float32(Math.Pow(float64(density/tgt), float64(exp))-1.0)
 	if p < 0 {
 		p *= negativePressure //Negative Pressure Scaling
 	}
@@ -262,7 +388,10 @@ func (fluid *SPHFluid) Update(index int) error {
 	//Updates Position
 	///TestSPH
 
-	fluid.Positions[index].Add(*fluid.Velocities[index].Scale(fluid.Timer.TS))
+	//Solid particles are advanced together in UpdateSolids
+	if !fluid.IsSolid(index) {
+		fluid.Positions[index].Add(V.Scale(fluid.Velocities[index], fluid.Timer.TS)) //Keeps the velocity
+	}
 
 	//Clear Particle Force State
 	fluid.Forces[index][0] = float32(0.0)
@@ -272,23 +401,49 @@ func (fluid *SPHFluid) Update(index int) error {
 	return nil
 }
 
+//BodyAcceleration - Gravity acceleration (m/s^2) acting on every particle, Gravity when set
+func (fluid *SPHFluid) BodyAcceleration() V.Vec32 {
+	if fluid.Gravity != nil {
+		return *fluid.Gravity
+	}
+	return V.Vec32{0, GRAV, 0}
+}
+
 //Main SPH fluid loop. Integrates all forces. Computes pressure from EOS and Resolves
-//Collisions. Updates particle velocity and position then clears all forces
+//Collisions. Updates particle velocity and position then clears all forces. Every pass finishes for all
+//particles before the next one starts, so forces only see the state at the start of the step
 func (fluid *SPHFluid) Compute() {
+	fluid.step()
+	fluid.record()
+}
+
+//step - Solver step of Compute, diagnostics are left to the caller since watched steps may be rolled back
+func (fluid *SPHFluid) step() {
 	FLUID := fluid.Count
-	GRAVITY := V.Vec32{0, GRAV, 0}
-	EXTERNAL := V.Vec32{}
-	EXTERNAL.Add(GRAVITY)
+	EXTERNAL := V.Scale(fluid.BodyAcceleration(), fluid.Mfp.Mass) //Gravity is an acceleration
+
+	//Positions may have been changed since the last step
+	fluid.reorderDue()
+	fluid.applyWorkers()
+	fluid.SPHGrid.Update(fluid.Positions)
 
 	//Conditioning Loop
 	fluid.UpdateDensities()
+	for i := 0; i < FLUID; i++ {
+		fluid.PressureEOS(i, 0) //Negative Pressure Scale 0, the granular return mapping reads these
+	}
+	fluid.UpdateTemperatures()
+	fluid.DiffuseScalars()
+	fluid.ElasticForces()
+	fluid.GranularForces()
 
 	//Fluid Properties
 	for i := 0; i < FLUID; i++ {
-		fluid.PressureEOS(i, 0) //Negative Pressure Scale 0
 		fluid.Pressure(i)
 		fluid.Viscosity(i)
 		fluid.External(i, EXTERNAL)
+	}
+	for i := 0; i < FLUID; i++ {
 		//Resolve Mesh Collisions
 		fluid.Collide(i)
 
@@ -296,6 +451,22 @@ func (fluid *SPHFluid) Compute() {
 		fluid.Update(i)
 	}
 
+	fluid.UpdateSolids()
+	if fluid.Periodic != nil {
+		for i := 0; i < FLUID; i++ {
+			fluid.Periodic.Wrap(&fluid.Positions[i])
+		}
+	}
+	fluid.SPHGrid.Update(fluid.Positions) //Neighbors of the new positions for diffuse particles and diagnostics
+	fluid.invalidateNeighbors()
+	fluid.UpdateDiffuse()
 	fluid.Timer.StepTime()
+	fluid.sinceReorder++
+}
 
+//record - Appends the diagnostics of an accepted step to the recorder
+func (fluid *SPHFluid) record() {
+	if fluid.Recorder != nil {
+		fluid.Recorder.Record(fluid.Diagnose())
+	}
 }
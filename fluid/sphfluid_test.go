@@ -0,0 +1,1027 @@
+package fluid
+
+import (
+	"bytes"
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	"fmt"
+	Math "math"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+const TEST_NEIGHBORS = 30
+
+//newTestFluid - Water on the lattice of the box with the particle description derived from its spacing
+func newTestFluid(t testing.TB, box BoxFluidSystem) *SPHFluid {
+	mfp, err := NewBoxMassFluidParticle(&box, 1000, TEST_NEIGHBORS, 1e-3, 2)
+	if err != nil {
+		t.Fatalf("Failed to derive the particle description: %s\n", err.Error())
+	}
+	fluid := &SPHFluid{}
+	if err := fluid.Initialize(&box, mfp); err != nil {
+		t.Fatalf("Valid fluid failed to initialize: %s\n", err.Error())
+	}
+	return fluid
+}
+
+//Initialize rejects bad inputs with typed errors and leaves the fluid untouched
+func TestInitializeValidation(t *testing.T) {
+	var box = BoxFluidSystem{V.Vec32{0, 0, -5}, 2, 2, 2, 9, 9, 9}
+	fluid := newTestFluid(t, box)
+	mfp := *fluid.Mfp
+	valid := fluid.Mfp
+	count := fluid.Count
+
+	badBox := box
+	badBox.WidthCells = 0
+	if err, ok := fluid.Initialize(&badBox, &mfp).(*ParameterError); !ok || err.Field != "WidthCells" {
+		t.Errorf("Expected WidthCells parameter error, got %v\n", err)
+	}
+
+	badMfp := mfp
+	badMfp.Mass = -1
+	if err, ok := fluid.Initialize(&box, &badMfp).(*ParameterError); !ok || err.Field != "Mass" {
+		t.Errorf("Expected Mass parameter error, got %v\n", err)
+	}
+
+	badMfp = mfp
+	badMfp.InnerRadius = 0
+	if _, ok := fluid.Initialize(&box, &badMfp).(*ParameterError); !ok {
+		t.Errorf("Expected parameter error for zero radius\n")
+	}
+
+	if fluid.Count != count || fluid.Mfp != valid || len(fluid.Positions) != count {
+		t.Errorf("Failed initialization modified the fluid\n")
+	}
+}
+
+//Initializing again with fewer particles drops the per particle state of the old field
+func TestReinitialize(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 4, 4, 4})
+	fluid.EnablePhaseChange(&PhaseChange{MeltingPoint: 300, LatentHeat: 1000, SpecificHeat: 100, Ambient: 280}, 310)
+	fluid.AddScalar("dye", 0.01, 1)
+	if _, err := fluid.AddElasticSolid([]int{60, 61, 62, 63}, 1e4, 0.3); err != nil {
+		t.Fatalf("Failed to add solid: %s\n", err.Error())
+	}
+	fluid.SetGranular([]int{50, 51}, &GranularMaterial{FrictionAngle: 30, ShearModulus: 1e4})
+	fluid.Diffuse = NewDiffuseSystem(1)
+	fluid.Compute()
+
+	box := BoxFluidSystem{V.Vec32{}, 0.2, 0.2, 0.2, 2, 2, 2}
+	if err := fluid.Initialize(&box, fluid.Mfp); err != nil {
+		t.Fatalf("Failed to initialize again: %s\n", err.Error())
+	}
+	if fluid.Thermal != nil || fluid.Temperatures != nil || fluid.Phases != nil || fluid.Scalars != nil ||
+		fluid.Solids != nil || fluid.Granular != nil || fluid.Stresses != nil || fluid.Diffuse != nil {
+		t.Errorf("Per particle state of the old field was kept\n")
+	}
+	fluid.Compute()
+	if len(fluid.IDs) != 8 || fluid.Neighbors.Particles() != 8 {
+		t.Errorf("Expected buffers of the 8 new particles\n")
+	}
+}
+
+//Non cubic lattices fill every particle exactly once
+func TestInitializeLattice(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.6, 0.8, 2, 3, 4})
+
+	seen := make(map[V.Vec32]bool)
+	for _, p := range fluid.Positions {
+		seen[p] = true
+	}
+	if len(seen) != fluid.Count {
+		t.Errorf("Expected %d distinct particle positions, got %d\n", fluid.Count, len(seen))
+	}
+}
+
+//Watchdog rolls back an exploding step and retries with a smaller time step
+func TestWatchdogRollback(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 2, 2, 2})
+	fluid.Timer.TS = 1.0
+	fluid.Watchdog = fluid.NewWatchdog()
+	fluid.Watchdog.MaxVelocity = 1e9
+	fluid.Watchdog.MinTS = 1e-3
+	fluid.Velocities[0] = V.Vec32{10, 0, 0} //Leaves the box within a large step
+
+	if err := fluid.SafeCompute(); err != nil {
+		t.Fatalf("Reduced time steps should recover the step: %s\n", err.Error())
+	}
+	events := fluid.Watchdog.Events
+	if len(events) == 0 || events[0].Kind != WatchdogEscape || events[0].TS != 1.0 {
+		t.Fatalf("Expected a rollback of the escaping unit step, got %v\n", events)
+	}
+	for k, e := range events {
+		if e.Retry != k+1 || e.NextTS != e.TS*0.5 || (k > 0 && e.TS != events[k-1].NextTS) {
+			t.Errorf("Retry %d should halve the time step: %s\n", k, e.String())
+		}
+	}
+	last := events[len(events)-1]
+	if fluid.Timer.TS != last.NextTS || fluid.Timer.T != last.NextTS {
+		t.Errorf("Accepted step should use the reduced time step %f, got ts %f at t %f\n", last.NextTS, fluid.Timer.TS, fluid.Timer.T)
+	}
+
+	//Exhausted retries restore the state before the step
+	fluid.Timer.TS = 1.0
+	fluid.Watchdog.MaxRetries = 0
+	fluid.Velocities[0] = V.Vec32{10, 0, 0}
+	start, t0 := fluid.Positions[0], fluid.Timer.T
+	if _, ok := fluid.SafeCompute().(*StateError); !ok {
+		t.Fatalf("Expected a state error once the retries are exhausted\n")
+	}
+	if fluid.Positions[0] != start || fluid.Timer.T != t0 || fluid.Velocities[0] != (V.Vec32{10, 0, 0}) {
+		t.Errorf("Failed step should restore the previous state\n")
+	}
+
+	//Empty collider meshes (periodic scenes) bound nothing
+	fluid.Colliders = &G.Mesh{}
+	fluid.Velocities[0] = V.Vec32{}
+	if event := fluid.Watchdog.Check(fluid); event != nil {
+		t.Errorf("Particles cannot escape an empty collider mesh: %s\n", event.String())
+	}
+}
+
+//Diagnostics are recorded after every step
+func TestDiagnostics(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 2, 2, 2})
+	fluid.Velocities[0] = V.Vec32{2, 0, 0}
+	d := fluid.Diagnose()
+	if !isClose(d.KineticEnergy, 0.5*fluid.Mfp.Mass*4) || !isClose(d.Momentum[0], 2*fluid.Mfp.Mass) || d.MaxVelocity != 2 {
+		t.Errorf("Unexpected energy or momentum %f %v\n", d.KineticEnergy, d.Momentum)
+	}
+
+	pe := float32(0)
+	for _, p := range fluid.Positions {
+		pe += fluid.Mfp.Mass * -GRAV * p[1]
+	}
+	if !isClose(d.PotentialEnergy/pe, 1) {
+		t.Errorf("Unexpected potential energy %f, expected %f\n", d.PotentialEnergy, pe)
+	}
+	fluid.Gravity = &V.Vec32{}
+	if d := fluid.Diagnose(); d.PotentialEnergy != 0 {
+		t.Errorf("Potential energy should follow the gravity of the fluid, got %f\n", d.PotentialEnergy)
+	}
+
+	volume := float32(0)
+	for i := range fluid.Densities {
+		volume += fluid.Mfp.Mass / fluid.Densities[i]
+	}
+	if !isClose(d.Mass, 8*fluid.Mfp.Mass) || !isClose(d.Volume, volume) {
+		t.Errorf("Unexpected mass %f or volume %f\n", d.Mass, d.Volume)
+	}
+	nl := fluid.neighborList()
+	if d.MinNeighbors != nl.Count(0) || d.MaxNeighbors != nl.Count(0) {
+		t.Errorf("Neighbor counts should come from the neighbor lists, got %d to %d\n", d.MinNeighbors, d.MaxNeighbors)
+	}
+	last := fluid.Positions[7]
+	fluid.Positions[7] = V.Vec32{float32(Math.NaN()), 0, 0}
+	if d := fluid.Diagnose(); !isClose(d.Mass, 7*fluid.Mfp.Mass) {
+		t.Errorf("Particles lost to invalid positions should not count into the mass, got %f\n", d.Mass)
+	}
+	fluid.Positions[7] = last
+
+	fluid.Recorder = &DiagnosticsSeries{}
+	fluid.Compute()
+	fluid.Compute()
+	if len(fluid.Recorder.Samples) != 2 {
+		t.Errorf("Expected 2 recorded samples, got %d\n", len(fluid.Recorder.Samples))
+	}
+
+	//Rolled back attempts of a watched step are not recorded
+	fluid.Watchdog = fluid.NewWatchdog()
+	fluid.Watchdog.MaxVelocity = 1e9
+	fluid.Timer.TS = 1.0
+	fluid.Velocities[0] = V.Vec32{10, 0, 0}
+	if err := fluid.SafeCompute(); err != nil || len(fluid.Watchdog.Events) == 0 {
+		t.Fatalf("Expected a recovered step after rollbacks: %v\n", err)
+	}
+	if last, _ := fluid.Recorder.Last(); len(fluid.Recorder.Samples) != 3 || last.Time != fluid.Timer.T {
+		t.Errorf("Expected one sample of the accepted step, got %d\n", len(fluid.Recorder.Samples))
+	}
+}
+
+//Checkpoints restore the full state and reject corrupted files
+func TestCheckpointRoundTrip(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 2, 2, 2})
+	fluid.Timer.T = 1.25
+	fluid.Velocities[3] = V.Vec32{1, 2, 3}
+	fluid.AddScalar("dye", 0.01, 0)
+	fluid.Scalars[0].Values[2] = 0.5
+
+	buf := bytes.Buffer{}
+	if err := fluid.WriteCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to write checkpoint: %s\n", err.Error())
+	}
+	data := buf.Bytes()
+
+	loaded := SPHFluid{}
+	if err := loaded.ReadCheckpoint(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to read checkpoint: %s\n", err.Error())
+	}
+	if loaded.Count != fluid.Count || loaded.Timer != fluid.Timer || *loaded.Mfp != *fluid.Mfp {
+		t.Errorf("Checkpoint did not restore count, timer and material\n")
+	}
+	for i := 0; i < fluid.Count; i++ {
+		if loaded.Positions[i] != fluid.Positions[i] || loaded.Velocities[i] != fluid.Velocities[i] || loaded.Densities[i] != fluid.Densities[i] {
+			t.Fatalf("Checkpoint particle %d differs\n", i)
+		}
+	}
+	if len(loaded.Scalars) != 1 || loaded.Scalars[0].Name != "dye" || loaded.Scalars[0].Values[2] != 0.5 {
+		t.Errorf("Checkpoint did not restore scalar fields\n")
+	}
+	if len(loaded.Colliders.Vertexes) != len(fluid.Colliders.Vertexes) {
+		t.Errorf("Checkpoint did not restore colliders\n")
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := loaded.ReadCheckpoint(bytes.NewReader(corrupt)); err == nil {
+		t.Errorf("Expected checksum error for corrupted checkpoint\n")
+	}
+	if err := loaded.ReadCheckpoint(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Errorf("Expected error for truncated checkpoint\n")
+	}
+}
+
+//Thermal, granular, elastic solid and diffuse sections survive a checkpoint, the run configuration of the
+//loading fluid is kept
+func TestCheckpointSections(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 2, 2, 2})
+	if err := fluid.EnablePhaseChange(&PhaseChange{MeltingPoint: 300, LatentHeat: 1000, SpecificHeat: 100, Ambient: 280}, 310); err != nil {
+		t.Fatalf("Failed to enable phase change: %s\n", err.Error())
+	}
+	fluid.Temperatures[1], fluid.Latent[1] = 295, 500
+	if err := fluid.SetGranular([]int{0, 1}, &GranularMaterial{FrictionAngle: 30, Cohesion: 5, ShearModulus: 1e4}); err != nil {
+		t.Fatalf("Failed to set granular particles: %s\n", err.Error())
+	}
+	fluid.Stresses[1] = V.Mat3{1, 2, 3, 2, 4, 5, 3, 5, 6}
+	solid, err := fluid.AddElasticSolid([]int{4, 5, 6, 7}, 1e5, 0.3)
+	if err != nil {
+		t.Fatalf("Failed to add elastic solid: %s\n", err.Error())
+	}
+	solid.DeformGrad[2] = V.Mat3{1.1, 0, 0, 0, 1, 0, 0, 0, 0.9}
+	fluid.Diffuse = NewDiffuseSystem(1)
+	fluid.Diffuse.Particles = []DiffuseParticle{{V.Vec32{0.1, 0.2, 0.3}, V.Vec32{1, 0, 0}, 2, DiffuseBubble}}
+	fluid.sinceReorder = 3
+
+	buf := bytes.Buffer{}
+	if err := fluid.WriteCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to write checkpoint: %s\n", err.Error())
+	}
+	loaded := SPHFluid{Workers: 2, ReorderEvery: 10, SPHGrid: &SpatialHashGrid{MaxSamples: 16}}
+	if err := loaded.ReadCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to read checkpoint: %s\n", err.Error())
+	}
+
+	if !reflect.DeepEqual(loaded.Thermal, fluid.Thermal) || !reflect.DeepEqual(loaded.Temperatures, fluid.Temperatures) ||
+		!reflect.DeepEqual(loaded.Latent, fluid.Latent) || !reflect.DeepEqual(loaded.Phases, fluid.Phases) {
+		t.Errorf("Checkpoint did not restore the thermal section\n")
+	}
+	if !reflect.DeepEqual(loaded.Granular, fluid.Granular) || !reflect.DeepEqual(loaded.Stresses, fluid.Stresses) {
+		t.Errorf("Checkpoint did not restore the granular section\n")
+	}
+	if !reflect.DeepEqual(loaded.Solids, fluid.Solids) {
+		t.Errorf("Checkpoint did not restore the elastic solids\n")
+	}
+	if ds := loaded.Diffuse; ds == nil || !reflect.DeepEqual(ds.Particles, fluid.Diffuse.Particles) || ds.Drag != fluid.Diffuse.Drag {
+		t.Errorf("Checkpoint did not restore the diffuse section\n")
+	}
+	if loaded.sinceReorder != 3 || loaded.Workers != 2 || loaded.ReorderEvery != 10 || loaded.SPHGrid.MaxSamples != 16 || loaded.SPHGrid.Workers != 2 {
+		t.Errorf("Checkpoint should restore the reorder count and keep the run configuration\n")
+	}
+}
+
+//Shape fills hold one particle per spacing^3 of volume and respect unions, differences and meshes
+func TestFillVolume(t *testing.T) {
+	const spacing = 0.02
+	sphere := &SphereVolume{V.Vec32{1, 1, 1}, 0.2}
+	points, err := FillVolume(sphere, spacing, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to fill sphere: %s\n", err.Error())
+	}
+	expect := 4.0 / 3.0 * Math.Pi * 0.2 * 0.2 * 0.2 / (spacing * spacing * spacing)
+	if Math.Abs(float64(len(points))-expect)/expect > 0.05 {
+		t.Errorf("Expected about %f sphere particles, got %d\n", expect, len(points))
+	}
+
+	//Bottle: glass cylinder minus its hollow, filled up to half height
+	glass := &CylinderVolume{V.Vec32{}, V.Vec32{0, 1, 0}, 0.1, 0.3}
+	hollow := &CylinderVolume{V.Vec32{0, 0.02, 0}, V.Vec32{0, 1, 0}, 0.08, 0.3}
+	water := IntersectionVolume{hollow, &BoxVolume{V.Vec32{0, 0.1, 0}, V.Vec32{1, 0.2, 1}}}
+	wall := &DifferenceVolume{glass, []Volume{hollow}}
+	for _, p := range mustFill(t, water, spacing) {
+		if wall.Contains(p) || p[1] > 0.2 {
+			t.Fatalf("Water particle %v inside the glass wall or above the fill level\n", p)
+		}
+	}
+
+	box := &BoxVolume{V.Vec32{0.5, 0.5, 0.5}, V.Vec32{0.2, 0.1, 0.3}}
+	mesh := &MeshVolume{G.Box(0.2, 0.1, 0.3, V.Vec32{0.5, 0.5, 0.5})}
+	if a, b := len(mustFill(t, box, spacing)), len(mustFill(t, mesh, spacing)); a != 10*5*15 || a != b {
+		t.Errorf("Expected 750 particles in box and mesh box, got %d and %d\n", a, b)
+	}
+	union := UnionVolume{box, &BoxVolume{V.Vec32{0.5, 0.5, 0.5}, V.Vec32{0.1, 0.1, 0.1}}}
+	if n := len(mustFill(t, union, spacing)); n != 750 {
+		t.Errorf("Union with a contained box changed the particle count to %d\n", n)
+	}
+
+	a, _ := FillVolume(sphere, spacing, 0.3, 7)
+	b, _ := FillVolume(sphere, spacing, 0.3, 7)
+	if len(a) != len(b) || a[0] != b[0] || a[0] == points[0] {
+		t.Errorf("Jittered fill must be reproducible and differ from the lattice\n")
+	}
+}
+
+func mustFill(t *testing.T, v Volume, spacing float32) []V.Vec32 {
+	points, err := FillVolume(v, spacing, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to fill volume: %s\n", err.Error())
+	}
+	return points
+}
+
+//Poisson disk samples keep the minimum distance and relaxation moves particles towards rest density
+func TestPoissonRelax(t *testing.T) {
+	const spacing = 0.05
+	sphere := &SphereVolume{V.Vec32{1, 1, 1}, 0.2}
+	radius := PoissonSpacing(spacing)
+	points, err := PoissonDisk(sphere, radius, 1)
+	if err != nil {
+		t.Fatalf("Failed to sample sphere: %s\n", err.Error())
+	}
+	for i := range points {
+		if !sphere.Contains(points[i]) {
+			t.Fatalf("Sample %v outside the sphere\n", points[i])
+		}
+		for j := i + 1; j < len(points); j++ {
+			if points[i].Distance(points[j]) < radius {
+				t.Fatalf("Samples %d and %d closer than %f\n", i, j, radius)
+			}
+		}
+	}
+	lattice, _ := FillVolume(sphere, spacing, 0, 0)
+	if ratio := float64(len(points)) / float64(len(lattice)); ratio < 0.8 || ratio > 1.25 {
+		t.Errorf("Poisson spacing should match the lattice count, got %d vs %d\n", len(points), len(lattice))
+	}
+
+	surface, err := PoissonSurface(G.Box(0.4, 0.4, 0.4, V.Vec32{1, 1, 1}), radius, 1)
+	if err != nil || len(surface) == 0 {
+		t.Fatalf("Failed to sample box surface: %v\n", err)
+	}
+	for _, p := range surface {
+		d := Math.Max(Math.Abs(float64(p[0]-1)), Math.Max(Math.Abs(float64(p[1]-1)), Math.Abs(float64(p[2]-1))))
+		if Math.Abs(d-0.2) > 1e-4 {
+			t.Fatalf("Surface sample %v off the box surface\n", p)
+		}
+	}
+
+	mfp, _ := NewMassFluidParticle(spacing, 1000, 20, 0.001, 2)
+	fluid := SPHFluid{}
+	if err := fluid.InitializeParticles(points, nil, mfp); err != nil {
+		t.Fatalf("Failed to initialize samples: %s\n", err.Error())
+	}
+	before := fluid.densityError()
+	after, err := fluid.Relax(20, 0, sphere)
+	if err != nil {
+		t.Fatalf("Relax failed: %s\n", err.Error())
+	}
+	if after.Iterations != 20 || after.RMSError > before.RMSError/2 {
+		t.Errorf("Relaxation should at least halve the density error %f -> %f\n", before.RMSError, after.RMSError)
+	}
+	for _, p := range fluid.Positions {
+		if !sphere.Contains(p) {
+			t.Fatalf("Relaxed particle %v left the constraint volume\n", p)
+		}
+	}
+	if report, err := fluid.CheckNeighbors(); err != nil || !report.Exact() {
+		t.Errorf("Neighbor lists should follow the relaxed positions: %v\n", report)
+	}
+
+	//The selected backend relaxes the same way as the grid
+	tree := SPHFluid{}
+	tree.InitializeParticles(points, nil, mfp)
+	if err := tree.SetNeighborSearch(SEARCH_KDTREE); err != nil {
+		t.Fatalf("Failed to select the kd tree: %s\n", err.Error())
+	}
+	if result, err := tree.Relax(20, 0, sphere); err != nil || Math.Abs(float64(result.RMSError/after.RMSError-1)) > 1e-3 {
+		t.Errorf("Kd tree relaxation should match the grid, RMS error %f vs %f\n", result.RMSError, after.RMSError)
+	}
+}
+
+//Radius queries find exactly the particles a brute force search finds, on both sides of the origin,
+//across diagonal cells and for positions outside the grid. Dense, compact and user defined grids agree
+func TestGridQuery(t *testing.T) {
+	const h = 0.1
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{0.6, 0.6, 0.6}}, 0.05, 0.5, 3)
+	points = append(points, V.Vec32{0.05, 0.05, 0.05}, V.Vec32{-0.05, -0.05, -0.05}, V.Vec32{0.9, 0.9, 0.9}, V.Vec32{-40, 7, 1e4})
+	dense, err := GridForDomain(V.Vec32{-0.3, -0.3, -0.3}, V.Vec32{0.3, 0.3, 0.3}, h)
+	if err != nil {
+		t.Fatalf("Failed to allocate grid: %s\n", err.Error())
+	}
+	compact := AllocateCompactTable(V.Vec32{}, h, 7) //Few buckets, many collisions
+	legacy := AllocateGridUserDefined(0.6, 6)
+
+	for _, grid := range []*SpatialHashGrid{dense, compact, legacy} {
+		if err := grid.Load(points); err != nil {
+			t.Fatalf("Failed to load grid: %s\n", err.Error())
+		}
+		queries := append([]V.Vec32{{1, 1, 1}, {-0.5, 0.2, 0}}, points...)
+		for _, q := range queries {
+			for _, radius := range []float32{h, 0.25 * h, 2.5 * h, 1e5} {
+				found := map[int]float32{}
+				for _, n := range grid.Query(q, radius) {
+					if _, ok := found[n.Index]; ok {
+						t.Fatalf("Particle %d returned twice for %v\n", n.Index, q)
+					}
+					found[n.Index] = n.Distance
+				}
+				for j, p := range points {
+					d, ok := found[j]
+					if inside := q.Distance(p) <= radius; inside != ok {
+						t.Fatalf("Query %v radius %f: particle %d at %v found %t, expected %t\n", q, radius, j, p, ok, inside)
+					}
+					if ok && d != q.Distance(p) {
+						t.Fatalf("Query %v: wrong distance %f for particle %d\n", q, d, j)
+					}
+				}
+			}
+		}
+
+		//Mirrored positions must not share a cell
+		a, b := grid.Hash(&points[len(points)-4]), grid.Hash(&points[len(points)-3])
+		if *a == *b {
+			t.Errorf("Positions on both sides of the origin hashed to the same cell %v\n", *a)
+		}
+	}
+	if compact.Occupied > len(points) || compact.Occupied == 0 {
+		t.Errorf("Compact grid should store only occupied cells, got %d\n", compact.Occupied)
+	}
+}
+
+//Incremental grid updates of moved and appended particles match a full counting sort
+func TestGridUpdate(t *testing.T) {
+	const h = 0.1
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{0.5, 0.5, 0.5}}, 0.05, 0.3, 5)
+	dense, _ := GridForDomain(V.Vec32{-0.25, -0.25, -0.25}, V.Vec32{0.25, 0.25, 0.25}, h)
+	for _, grid := range []*SpatialHashGrid{dense, AllocateCompactGrid(h, len(points))} {
+		positions := append([]V.Vec32(nil), points...)
+		grid.Load(positions)
+		for step := 0; step < 4; step++ {
+			for i := step; i < len(positions); i += 17 {
+				positions[i].Add(V.Vec32{0.07, -0.05, 0.11}) //Few particles change cell
+			}
+			positions = append(positions, V.Vec32{float32(step) * 0.03, 0.2, -0.3})
+			if err := grid.Update(positions); err != nil {
+				t.Fatalf("Update failed: %s\n", err.Error())
+			}
+			fresh := AllocateCompactGrid(h, len(positions))
+			fresh.Load(positions)
+			for i, p := range positions {
+				if err := grid.findNode(i, &positions[i]); err != nil {
+					t.Fatalf("Step %d: particle %d not in its cell\n", step, i)
+				}
+				if a, b := len(grid.Query(p, h)), len(fresh.Query(p, h)); a != b {
+					t.Fatalf("Step %d: updated grid finds %d neighbors of %d, full sort %d\n", step, a, i, b)
+				}
+			}
+			if len(grid.Sorted) != len(positions) {
+				t.Fatalf("Sorted buffer holds %d of %d particles\n", len(grid.Sorted), len(positions))
+			}
+		}
+	}
+}
+
+//Neighbor lists hold the grid query results without the particle itself and reuse their memory
+func TestNeighborList(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 4, 4, 4})
+	nl := fluid.Neighbors
+	if nl == nil || nl.Particles() != fluid.Count {
+		t.Fatalf("Initialize should build the neighbor lists\n")
+	}
+	for i := 0; i < fluid.Count; i++ {
+		want := len(fluid.SPHGrid.Query(fluid.Positions[i], fluid.Mfp.InnerRadius)) - 1
+		if nl.Count(i) != want {
+			t.Fatalf("Particle %d has %d listed neighbors, query finds %d\n", i, nl.Count(i), want)
+		}
+		start, end := nl.Range(i)
+		for n := start; n < end; n++ {
+			j := nl.Indices[n]
+			if j == i || !isClose(nl.Distances[n], fluid.Positions[i].Distance(fluid.Positions[j])) {
+				t.Fatalf("Bad neighbor entry %d of particle %d\n", j, i)
+			}
+			back := V.Add(fluid.Positions[i], V.Scale(nl.Directions[n], nl.Distances[n]))
+			if !isClose(back.Distance(fluid.Positions[j]), 0) {
+				t.Fatalf("Direction of neighbor %d of particle %d does not point to it\n", j, i)
+			}
+		}
+	}
+
+	indices := &nl.Indices[0]
+	fluid.UpdateDensities()
+	if fluid.Neighbors != nl || &nl.Indices[0] != indices {
+		t.Errorf("Rebuilding the neighbor lists should reuse their buffers\n")
+	}
+
+	//Passes after a step see the neighbors of the moved particles
+	fluid.Gravity = &V.Vec32{}
+	fluid.Velocities[0] = V.Vec32{1, 1, 1}
+	fluid.Compute()
+	nl = fluid.neighborList()
+	for i := 0; i < fluid.Count; i++ {
+		start, end := nl.Range(i)
+		for n := start; n < end; n++ {
+			if !isClose(nl.Distances[n], fluid.Positions[i].Distance(fluid.Positions[nl.Indices[n]])) {
+				t.Fatalf("Neighbor %d of particle %d was not updated for the new positions\n", nl.Indices[n], i)
+			}
+		}
+	}
+}
+
+//Periodic domains list the neighbors across the boundary, every particle of the lattice sees the same
+//neighborhood and directions point to the nearest image
+func TestPeriodicNeighbors(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.6, 0.6, 0.6, 6, 6, 6})
+	min := fluid.Positions[0]
+	for _, p := range fluid.Positions {
+		for k := 0; k < 3; k++ {
+			min[k] = float32(Math.Min(float64(min[k]), float64(p[k])))
+		}
+	}
+	domain := &PeriodicDomain{V.Sub(min, V.Vec32{0.05, 0.05, 0.05}), V.Vec32{0.6, 0.6, 0.6}}
+	fluid.Periodic = domain
+	fluid.UpdateDensities()
+	nl := fluid.Neighbors
+	for i := 0; i < fluid.Count; i++ {
+		if nl.Count(i) != nl.Count(0) || !isClose(fluid.Densities[i], fluid.Densities[0]) {
+			t.Fatalf("Particle %d has %d neighbors and density %f, expected %d and %f\n", i, nl.Count(i), fluid.Densities[i], nl.Count(0), fluid.Densities[0])
+		}
+		start, end := nl.Range(i)
+		for n := start; n < end; n++ {
+			back := V.Add(fluid.Positions[i], V.Scale(nl.Directions[n], nl.Distances[n]))
+			domain.Wrap(&back)
+			if back.Distance(fluid.Positions[nl.Indices[n]]) > 1e-4 {
+				t.Fatalf("Direction of neighbor %d of particle %d does not point to its image\n", nl.Indices[n], i)
+			}
+		}
+	}
+
+	p := V.Vec32{min[0] - 0.06, min[1], min[2] + 0.65}
+	domain.Wrap(&p)
+	if !isClose(p[0], min[0]+0.54) || !isClose(p[2], min[2]+0.05) || p[1] != min[1] {
+		t.Errorf("Positions should wrap into the domain, got %v\n", p)
+	}
+}
+
+//Dense clusters never overflow a sample buffer, capped searches keep the nearest particles and count
+//the overflow
+func TestSampleCap(t *testing.T) {
+	const h = 0.1
+	cluster, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{0.1, 0.1, 0.1}}, 0.01, 0, 0) //1000 particles
+	grid := AllocateCompactGrid(h, len(cluster))
+	grid.Load(cluster)
+	center := V.Vec32{}
+	if _, n, err := grid.GetSamples(&center); err != nil || n != len(cluster) {
+		t.Fatalf("Expected all %d clustered samples, got %d (%v)\n", len(cluster), n, err)
+	}
+	if grid.Stats.Overflows != 0 || grid.Stats.Largest != len(cluster) {
+		t.Errorf("Unexpected uncapped stats %+v\n", grid.Stats)
+	}
+
+	grid.MaxSamples = 50
+	grid.ResetStats()
+	samples, n, _ := grid.GetSamples(&center)
+	found := grid.Query(center, h)
+	if n != 50 || len(found) != 50 {
+		t.Fatalf("Expected 50 capped samples, got %d and %d\n", n, len(found))
+	}
+	farthest := float32(0)
+	for k, nb := range found {
+		if nb.Index != samples[k].Index {
+			t.Errorf("Samples and query should keep the same nearest particles\n")
+		}
+		farthest = nb.Distance
+	}
+	for j, p := range cluster {
+		if p.Distance(center) < farthest {
+			kept := false
+			for _, nb := range found {
+				kept = kept || nb.Index == j
+			}
+			if !kept {
+				t.Fatalf("Particle %d at %f dropped while one at %f was kept\n", j, p.Distance(center), farthest)
+			}
+		}
+	}
+	if s := grid.Stats; s.Searches != 2 || s.Overflows != 2 || s.Dropped != 2*(len(cluster)-50) {
+		t.Errorf("Unexpected overflow stats %+v\n", s)
+	}
+}
+
+//Every neighbor search backend finds exactly the particles of a brute force search, radius queries in
+//any order and k nearest queries in ascending distance
+func TestNeighborSearch(t *testing.T) {
+	const h = 0.1
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{0.6, 0.6, 0.6}}, 0.05, 0.5, 11)
+	points = append(points, V.Vec32{0.9, 0.9, 0.9}, V.Vec32{-40, 7, 1e4}, V.Vec32{0.1, 0.1, 0.1}, V.Vec32{0.1, 0.1, 0.1})
+	points = append(points, V.Vec32{float32(Math.NaN()), 0, 0})
+	queries := append([]V.Vec32{{1, 1, 1}, {-0.5, 0.2, 0}, {0.1, 0.1, 0.1}}, points[:40]...)
+
+	for _, name := range NeighborSearches {
+		search, err := NewNeighborSearch(name, h)
+		if err != nil {
+			t.Fatalf("Failed to create %s search: %s\n", name, err.Error())
+		}
+		if err := search.Build(points); err != nil {
+			t.Fatalf("Failed to build %s search: %s\n", name, err.Error())
+		}
+		for _, q := range queries {
+			for _, radius := range []float32{h, 0.25 * h, 2.5 * h, 1e5} {
+				found := map[int]bool{}
+				for _, n := range search.QueryAppend(nil, q, radius) {
+					if found[n.Index] || n.Distance != q.Distance(points[n.Index]) {
+						t.Fatalf("%s: particle %d returned twice or with wrong distance\n", name, n.Index)
+					}
+					found[n.Index] = true
+				}
+				for j, p := range points {
+					if inside := q.Distance(p) <= radius; inside != found[j] {
+						t.Fatalf("%s query %v radius %f: particle %d found %t, expected %t\n", name, q, radius, j, found[j], inside)
+					}
+				}
+			}
+
+			for _, k := range []int{1, 7, 30} {
+				nearest := search.Nearest(q, k)
+				all := make([]Neighbor, 0, len(points))
+				for j, p := range points {
+					if d := q.Distance(p); !Math.IsNaN(float64(d)) {
+						all = append(all, Neighbor{j, d})
+					}
+				}
+				sortNeighbors(all)
+				if len(nearest) != k {
+					t.Fatalf("%s: expected %d nearest of %v, got %d\n", name, k, q, len(nearest))
+				}
+				for i := range nearest {
+					if nearest[i] != all[i] {
+						t.Fatalf("%s: nearest %d of %v is %v, expected %v\n", name, i, q, nearest[i], all[i])
+					}
+				}
+			}
+		}
+	}
+	if _, err := NewNeighborSearch("bvh", h); err == nil {
+		t.Errorf("Unknown backends should be rejected\n")
+	}
+
+	//The fluid builds identical neighbor lists with any backend
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 4, 4, 4})
+	counts := make([]int, fluid.Count)
+	for i := range counts {
+		counts[i] = fluid.Neighbors.Count(i)
+	}
+	for _, name := range NeighborSearches {
+		if err := fluid.SetNeighborSearch(name); err != nil {
+			t.Fatalf("Failed to select %s search: %s\n", name, err.Error())
+		}
+		for i, c := range counts {
+			if fluid.Neighbors.Count(i) != c {
+				t.Fatalf("%s: particle %d has %d neighbors, grid finds %d\n", name, i, fluid.Neighbors.Count(i), c)
+			}
+		}
+		if report, err := fluid.CheckNeighbors(); err != nil || !report.Exact() {
+			t.Errorf("%s: fluid neighbor search is not exact: %v %v\n", name, report, err)
+		}
+	}
+}
+
+func BenchmarkNeighborSearch(b *testing.B) {
+	const h = 0.05
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{1, 1, 1}}, 0.025, 0.3, 1)
+	for _, name := range NeighborSearches {
+		b.Run(name, func(b *testing.B) {
+			search, _ := NewNeighborSearch(name, h)
+			var found []Neighbor
+			for n := 0; n < b.N; n++ {
+				search.Build(points)
+				for _, p := range points {
+					found = search.QueryAppend(found[:0], p, h)
+				}
+			}
+		})
+	}
+}
+
+//faultySearch - Drops the first neighbor of every query and adds a far particle twice
+type faultySearch struct {
+	BruteForce
+}
+
+func (f *faultySearch) QueryAppend(found []Neighbor, position V.Vec32, radius float32) []Neighbor {
+	first := len(found)
+	found = f.BruteForce.QueryAppend(found, position, radius)
+	found = append(found[:first], found[first+1:]...)
+	far := len(f.Positions) - 1
+	return append(found, Neighbor{far, 0}, Neighbor{far, 0})
+}
+
+//The checker proves every backend exact and reports missing and spurious neighbors of broken ones
+func TestCheckNeighborSearch(t *testing.T) {
+	const h = 0.1
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{0.4, 0.4, 0.4}}, 0.05, 0.5, 5)
+	points = append(points, V.Vec32{-40, 7, 1e4})
+	dense, _ := GridForDomain(V.Vec32{-0.2, -0.2, -0.2}, V.Vec32{0.2, 0.2, 0.2}, h)
+	searches := []NeighborSearch{dense, AllocateCompactTable(V.Vec32{}, h, 7)}
+	for _, name := range NeighborSearches {
+		search, _ := NewNeighborSearch(name, h)
+		searches = append(searches, search)
+	}
+	for _, search := range searches {
+		report, err := CheckNeighborSearch(search, points, h)
+		if err != nil {
+			t.Fatalf("Check failed: %s\n", err.Error())
+		}
+		if !report.Exact() || report.Queries != len(points) || report.Neighbors <= len(points) {
+			t.Errorf("%T should be exact: %s\n", search, report.String())
+		}
+	}
+
+	report, _ := CheckNeighborSearch(&faultySearch{}, points, h)
+	if len(report.Missing) != len(points)-1 || len(report.Spurious) != 2*(len(points)-1)+1 || report.Exact() {
+		t.Errorf("Faulty search not reported: %s\n", report.String())
+	}
+
+	capped := AllocateCompactGrid(h, len(points))
+	capped.MaxSamples = 5
+	report, _ = CheckNeighborSearch(capped, points, h)
+	if len(report.Missing) != capped.Stats.Dropped || len(report.Spurious) != 0 {
+		t.Errorf("Capped search should only miss the dropped neighbors: %s\n", report.String())
+	}
+	if _, err := CheckNeighborSearch(dense, points, -1); err == nil {
+		t.Errorf("Negative radius should be rejected\n")
+	}
+}
+
+//Morton reordering permutes every particle buffer consistently and keeps particle IDs stable
+func TestMortonReorder(t *testing.T) {
+	if Morton([3]uint32{1, 0, 0}) != 1 || Morton([3]uint32{0, 1, 0}) != 2 || Morton([3]uint32{0, 0, 1}) != 4 || Morton([3]uint32{3, 3, 3}) != 63 {
+		t.Fatalf("Morton codes must interleave x, y and z bits\n")
+	}
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.6, 0.6, 0.6, 6, 6, 6})
+	dye := fluid.AddScalar("dye", 0.01, 0)
+	for i := 0; i < fluid.Count; i++ {
+		fluid.Velocities[i] = V.Vec32{float32(i), 0, 0}
+		dye.Values[i] = float32(i)
+	}
+	solid, err := fluid.AddElasticSolid([]int{0, 1, 6, 7, 36, 37, 42, 43}, 1e4, 0.3)
+	if err != nil {
+		t.Fatalf("Failed to add solid: %s\n", err.Error())
+	}
+	positions := append([]V.Vec32(nil), fluid.Positions...)
+
+	fluid.Reorder()
+	moved := 0
+	for id := 0; id < fluid.Count; id++ {
+		i := fluid.Index(id)
+		if fluid.IDs[i] != id || fluid.Positions[i] != positions[id] || fluid.Velocities[i][0] != float32(id) || dye.Values[i] != float32(id) {
+			t.Fatalf("Particle %d was not moved with its buffers\n", id)
+		}
+		if i != id {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("The z fastest lattice should be reordered\n")
+	}
+	for l, i := range solid.Indices {
+		if fluid.IDs[i] != []int{0, 1, 6, 7, 36, 37, 42, 43}[l] {
+			t.Errorf("Solid particle %d does not follow its fluid particle\n", l)
+		}
+	}
+	for i := 1; i < fluid.Count; i++ {
+		a, b := fluid.SPHGrid.Hash(&fluid.Positions[i-1]), fluid.SPHGrid.Hash(&fluid.Positions[i])
+		if Morton([3]uint32{uint32(a[0] + 64), uint32(a[1] + 64), uint32(a[2] + 64)}) > Morton([3]uint32{uint32(b[0] + 64), uint32(b[1] + 64), uint32(b[2] + 64)}) {
+			t.Fatalf("Particles %d and %d are not in Morton order\n", i-1, i)
+		}
+	}
+	if report, err := fluid.CheckNeighbors(); err != nil || !report.Exact() || fluid.Neighbors.Particles() != fluid.Count {
+		t.Errorf("Grid and neighbor lists were not rebuilt: %v\n", report)
+	}
+
+	buf := bytes.Buffer{}
+	if err := fluid.WriteCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to write checkpoint: %s\n", err.Error())
+	}
+	loaded := SPHFluid{}
+	if err := loaded.ReadCheckpoint(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to read checkpoint: %s\n", err.Error())
+	}
+	for id := 0; id < fluid.Count; id++ {
+		if loaded.Index(id) != fluid.Index(id) {
+			t.Fatalf("Checkpoint did not keep the ID of particle %d\n", id)
+		}
+	}
+
+	//Periodic reordering inside watched steps, new particles get the next IDs. The marker velocities would
+	//trip the watchdog
+	for i := range fluid.Velocities {
+		fluid.Velocities[i] = V.Vec32{}
+	}
+	fluid.ReorderEvery = 1
+	fluid.Watchdog = fluid.NewWatchdog()
+	first, _ := fluid.AddParticles([]V.Vec32{{0.05, 0.05, 0.05}}, nil)
+	if fluid.IDs[first] != fluid.Count-1 || fluid.Index(fluid.Count-1) != first {
+		t.Errorf("Added particle should get the next ID %d\n", fluid.Count-1)
+	}
+	for step := 0; step < 2; step++ {
+		if err := fluid.SafeCompute(); err != nil {
+			t.Fatalf("Step %d failed: %s\n", step, err.Error())
+		}
+	}
+	for i, id := range fluid.IDs {
+		if fluid.Index(id) != i {
+			t.Fatalf("IDs are no longer a permutation after watched steps\n")
+		}
+	}
+	if fluid.sinceReorder != 1 {
+		t.Errorf("Expected a reordering every step, %d steps since the last\n", fluid.sinceReorder)
+	}
+}
+
+//Parallel loads sort every cell exactly like the serial load for any number of workers
+func TestParallelLoad(t *testing.T) {
+	const h = 0.05
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{1, 1, 1}}, 0.03, 0.5, 9)
+	points = append(points, V.Vec32{-40, 7, 1e4}, V.Vec32{3, 3, 3})
+	for _, compact := range []bool{false, true} {
+		alloc := func() *SpatialHashGrid {
+			if compact {
+				return AllocateCompactGrid(h, len(points))
+			}
+			grid, _ := GridForDomain(V.Vec32{-0.5, -0.5, -0.5}, V.Vec32{0.5, 0.5, 0.5}, h)
+			return grid
+		}
+		serial := alloc()
+		serial.Load(points)
+		for _, workers := range []int{2, 3, 8} {
+			grid := alloc()
+			grid.Workers = workers
+			if err := grid.Load(points); err != nil {
+				t.Fatalf("Parallel load failed: %s\n", err.Error())
+			}
+			if grid.Occupied != serial.Occupied || len(grid.Start) != len(serial.Start) {
+				t.Fatalf("%d workers: %d occupied cells, serial load %d\n", workers, grid.Occupied, serial.Occupied)
+			}
+			for i := range points {
+				a, b := grid.Keys[i], serial.Keys[i]
+				got, want := grid.Sorted[grid.Start[a]:grid.End[a]], serial.Sorted[serial.Start[b]:serial.End[b]]
+				if len(got) != len(want) || grid.Coords[i] != serial.Coords[i] {
+					t.Fatalf("%d workers: cell of particle %d differs\n", workers, i)
+				}
+				for k := range got {
+					if got[k] != want[k] {
+						t.Fatalf("%d workers: cell of particle %d is not in particle order\n", workers, i)
+					}
+				}
+				if a != b || grid.Sorted[i] != serial.Sorted[i] {
+					t.Fatalf("%d workers: compact handles and order should not depend on the workers\n", workers)
+				}
+			}
+		}
+	}
+
+	//Parallel updates find the same moved particles
+	moved := append([]V.Vec32(nil), points...)
+	for i := 0; i < len(moved); i += 97 {
+		moved[i][0] += 0.06
+	}
+	serial := AllocateCompactGrid(h, len(points))
+	serial.Load(append([]V.Vec32(nil), points...))
+	serial.Update(moved)
+	grid := AllocateCompactGrid(h, len(points))
+	grid.Workers = 4
+	grid.Load(append([]V.Vec32(nil), points...))
+	grid.Update(moved)
+	for i := range moved {
+		if grid.Keys[i] != serial.Keys[i] || grid.Sorted[i] != serial.Sorted[i] {
+			t.Fatalf("Parallel update of particle %d differs from the serial update\n", i)
+		}
+	}
+
+	//Trees built by several workers answer like the serial trees
+	for _, name := range []string{SEARCH_KDTREE, SEARCH_OCTREE} {
+		serial, _ := NewNeighborSearch(name, h)
+		parallel, _ := NewNeighborSearch(name, h)
+		switch tree := parallel.(type) {
+		case *KDTree:
+			tree.Workers = 8
+		case *Octree:
+			tree.Workers = 8
+		}
+		serial.Build(points)
+		parallel.Build(points)
+		for i := 0; i < len(points); i += 37 {
+			got := parallel.QueryAppend(nil, points[i], h)
+			want := serial.QueryAppend(nil, points[i], h)
+			if len(got) != len(want) {
+				t.Fatalf("%s: %d workers found %d neighbors of particle %d, serial %d\n", name, 8, len(got), i, len(want))
+			}
+			for k := range got {
+				if got[k] != want[k] {
+					t.Fatalf("%s: neighbors of particle %d differ from the serial tree\n", name, i)
+				}
+			}
+		}
+	}
+
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 4, 4, 4})
+	if fluid.SPHGrid.Workers != runtime.GOMAXPROCS(0) {
+		t.Errorf("Grid workers should default to GOMAXPROCS, got %d\n", fluid.SPHGrid.Workers)
+	}
+	fluid.Workers = 1
+	fluid.SetNeighborSearch(SEARCH_KDTREE)
+	if fluid.SPHGrid.Workers != 1 || fluid.Search.(*KDTree).Workers != 1 {
+		t.Errorf("Fluid workers should be handed to the grid and the search backend\n")
+	}
+
+	keys := make([]int, 10000)
+	for i := range keys {
+		keys[i] = (i * 7919) % 613
+	}
+	sorted, start, end := make([]int, len(keys)), make([]int, 613), make([]int, 613)
+	if occupied := CountingSort(keys, 4, sorted, start, end); occupied != 613 || end[612] != len(keys) {
+		t.Fatalf("Unexpected counting sort ranges, %d occupied\n", occupied)
+	}
+	for c := range start {
+		for k := start[c]; k < end[c]; k++ {
+			if keys[sorted[k]] != c || (k > start[c] && sorted[k] < sorted[k-1]) {
+				t.Fatalf("Counting sort is not stable by key\n")
+			}
+		}
+	}
+}
+
+func BenchmarkGridLoad(b *testing.B) {
+	points, _ := FillVolume(&BoxVolume{V.Vec32{}, V.Vec32{1, 1, 1}}, 0.02, 0.3, 1)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			grid := AllocateCompactGrid(0.05, len(points))
+			grid.Workers = workers
+			for n := 0; n < b.N; n++ {
+				grid.Load(points)
+			}
+		})
+	}
+}
+
+//Occupancy reports the cell histogram, query cost and advice for badly tuned grids
+func TestGridOccupancy(t *testing.T) {
+	fluid := newTestFluid(t, BoxFluidSystem{V.Vec32{}, 0.4, 0.4, 0.4, 8, 8, 8})
+	h := fluid.Mfp.InnerRadius
+	o := fluid.GridOccupancy()
+	listed := 0
+	for i := 0; i < fluid.Count; i++ {
+		listed += fluid.Neighbors.Count(i)
+	}
+	cells, most := map[[3]int]int{}, 0
+	for i := range fluid.Positions {
+		c := *fluid.SPHGrid.Hash(&fluid.Positions[i])
+		cells[c]++
+		if cells[c] > most {
+			most = cells[c]
+		}
+	}
+	if o.Particles != fluid.Count || o.Occupied != len(cells) || o.MaxCell != most || o.Histogram[most] == 0 {
+		t.Errorf("Expected %d occupied cells with up to %d particles: %s\n", len(cells), most, o.String())
+	}
+	if !isClose(o.AvgNeighbors, float32(listed)/float32(fluid.Count)) || o.Efficiency <= 0 || o.Efficiency > 1 {
+		t.Errorf("Neighbor counts differ from the neighbor lists: %s\n", o.String())
+	}
+	nonempty := 0
+	for _, bucket := range fluid.SPHGrid.Table {
+		if len(bucket) > 0 {
+			nonempty++
+		}
+	}
+	if o.Collisions != o.Cells-nonempty || o.MaxChain < 1 || o.TableSize != nextPrime(2*len(cells)) {
+		t.Errorf("Unexpected hash table statistics: %s\n", o.String())
+	}
+	if len(o.Advice) != 0 || o.CellSize != h || o.Dims != [3]int{6, 6, 6} {
+		t.Errorf("Kernel sized cells need no advice: %s\n", o.String())
+	}
+
+	coarse := AllocateCompactGrid(2*h, fluid.Count)
+	coarse.Load(fluid.Positions)
+	c := coarse.Occupancy(h)
+	if c.AvgCandidates <= o.AvgCandidates || c.AvgNeighbors != o.AvgNeighbors || len(c.Advice) != 1 {
+		t.Errorf("Coarse cells should test more particles and be reported: %s\n", c.String())
+	}
+
+	sparse, _ := GridForDomain(V.Vec32{-2, -2, -2}, V.Vec32{2, 2, 2}, h)
+	sparse.Load(fluid.Positions)
+	s := sparse.Occupancy(h)
+	if s.Histogram[0] != s.Cells-s.Occupied || s.MaxChain != 1 || len(s.Advice) != 1 || s.Dims != o.Dims {
+		t.Errorf("Mostly empty dense grid should be reported: %s\n", s.String())
+	}
+}
@@ -0,0 +1,59 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"testing"
+)
+
+//Analytic references approach their steady states and the dam break table interpolates
+func TestValidationReferences(t *testing.T) {
+	const L = 0.2
+	const nu = 1e-3
+	y := float32(0.05)
+
+	couette := CouetteVelocity(y, 1e4, 0.05, L, nu)
+	if !isClose(couette, 0.05*y/L) {
+		t.Errorf("Couette flow should reach the linear profile, got %f\n", couette)
+	}
+	if start := CouetteVelocity(y, 0, 0.05, L, nu); start > 0.005 || start < -0.005 {
+		t.Errorf("Couette flow should start at rest, got %f\n", start)
+	}
+
+	poiseuille := PoiseuilleVelocity(y, 1e4, 0.02, L, nu)
+	if !isClose(poiseuille, 0.02/(2*nu)*y*(L-y)) {
+		t.Errorf("Poiseuille flow should reach the parabolic profile, got %f\n", poiseuille)
+	}
+
+	if MartinMoyceFront(0) != 1 || !isClose(MartinMoyceFront(0.84), 1.22) || MartinMoyceFront(10) != 4.11 {
+		t.Errorf("Martin Moyce front interpolation is wrong\n")
+	}
+
+	if len(ValidationScenarios()) != 5 {
+		t.Errorf("Expected five validation scenarios\n")
+	}
+}
+
+//Every validation scene runs for its full duration and stays within its error tolerance
+func TestScenarioAccuracy(t *testing.T) {
+	for _, s := range ValidationScenarios() {
+		result, err := RunScenario(s, 0)
+		if err != nil {
+			t.Errorf("Scenario %s failed: %s\n", s.Name, err.Error())
+			continue
+		}
+		if result.Time < s.Duration || len(result.Series) != result.Steps {
+			t.Errorf("Scenario %s stopped at %f of %f\n", s.Name, result.Time, s.Duration)
+		}
+		if !result.Passed || result.Error > s.Tolerance {
+			t.Errorf("Scenario %s exceeds its tolerance %f: %s\n", s.Name, s.Tolerance, result.String())
+		}
+	}
+
+	//Unsupported channel, the profile error is undefined rather than zero
+	c := &channelScene{}
+	fluid := &SPHFluid{Positions: []V.Vec32{{}}, Velocities: []V.Vec32{{}}, Count: 1}
+	if e := c.profileError(fluid, func(y float32) float32 { return 0 }, 1); !Math.IsNaN(float64(e)) {
+		t.Errorf("Channel without inner particles should report NaN, got %f\n", e)
+	}
+}
@@ -0,0 +1,244 @@
+package fluid
+
+import (
+	G "diesel.com/diesel/geometry"
+	V "diesel.com/diesel/vector"
+	Math "math"
+	"math/rand"
+)
+
+//Fluid volume initializers. A Volume is a solid region that can be filled with particles on a regular
+//or jittered lattice (FillVolume) and passed to InitializeParticles. Shapes combine with unions and
+//differences, i.e. a bottle is the difference of two cylinders filled up to a box
+
+//Volume - Closed region of space
+type Volume interface {
+	Contains(p V.Vec32) bool
+	Bounds() (V.Vec32, V.Vec32)
+}
+
+//BoxVolume - Axis aligned box
+type BoxVolume struct {
+	Center V.Vec32
+	Size   V.Vec32
+}
+
+//SphereVolume - Ball of radius Radius
+type SphereVolume struct {
+	Center V.Vec32
+	Radius float32
+}
+
+//CylinderVolume - Solid cylinder from Base along Axis with length Height (Axis need not be normalized)
+type CylinderVolume struct {
+	Base   V.Vec32
+	Axis   V.Vec32
+	Radius float32
+	Height float32
+}
+
+//MeshVolume - Interior of a watertight triangle mesh
+type MeshVolume struct {
+	Mesh *G.Mesh
+}
+
+//UnionVolume - Points inside any of the volumes
+type UnionVolume []Volume
+
+//DifferenceVolume - Points inside Volume but outside all of Subtract
+type DifferenceVolume struct {
+	Volume   Volume
+	Subtract []Volume
+}
+
+//IntersectionVolume - Points inside every volume
+type IntersectionVolume []Volume
+
+func (b *BoxVolume) Contains(p V.Vec32) bool {
+	for k := 0; k < 3; k++ {
+		if Math.Abs(float64(p[k]-b.Center[k])) > float64(b.Size[k]/2) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BoxVolume) Bounds() (V.Vec32, V.Vec32) {
+	half := V.Scale(b.Size, 0.5)
+	return V.Sub(b.Center, half), V.Add(b.Center, half)
+}
+
+func (s *SphereVolume) Contains(p V.Vec32) bool {
+	return p.Distance(s.Center) <= s.Radius
+}
+
+func (s *SphereVolume) Bounds() (V.Vec32, V.Vec32) {
+	r := V.Vec32{s.Radius, s.Radius, s.Radius}
+	return V.Sub(s.Center, r), V.Add(s.Center, r)
+}
+
+func (c *CylinderVolume) Contains(p V.Vec32) bool {
+	axis := V.Normalize(c.Axis)
+	d := V.Sub(p, c.Base)
+	h := V.Dot(d, axis)
+	if h < 0 || h > c.Height {
+		return false
+	}
+	return V.Length(V.Sub(d, V.Scale(axis, h))) <= c.Radius
+}
+
+//Bounds - Box around both end discs. A disc with unit normal n extends r * sqrt(1 - n_k^2) along axis k
+func (c *CylinderVolume) Bounds() (V.Vec32, V.Vec32) {
+	axis := V.Normalize(c.Axis)
+	top := V.Add(c.Base, V.Scale(axis, c.Height))
+	min, max := c.Base, c.Base
+	for k := 0; k < 3; k++ {
+		e := c.Radius * float32(Math.Sqrt(Math.Max(0, 1-float64(axis[k]*axis[k]))))
+		min[k] = float32(Math.Min(float64(c.Base[k]), float64(top[k]))) - e
+		max[k] = float32(Math.Max(float64(c.Base[k]), float64(top[k]))) + e
+	}
+	return min, max
+}
+
+func (m *MeshVolume) Contains(p V.Vec32) bool {
+	return m.Mesh.Contains(p)
+}
+
+func (m *MeshVolume) Bounds() (V.Vec32, V.Vec32) {
+	return m.Mesh.Bounds()
+}
+
+func (u UnionVolume) Contains(p V.Vec32) bool {
+	for _, v := range u {
+		if v.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u UnionVolume) Bounds() (V.Vec32, V.Vec32) {
+	return joinBounds(u, false)
+}
+
+func (d *DifferenceVolume) Contains(p V.Vec32) bool {
+	if !d.Volume.Contains(p) {
+		return false
+	}
+	for _, v := range d.Subtract {
+		if v.Contains(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DifferenceVolume) Bounds() (V.Vec32, V.Vec32) {
+	return d.Volume.Bounds()
+}
+
+func (in IntersectionVolume) Contains(p V.Vec32) bool {
+	for _, v := range in {
+		if !v.Contains(p) {
+			return false
+		}
+	}
+	return len(in) > 0
+}
+
+func (in IntersectionVolume) Bounds() (V.Vec32, V.Vec32) {
+	return joinBounds(in, true)
+}
+
+//joinBounds - Union (or intersection) of the bounding boxes of volumes
+func joinBounds(volumes []Volume, intersect bool) (V.Vec32, V.Vec32) {
+	if len(volumes) == 0 {
+		return V.Vec32{}, V.Vec32{}
+	}
+	min, max := volumes[0].Bounds()
+	for _, v := range volumes[1:] {
+		vmin, vmax := v.Bounds()
+		for k := 0; k < 3; k++ {
+			if intersect {
+				min[k] = float32(Math.Max(float64(min[k]), float64(vmin[k])))
+				max[k] = float32(Math.Min(float64(max[k]), float64(vmax[k])))
+			} else {
+				min[k] = float32(Math.Min(float64(min[k]), float64(vmin[k])))
+				max[k] = float32(Math.Max(float64(max[k]), float64(vmax[k])))
+			}
+		}
+	}
+	return min, max
+}
+
+//FillVolume - Particle positions inside the volume on a cubic lattice of the given spacing, centered in
+//the volume bounds. Every particle stands for one spacing^3 cell, so a box of size L gets L / spacing
+//particles per axis. Jitter in [0, 0.5] displaces every lattice point randomly by up to Jitter * spacing
+//per axis (seeded, reproducible) to break the lattice symmetry. Jittered points that leave the volume
+//are dropped
+func FillVolume(v Volume, spacing float32, jitter float32, seed int64) ([]V.Vec32, error) {
+	if err := checkPositive("FillVolume", "spacing", spacing); err != nil {
+		return nil, err
+	}
+	if !isFinite(jitter) || jitter < 0 || jitter > 0.5 {
+		return nil, &ParameterError{"FillVolume", "jitter", jitter, "must be within [0, 0.5]"}
+	}
+	min, max := v.Bounds()
+	var n [3]int
+	var start V.Vec32
+	cells := 1
+	for k := 0; k < 3; k++ {
+		size := max[k] - min[k]
+		if !isFinite(size) || size < 0 {
+			return nil, &ParameterError{"FillVolume", "bounds", [2]V.Vec32{min, max}, "volume bounds must be finite"}
+		}
+		n[k] = int(Math.Floor(float64(size/spacing) + 1e-4))
+		if n[k] < 1 {
+			n[k] = 1
+		}
+		start[k] = min[k] + (size-float32(n[k]-1)*spacing)/2
+		cells *= n[k]
+	}
+	if cells > 1<<26 {
+		return nil, &ParameterError{"FillVolume", "spacing", spacing, "lattice over the volume bounds is too large"}
+	}
+
+	rnd := rand.New(rand.NewSource(seed))
+	var points []V.Vec32
+	for i := 0; i < n[0]; i++ {
+		for j := 0; j < n[1]; j++ {
+			for k := 0; k < n[2]; k++ {
+				p := V.Vec32{start[0] + float32(i)*spacing, start[1] + float32(j)*spacing, start[2] + float32(k)*spacing}
+				if jitter > 0 {
+					for a := 0; a < 3; a++ {
+						p[a] += (2*rnd.Float32() - 1) * jitter * spacing
+					}
+				}
+				if v.Contains(p) {
+					points = append(points, p)
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+//InitializeVolume - Fills the volume with particles of the description's spacing and initializes the
+//fluid from them. Spacing is recovered from the particle mass and rest density
+func (fluid *SPHFluid) InitializeVolume(v Volume, jitter float32, seed int64, colliders *G.Mesh, mpf *MassFluidParticle) error {
+	if mpf == nil {
+		return &ParameterError{"SPHFluid", "InitializeVolume", nil, "particle description is required"}
+	}
+	if err := mpf.Validate(); err != nil {
+		return err
+	}
+	spacing := float32(Math.Cbrt(float64(mpf.Mass / mpf.TargetDensity)))
+	positions, err := FillVolume(v, spacing, jitter, seed)
+	if err != nil {
+		return err
+	}
+	if len(positions) == 0 {
+		return &ParameterError{"SPHFluid", "volume", v, "volume contains no lattice points"}
+	}
+	return fluid.InitializeParticles(positions, colliders, mpf)
+}
@@ -0,0 +1,153 @@
+package fluid
+
+import (
+	V "diesel.com/diesel/vector"
+	"fmt"
+	Math "math"
+)
+
+//WatchdogKind - Reason a simulation step was rejected
+type WatchdogKind int
+
+const (
+	WatchdogNaN      WatchdogKind = iota //NaN or Inf position / velocity
+	WatchdogVelocity                     //Velocity above the allowed maximum
+	WatchdogEscape                       //Particle left the collider domain
+)
+
+func (k WatchdogKind) String() string {
+	switch k {
+	case WatchdogNaN:
+		return "nan"
+	case WatchdogVelocity:
+		return "velocity"
+	case WatchdogEscape:
+		return "escape"
+	}
+	return "unknown"
+}
+
+//WatchdogEvent - Diagnostic emitted whenever a step is rolled back
+type WatchdogEvent struct {
+	Time     float32      //Simulation time the step started from
+	Kind     WatchdogKind //Detected instability
+	Particle int          //First offending particle
+	Value    V.Vec32      //Offending position or velocity
+	TS       float32      //Rejected time step
+	NextTS   float32      //Time step used for the retry
+	Retry    int          //Retry count for this step
+}
+
+func (e WatchdogEvent) String() string {
+	return fmt.Sprintf("Watchdog t=%f %s at particle %d %v: ts %g -> %g (retry %d)", e.Time, e.Kind, e.Particle, e.Value, e.TS, e.NextTS, e.Retry)
+}
+
+//Watchdog - Detects unstable steps, restores the previous state and retries with a reduced time step.
+//Escape bounds default to the collider bounding box grown by Margin
+type Watchdog struct {
+	MaxVelocity float32             //Velocity magnitude considered an explosion, 0 disables the check
+	Margin      float32             //Distance particles may leave the collider bounds before escaping
+	Reduction   float32             //Time step multiplier for every retry (0, 1)
+	MinTS       float32             //Smallest time step before giving up
+	MaxRetries  int                 //Retries per step before giving up
+	OnEvent     func(WatchdogEvent) //Optional event callback (logging, alerts)
+	Events      []WatchdogEvent     //Event history
+}
+
+//NewWatchdog - Watchdog with the velocity limit tied to the speed of sound of the fluid
+func (fluid *SPHFluid) NewWatchdog() *Watchdog {
+	return &Watchdog{
+		MaxVelocity: fluid.Mfp.SpeedSound,
+		Margin:      fluid.Mfp.InnerRadius,
+		Reduction:   0.5,
+		MinTS:       fluid.Timer.TS / 1024,
+		MaxRetries:  10}
+}
+
+//ColliderBounds - Axis aligned bounding box of the collider mesh, unbounded without colliders or for an
+//empty mesh (periodic scenes)
+func (fluid *SPHFluid) ColliderBounds() (V.Vec32, V.Vec32) {
+	inf := float32(Math.Inf(1))
+	min := V.Vec32{inf, inf, inf}
+	max := V.Vec32{-inf, -inf, -inf}
+	if fluid.Colliders == nil || len(fluid.Colliders.Vertexes) == 0 {
+		return V.Scale(min, -1), V.Scale(max, -1)
+	}
+	for _, v := range fluid.Colliders.Vertexes {
+		for i := 0; i < 3; i++ {
+			min[i] = float32(Math.Min(float64(min[i]), float64(v[i])))
+			max[i] = float32(Math.Max(float64(max[i]), float64(v[i])))
+		}
+	}
+	return min, max
+}
+
+//Check - Returns the first instability found in the current state or nil
+func (w *Watchdog) Check(fluid *SPHFluid) *WatchdogEvent {
+	min, max := fluid.ColliderBounds()
+	margin := V.Vec32{w.Margin, w.Margin, w.Margin}
+	min.Sub(margin)
+	max.Add(margin)
+	maxSq := w.MaxVelocity * w.MaxVelocity
+
+	for i := 0; i < fluid.Count; i++ {
+		p := fluid.Positions[i]
+		v := fluid.Velocities[i]
+		for k := 0; k < 3; k++ {
+			if !isFinite(p[k]) {
+				return &WatchdogEvent{Kind: WatchdogNaN, Particle: i, Value: p}
+			}
+			if !isFinite(v[k]) {
+				return &WatchdogEvent{Kind: WatchdogNaN, Particle: i, Value: v}
+			}
+		}
+		if w.MaxVelocity > 0 && V.Dot(v, v) > maxSq {
+			return &WatchdogEvent{Kind: WatchdogVelocity, Particle: i, Value: v}
+		}
+		for k := 0; k < 3; k++ {
+			if p[k] < min[k] || p[k] > max[k] {
+				return &WatchdogEvent{Kind: WatchdogEscape, Particle: i, Value: p}
+			}
+		}
+	}
+	return nil
+}
+
+//SafeCompute - Runs Compute under the watchdog. Unstable steps are rolled back to the state before the
+//step and retried with Timer.TS scaled by Reduction. The reduced time step is kept for later steps.
+//Returns a StateError once the retries or the minimum time step are exhausted (state is rolled back).
+//Diagnostics are only recorded for the accepted step
+func (fluid *SPHFluid) SafeCompute() error {
+	w := fluid.Watchdog
+	if w == nil {
+		fluid.Compute()
+		return nil
+	}
+	fluid.reorderDue() //Before the snapshot, rollbacks never undo a reordering
+	prev := fluid.Snapshot()
+
+	for retry := 0; ; retry++ {
+		fluid.step()
+		event := w.Check(fluid)
+		if event == nil {
+			fluid.record()
+			return nil
+		}
+
+		ts := fluid.Timer.TS
+		fluid.Restore(prev)
+		event.Time = fluid.Timer.T
+		event.TS = ts
+		event.NextTS = ts * w.Reduction
+		event.Retry = retry + 1
+		w.Events = append(w.Events, *event)
+		if w.OnEvent != nil {
+			w.OnEvent(*event)
+		}
+
+		if retry+1 > w.MaxRetries || event.NextTS < w.MinTS {
+			return &StateError{event.Particle, fmt.Sprintf("unstable after %d retries: %s", retry+1, event.String())}
+		}
+		fluid.Timer.TS = event.NextTS
+	}
+}
@@ -20,6 +20,7 @@ type Triangle struct {
 type Mesh struct {
 	Vertexes []Vec.Vec32
 	Normals  []Vec.Vec32
+	index    *triangleIndex //Bounds and BVH of the inside tests, built on first use
 }
 
 type Sphere struct {
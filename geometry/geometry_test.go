@@ -3,6 +3,8 @@ package geometry
 import (
 	"diesel.com/diesel/vector"
 	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -32,3 +34,87 @@ func TestGeometry(t *testing.T) {
 	Mesh.Vertexes[0][0] = 0
 
 }
+
+//OBJ faces are triangulated as fans, quads become two triangles
+func TestReadOBJ(t *testing.T) {
+	src := "# quad and triangle\nv 0 0 0\nv 1 0 0\nv 1 1 0\nv 0 1 0\nf 1 2 3 4\nf 1/1/1 -3/2/2 -1/3/3\n"
+	mesh, err := ReadOBJ(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Failed to read OBJ: %s\n", err.Error())
+	}
+	if len(mesh.Vertexes) != 9 || len(mesh.Normals) != 3 {
+		t.Errorf("Expected 3 triangles, got %d vertexes %d normals\n", len(mesh.Vertexes), len(mesh.Normals))
+	}
+	if mesh.Vertexes[5] != (vector.Vec32{0, 1, 0}) || mesh.Vertexes[7] != (vector.Vec32{1, 0, 0}) {
+		t.Errorf("Unexpected triangulation %v\n", mesh.Vertexes)
+	}
+	if _, err := ReadOBJ(strings.NewReader("v 0 0 0\nf 1 2 3\n")); err == nil {
+		t.Errorf("Expected error for out of range face index\n")
+	}
+}
+
+//Inside tests through the BVH match the analytic boxes and a brute force ray count, and follow Transform
+func TestMeshContains(t *testing.T) {
+	mesh := &Mesh{}
+	var centers []vector.Vec32
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				c := vector.Vec32{float32(i), float32(j), float32(k)}
+				centers = append(centers, c)
+				mesh.Merge(Box(0.5, 0.5, 0.5, c))
+			}
+		}
+	}
+	inBoxes := func(p vector.Vec32, scale float32, offset vector.Vec32) (bool, bool) {
+		for _, c := range centers {
+			d := vector.Sub(p, vector.Add(vector.Scale(c, scale), offset))
+			m := float32(0)
+			for k := 0; k < 3; k++ {
+				if a := d[k]; a > m {
+					m = a
+				} else if -a > m {
+					m = -a
+				}
+			}
+			if m < 0.25*scale-1e-3 {
+				return true, true
+			}
+			if m < 0.25*scale+1e-3 {
+				return false, false //Too close to a face to decide
+			}
+		}
+		return false, true
+	}
+
+	rnd := rand.New(rand.NewSource(3))
+	check := func(scale float32, offset vector.Vec32) {
+		for n := 0; n < 2000; n++ {
+			p := vector.Vec32{4*rnd.Float32() - 0.5, 4*rnd.Float32() - 0.5, 4*rnd.Float32() - 0.5}
+			p = vector.Add(vector.Scale(p, scale), offset)
+			inside, decided := inBoxes(p, scale, offset)
+			if decided && mesh.Contains(p) != inside {
+				t.Fatalf("Point %v should be inside %v\n", p, inside)
+			}
+			brute := 0
+			for i := 0; i+2 < len(mesh.Vertexes); i += 3 {
+				tri := InitTriangle(mesh.Vertexes[i], mesh.Vertexes[i+1], mesh.Vertexes[i+2])
+				if _, hit := tri.RayIntersect(p, parityRays[0]); hit {
+					brute++
+				}
+			}
+			if got := mesh.Crossings(p, parityRays[0]); got != brute {
+				t.Fatalf("BVH counted %d crossings from %v, brute force %d\n", got, p, brute)
+			}
+		}
+	}
+	check(1, vector.Vec32{})
+	if min, max := mesh.Bounds(); min != (vector.Vec32{-0.25, -0.25, -0.25}) || max != (vector.Vec32{3.25, 3.25, 3.25}) {
+		t.Errorf("Unexpected bounds %v %v\n", min, max)
+	}
+	mesh.Transform(2, vector.Vec32{10, 0, -5})
+	check(2, vector.Vec32{10, 0, -5})
+	if (&Mesh{}).Contains(vector.Vec32{}) {
+		t.Errorf("Empty mesh should not contain any point\n")
+	}
+}
@@ -0,0 +1,236 @@
+package geometry
+
+import (
+	Vec "diesel.com/diesel/vector"
+	Math "math"
+	"sort"
+)
+
+//Inside / outside classification of points against closed (watertight) triangle meshes by ray parity.
+//A ray leaving an interior point crosses the surface an odd number of times. Rays that graze an edge or
+//vertex can miscount, so three rays in skewed directions are cast and the majority decides
+
+var parityRays = [3]Vec.Vec32{
+	{0.5773, 0.5774, 0.5773},
+	{-0.7071, 0.1234, 0.6962},
+	{0.2673, -0.8018, -0.5345},
+}
+
+//RayIntersect - Distance along the ray origin + t * dir to the triangle (Moller-Trumbore), false when
+//the ray misses or the triangle is behind the origin
+func (tri *Triangle) RayIntersect(origin Vec.Vec32, dir Vec.Vec32) (float32, bool) {
+	const eps = 1e-9
+	e1 := Vec.Sub(*tri.Verts[1], *tri.Verts[0])
+	e2 := Vec.Sub(*tri.Verts[2], *tri.Verts[0])
+	p := Vec.Cross(dir, e2)
+	det := Vec.Dot(e1, p)
+	if det > -eps && det < eps {
+		return 0, false //Parallel to the triangle
+	}
+	inv := 1 / det
+	s := Vec.Sub(origin, *tri.Verts[0])
+	u := Vec.Dot(s, p) * inv
+	if u < 0 || u > 1 {
+		return 0, false
+	}
+	q := Vec.Cross(s, e1)
+	v := Vec.Dot(dir, q) * inv
+	if v < 0 || u+v > 1 {
+		return 0, false
+	}
+	t := Vec.Dot(e2, q) * inv
+	return t, t > 0
+}
+
+//Crossings - Number of mesh triangles hit by the ray
+func (g *Mesh) Crossings(origin Vec.Vec32, dir Vec.Vec32) int {
+	return g.triangles().crossings(origin, dir)
+}
+
+//Contains - True when the point lies inside the closed mesh. The bounds and triangle BVH are built on the
+//first call, so call BuildIndex before testing points from several goroutines
+func (g *Mesh) Contains(p Vec.Vec32) bool {
+	index := g.triangles()
+	for k := 0; k < 3; k++ {
+		if p[k] < index.min[k] || p[k] > index.max[k] {
+			return false
+		}
+	}
+	inside := 0
+	for _, dir := range parityRays {
+		if index.crossings(p, dir)%2 == 1 {
+			inside++
+		}
+	}
+	return inside >= 2
+}
+
+//BuildIndex - Builds the bounds and triangle BVH of the inside tests ahead of use
+func (g *Mesh) BuildIndex() {
+	g.triangles()
+}
+
+//Invalidate - Drops the inside test index after the vertexes were edited in place. Transform and Merge
+//invalidate the index themselves
+func (g *Mesh) Invalidate() {
+	g.index = nil
+}
+
+//triangles - Current index of the mesh, rebuilt when the triangle count changed
+func (g *Mesh) triangles() *triangleIndex {
+	if g.index == nil || g.index.vertexes != len(g.Vertexes) {
+		g.index = newTriangleIndex(g.Vertexes)
+	}
+	return g.index
+}
+
+//Bounding volume hierarchy over the mesh triangles. Leaves hold up to BVH_LEAF triangles, inner nodes split
+//their triangles at the median centroid along the longest axis
+const BVH_LEAF = 4
+
+//bvhNode - Box of a subtree. Leaves reference the triangle range [start, end), inner nodes their children
+type bvhNode struct {
+	min, max    Vec.Vec32
+	left, right int
+	start, end  int
+}
+
+//triangleIndex - Bounds and BVH of the mesh triangles, vertexes is the vertex count it was built from
+type triangleIndex struct {
+	vertexes  int
+	min, max  Vec.Vec32
+	triangles []Triangle
+	nodes     []bvhNode
+}
+
+//newTriangleIndex - Copies the triangles of the vertex list and builds the BVH over them
+func newTriangleIndex(vertexes []Vec.Vec32) *triangleIndex {
+	index := &triangleIndex{vertexes: len(vertexes)}
+	index.min, index.max = vertexBounds(vertexes)
+	for i := 0; i+2 < len(vertexes); i += 3 {
+		index.triangles = append(index.triangles, InitTriangle(vertexes[i], vertexes[i+1], vertexes[i+2]))
+	}
+	if len(index.triangles) > 0 {
+		index.build(0, len(index.triangles))
+	}
+	return index
+}
+
+//build - Appends the subtree over triangles [start, end) and returns its node
+func (index *triangleIndex) build(start int, end int) int {
+	node := len(index.nodes)
+	index.nodes = append(index.nodes, bvhNode{left: -1, right: -1, start: start, end: end})
+	inf := float32(Math.Inf(1))
+	min, max := Vec.Vec32{inf, inf, inf}, Vec.Vec32{-inf, -inf, -inf}
+	cmin, cmax := min, max
+	for t := start; t < end; t++ {
+		c := centroid(&index.triangles[t])
+		for _, v := range index.triangles[t].Verts {
+			for k := 0; k < 3; k++ {
+				min[k] = float32(Math.Min(float64(min[k]), float64(v[k])))
+				max[k] = float32(Math.Max(float64(max[k]), float64(v[k])))
+			}
+		}
+		for k := 0; k < 3; k++ {
+			cmin[k] = float32(Math.Min(float64(cmin[k]), float64(c[k])))
+			cmax[k] = float32(Math.Max(float64(cmax[k]), float64(c[k])))
+		}
+	}
+	index.nodes[node].min, index.nodes[node].max = min, max
+	if end-start <= BVH_LEAF {
+		return node
+	}
+
+	axis := 0
+	for k := 1; k < 3; k++ {
+		if cmax[k]-cmin[k] > cmax[axis]-cmin[axis] {
+			axis = k
+		}
+	}
+	tris := index.triangles[start:end]
+	sort.Slice(tris, func(a, b int) bool {
+		return centroid(&tris[a])[axis] < centroid(&tris[b])[axis]
+	})
+	mid := (start + end) / 2
+	left := index.build(start, mid)
+	right := index.build(mid, end)
+	index.nodes[node].left, index.nodes[node].right = left, right
+	return node
+}
+
+//centroid - Mean of the triangle vertexes
+func centroid(tri *Triangle) Vec.Vec32 {
+	return Vec.Scale(Vec.Add(Vec.Add(*tri.Verts[0], *tri.Verts[1]), *tri.Verts[2]), 1.0/3)
+}
+
+//crossings - Triangles hit by the ray, visiting only the subtrees whose box the ray enters
+func (index *triangleIndex) crossings(origin Vec.Vec32, dir Vec.Vec32) int {
+	if len(index.nodes) == 0 {
+		return 0
+	}
+	hits := 0
+	stack := []int{0}
+	for len(stack) > 0 {
+		n := &index.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if !rayBox(origin, dir, n.min, n.max) {
+			continue
+		}
+		if n.left < 0 {
+			for t := n.start; t < n.end; t++ {
+				if _, hit := index.triangles[t].RayIntersect(origin, dir); hit {
+					hits++
+				}
+			}
+			continue
+		}
+		stack = append(stack, n.left, n.right)
+	}
+	return hits
+}
+
+//rayBox - Slab test of the half line origin + t * dir, t >= 0, against a box padded for rounding
+func rayBox(origin Vec.Vec32, dir Vec.Vec32, min Vec.Vec32, max Vec.Vec32) bool {
+	const pad = 1e-5
+	near, far := float32(0), float32(Math.Inf(1))
+	for k := 0; k < 3; k++ {
+		lo := min[k] - pad*(1+float32(Math.Abs(float64(min[k]))))
+		hi := max[k] + pad*(1+float32(Math.Abs(float64(max[k]))))
+		if dir[k] == 0 {
+			if origin[k] < lo || origin[k] > hi {
+				return false
+			}
+			continue
+		}
+		t0, t1 := (lo-origin[k])/dir[k], (hi-origin[k])/dir[k]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		near = float32(Math.Max(float64(near), float64(t0)))
+		far = float32(Math.Min(float64(far), float64(t1)))
+		if near > far {
+			return false
+		}
+	}
+	return true
+}
+
+//Bounds - Axis aligned bounding box of the mesh vertexes
+func (g *Mesh) Bounds() (Vec.Vec32, Vec.Vec32) {
+	index := g.triangles()
+	return index.min, index.max
+}
+
+//vertexBounds - Axis aligned bounding box of a vertex list
+func vertexBounds(vertexes []Vec.Vec32) (Vec.Vec32, Vec.Vec32) {
+	inf := float32(Math.Inf(1))
+	min := Vec.Vec32{inf, inf, inf}
+	max := Vec.Vec32{-inf, -inf, -inf}
+	for _, v := range vertexes {
+		for k := 0; k < 3; k++ {
+			min[k] = float32(Math.Min(float64(min[k]), float64(v[k])))
+			max[k] = float32(Math.Max(float64(max[k]), float64(v[k])))
+		}
+	}
+	return min, max
+}
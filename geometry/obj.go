@@ -0,0 +1,104 @@
+package geometry
+
+import (
+	"bufio"
+	Vec "diesel.com/diesel/vector"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//Wavefront OBJ collider import. Only vertex positions (v) and faces (f) are read, polygons are
+//triangulated as fans. Texture coordinates, normals, groups and materials are ignored
+
+//LoadOBJ - Reads a triangle mesh from an OBJ file
+func LoadOBJ(path string) (*Mesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mesh, err := ReadOBJ(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return mesh, nil
+}
+
+//ReadOBJ - Parses OBJ data into a triangle mesh. Face indices may be negative (relative to the end)
+func ReadOBJ(r io.Reader) (*Mesh, error) {
+	var positions []Vec.Vec32
+	var verts []Vec.Vec32
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("line %d: vertex needs 3 coordinates", line)
+			}
+			v := Vec.Vec32{}
+			for k := 0; k < 3; k++ {
+				x, err := strconv.ParseFloat(fields[k+1], 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", line, err.Error())
+				}
+				v[k] = float32(x)
+			}
+			positions = append(positions, v)
+		case "f":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("line %d: face needs at least 3 vertices", line)
+			}
+			face := make([]Vec.Vec32, len(fields)-1)
+			for k, ref := range fields[1:] {
+				idx, err := strconv.Atoi(strings.SplitN(ref, "/", 2)[0])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", line, err.Error())
+				}
+				if idx < 0 {
+					idx = len(positions) + idx + 1
+				}
+				if idx < 1 || idx > len(positions) {
+					return nil, fmt.Errorf("line %d: vertex index %s out of range", line, ref)
+				}
+				face[k] = positions[idx-1]
+			}
+			for k := 1; k+1 < len(face); k++ {
+				verts = append(verts, face[0], face[k], face[k+1])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(verts) == 0 {
+		return nil, fmt.Errorf("no faces")
+	}
+	mesh := InitMesh(verts)
+	return &mesh, nil
+}
+
+//Transform - Scales the mesh about the origin and then translates it. Normals keep their direction
+//for positive scales
+func (g *Mesh) Transform(scale float32, offset Vec.Vec32) {
+	for i := range g.Vertexes {
+		g.Vertexes[i] = Vec.Add(Vec.Scale(g.Vertexes[i], scale), offset)
+	}
+	g.Invalidate()
+}
+
+//Merge - Appends the triangles of another mesh
+func (g *Mesh) Merge(m *Mesh) {
+	g.Vertexes = append(g.Vertexes, m.Vertexes...)
+	g.Normals = append(g.Normals, m.Normals...)
+	g.Invalidate()
+}
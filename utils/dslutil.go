@@ -30,3 +30,27 @@ func TransferPositionData(graphicsPtr unsafe.Pointer, posArray []V.Vec32, count
 
 	return nil
 }
+
+//Transfers a per particle scalar (i.e. dye concentration) normalized into [0, 1] by min / max so it can be
+//bound as a color attribute next to the position buffer. Same unsafe streaming as TransferPositionData
+func TransferScalarData(graphicsPtr unsafe.Pointer, values []float32, min float32, max float32, count int) error {
+	if count <= 0 || count > len(values) {
+		return fmt.Errorf("Size of scalar data buffer transfer out of bounds: %d\n", count)
+	}
+
+	if graphicsPtr == nil {
+		return fmt.Errorf("No Valid Pointer to Graphics Memory Location\n")
+	}
+
+	scale := float32(1.0)
+	if max > min {
+		scale = 1 / (max - min)
+	}
+
+	for i := 0; i < count; i++ {
+		streamPtr := (*float32)(unsafe.Pointer(uintptr(graphicsPtr) + unsafe.Sizeof(values[0])*uintptr(i)))
+		*streamPtr = (values[i] - min) * scale
+	}
+
+	return nil
+}
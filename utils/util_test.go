@@ -20,3 +20,19 @@ func TestTransfer(t *testing.T) {
 	}
 
 }
+
+func TestScalarTransfer(t *testing.T) {
+	var values = []float32{2, 4, 6}
+	var out = []float32{0, 0, 0}
+
+	if err := TransferScalarData(unsafe.Pointer(&out[0]), values, 2, 6, len(values)); err != nil {
+		t.Errorf("Scalar transfer failed %s\n", err.Error())
+	}
+
+	expected := []float32{0, 0.5, 1}
+	for i := range expected {
+		if out[i] != expected[i] {
+			t.Errorf("Improper Scalar Buffer Load at index %d: %f\n", i, out[i])
+		}
+	}
+}